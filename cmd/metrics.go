@@ -0,0 +1,26 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/Jamescog/bttclient/pkg/client"
+)
+
+// serveMetrics exposes the client's Prometheus metrics at /metrics on addr
+// in the background.
+func serveMetrics(c *client.Client, addr string) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("failed to listen for -metrics: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", c.MetricsHandler())
+	log.Printf("Serving metrics on http://%s/metrics", ln.Addr())
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			log.Printf("metrics: %v", err)
+		}
+	}()
+}
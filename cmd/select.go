@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/Jamescog/bttclient/pkg/client"
+)
+
+// selectFiles skips every file of t not matched by spec, a comma separated
+// list of file indices and glob patterns. Patterns match the file's path
+// inside the torrent or its base name.
+func selectFiles(t *client.Torrent, spec string) error {
+	files := t.Files()
+	priorities := make([]client.Priority, len(files))
+	matched := 0
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		if index, err := strconv.Atoi(item); err == nil {
+			if index < 0 || index >= len(files) {
+				return fmt.Errorf("file index %d out of range (0-%d)", index, len(files)-1)
+			}
+			priorities[index] = client.PriorityNormal
+			matched++
+			continue
+		}
+
+		found := false
+		for i, f := range files {
+			name := torrentPath(f.Path)
+			full, err := path.Match(item, name)
+			if err != nil {
+				return fmt.Errorf("bad pattern %q: %w", item, err)
+			}
+			base, _ := path.Match(item, path.Base(name))
+			if full || base {
+				priorities[i] = client.PriorityNormal
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("no file matches %q", item)
+		}
+		matched++
+	}
+
+	if matched == 0 {
+		return fmt.Errorf("no files selected")
+	}
+	return t.SetFilePriorities(priorities)
+}
+
+// torrentPath returns a file's path inside the torrent, without the torrent
+// name that prefixes multi-file paths.
+func torrentPath(p []string) string {
+	if len(p) > 1 {
+		p = p[1:]
+	}
+	return strings.Join(p, "/")
+}
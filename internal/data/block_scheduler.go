@@ -0,0 +1,219 @@
+package data
+
+import (
+	"sort"
+	"time"
+)
+
+// BlockRef identifies a single block within a piece.
+type BlockRef struct {
+	Piece uint32
+	Block uint32
+}
+
+// NextBlocksForPeer picks up to count blocks that peerIP can serve and that
+// nobody has requested yet. Pieces already in progress are drained first so
+// partially downloaded pieces complete before new ones are started; a new
+// piece is only opened when no in-progress piece has a free block. Snubbed
+// peers are kept off in-progress pieces that another peer can serve so they
+// cannot hold them up again.
+// The returned blocks are recorded as requested from peerIP.
+func (s *Swarm) NextBlocksForPeer(peerIP string, count int) []BlockRef {
+	if count <= 0 {
+		return nil
+	}
+
+	s.clientsMu.RLock()
+	client, exists := s.clients[peerIP]
+	s.clientsMu.RUnlock()
+	if !exists {
+		return nil
+	}
+
+	var picked []BlockRef
+
+	client.Mu.Lock()
+	snubbed := client.Snubbed
+	client.Mu.Unlock()
+
+	for _, pieceIndex := range s.inProgressPieces() {
+		if len(picked) >= count {
+			break
+		}
+		if !client.HasPiece(pieceIndex) {
+			continue
+		}
+		if snubbed && s.hasOtherSource(pieceIndex, peerIP) {
+			continue
+		}
+		picked = append(picked, s.claimBlocks(pieceIndex, peerIP, count-len(picked))...)
+	}
+
+	for len(picked) < count {
+		pieceIndex := s.SelectNextPiece(peerIP)
+		if pieceIndex < 0 {
+			break
+		}
+		s.GetOrCreatePieceState(uint32(pieceIndex))
+		claimed := s.claimBlocks(uint32(pieceIndex), peerIP, count-len(picked))
+		if len(claimed) == 0 {
+			break
+		}
+		picked = append(picked, claimed...)
+	}
+
+	if len(picked) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	client.Mu.Lock()
+	if client.Requests == nil {
+		client.Requests = make(map[BlockRef]time.Time)
+	}
+	for _, ref := range picked {
+		client.Requests[ref] = now
+	}
+	client.Mu.Unlock()
+
+	return picked
+}
+
+// inProgressPieces returns the indices of started but unfinished pieces in
+// ascending order.
+func (s *Swarm) inProgressPieces() []uint32 {
+	s.piecesMu.RLock()
+	defer s.piecesMu.RUnlock()
+
+	pieces := make([]uint32, 0, len(s.pieces))
+	for index, piece := range s.pieces {
+		piece.Mu.Lock()
+		if piece.IsRequested && !piece.IsComplete {
+			pieces = append(pieces, index)
+		}
+		piece.Mu.Unlock()
+	}
+	sort.Slice(pieces, func(i, j int) bool { return pieces[i] < pieces[j] })
+	return pieces
+}
+
+// claimBlocks marks up to count free blocks of a piece as requested from
+// peerIP and returns them. A block that timed out from peerIP is left to
+// other peers only while one of them can serve it; otherwise the piece
+// would never complete.
+func (s *Swarm) claimBlocks(pieceIndex uint32, peerIP string, count int) []BlockRef {
+	piece, exists := s.GetPieceState(pieceIndex)
+	if !exists {
+		return nil
+	}
+	otherSource := s.hasOtherSource(pieceIndex, peerIP)
+
+	piece.Mu.Lock()
+	defer piece.Mu.Unlock()
+
+	var claimed []BlockRef
+	for blockIndex := uint32(0); blockIndex < piece.TotalBlocks && len(claimed) < count; blockIndex++ {
+		if piece.ReceivedBlocks[blockIndex] {
+			continue
+		}
+		if _, requested := piece.RequestedBlocks[blockIndex]; requested {
+			continue
+		}
+		if piece.TimedOutBlocks[blockIndex] == peerIP && otherSource {
+			continue
+		}
+		delete(piece.TimedOutBlocks, blockIndex)
+		piece.RequestedBlocks[blockIndex] = peerIP
+		claimed = append(claimed, BlockRef{Piece: pieceIndex, Block: blockIndex})
+	}
+	if len(claimed) > 0 {
+		piece.IsRequested = true
+	}
+	return claimed
+}
+
+// hasOtherSource reports whether a peer other than peerIP has the piece,
+// is unchoking us and is not snubbed.
+func (s *Swarm) hasOtherSource(pieceIndex uint32, peerIP string) bool {
+	s.clientsMu.RLock()
+	defer s.clientsMu.RUnlock()
+
+	for ip, client := range s.clients {
+		if ip == peerIP {
+			continue
+		}
+		client.Mu.Lock()
+		usable := !client.Choked && !client.Snubbed && client.Pieces.Has(pieceIndex)
+		client.Mu.Unlock()
+		if usable {
+			return true
+		}
+	}
+	return false
+}
+
+// CompleteBlockRequest clears the outstanding request for a block once its
+// data has arrived from peerIP and updates the peer's pipeline measurements.
+func (s *Swarm) CompleteBlockRequest(peerIP string, ref BlockRef, size int) {
+	s.clientsMu.RLock()
+	client, exists := s.clients[peerIP]
+	s.clientsMu.RUnlock()
+	if !exists {
+		return
+	}
+
+	now := time.Now()
+	client.Mu.Lock()
+	requestedAt := client.Requests[ref]
+	delete(client.Requests, ref)
+	client.Pipeline.recordBlock(size, requestedAt, now)
+	client.LastBlockAt = now
+	client.Snubbed = false
+	client.Mu.Unlock()
+}
+
+// PendingRequests returns how many block requests are outstanding to peerIP.
+func (s *Swarm) PendingRequests(peerIP string) int {
+	s.clientsMu.RLock()
+	client, exists := s.clients[peerIP]
+	s.clientsMu.RUnlock()
+	if !exists {
+		return 0
+	}
+
+	client.Mu.Lock()
+	defer client.Mu.Unlock()
+	return len(client.Requests)
+}
+
+// ReleasePeerRequests returns every block still requested from peerIP to the
+// pool. It is called when the peer chokes us or disconnects, since the peer
+// will not answer those requests anymore.
+func (s *Swarm) ReleasePeerRequests(peerIP string) {
+	s.clientsMu.RLock()
+	client, exists := s.clients[peerIP]
+	s.clientsMu.RUnlock()
+	if !exists {
+		return
+	}
+
+	client.Mu.Lock()
+	refs := make([]BlockRef, 0, len(client.Requests))
+	for ref := range client.Requests {
+		refs = append(refs, ref)
+	}
+	client.Requests = make(map[BlockRef]time.Time)
+	client.Mu.Unlock()
+
+	for _, ref := range refs {
+		piece, exists := s.GetPieceState(ref.Piece)
+		if !exists {
+			continue
+		}
+		piece.Mu.Lock()
+		if owner, ok := piece.RequestedBlocks[ref.Block]; ok && owner == peerIP {
+			delete(piece.RequestedBlocks, ref.Block)
+		}
+		piece.Mu.Unlock()
+	}
+}
@@ -0,0 +1,116 @@
+package data
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Jamescog/bttclient/pkg/protocol"
+	"github.com/Jamescog/bttclient/pkg/storage"
+)
+
+// newTestSwarm returns a swarm of one 64 KiB piece, four blocks long.
+func newTestSwarm(t *testing.T) *Swarm {
+	t.Helper()
+	geometry, err := storage.NewGeometry(65536, 65536)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewSwarm(geometry)
+}
+
+// addSeeder adds an unchoking peer that has every piece.
+func addSeeder(s *Swarm, ip string) {
+	pieces := protocol.NewBitfield(s.NumPieces)
+	pieces.SetAll()
+	s.AddPiecesForClient(ip, 6881, pieces)
+	s.UnchokeClient(ip)
+}
+
+func refSet(refs []BlockRef) map[BlockRef]bool {
+	set := make(map[BlockRef]bool, len(refs))
+	for _, ref := range refs {
+		set[ref] = true
+	}
+	return set
+}
+
+func TestTimedOutBlocksReturnToSolePeer(t *testing.T) {
+	// After 30s the requests have timed out; after a minute without a block
+	// the peer is snubbed as well.
+	for _, after := range []time.Duration{30 * time.Second, time.Minute} {
+		s := newTestSwarm(t)
+		addSeeder(s, "10.0.0.1")
+
+		first := s.NextBlocksForPeer("10.0.0.1", 2)
+		if len(first) != 2 {
+			t.Fatalf("claimed %v, want 2 blocks", first)
+		}
+		expired := s.ExpireRequests("10.0.0.1", time.Now().Add(after))
+		if len(expired) != 2 {
+			t.Fatalf("after %v: expired %v, want the 2 requested blocks", after, expired)
+		}
+
+		// The peer is the only source, so the timed-out blocks go back to it
+		// instead of leaving the piece stuck in progress.
+		again := refSet(s.NextBlocksForPeer("10.0.0.1", 4))
+		if len(again) != 4 {
+			t.Fatalf("after %v: claimed %d blocks, want all 4", after, len(again))
+		}
+		for _, ref := range first {
+			if !again[ref] {
+				t.Errorf("after %v: timed-out block %v not requested again", after, ref)
+			}
+		}
+	}
+}
+
+func TestTimedOutBlocksGoToOtherPeer(t *testing.T) {
+	tests := []struct {
+		name        string
+		other       func(s *Swarm, ip string)
+		otherServes bool
+	}{
+		{"unchoked", func(s *Swarm, ip string) {}, true},
+		{"choked", func(s *Swarm, ip string) { s.ChokeClient(ip) }, false},
+		{"snubbed", func(s *Swarm, ip string) {
+			client, _ := s.GetClient(ip)
+			client.Mu.Lock()
+			client.Snubbed = true
+			client.Mu.Unlock()
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestSwarm(t)
+			addSeeder(s, "10.0.0.1")
+			addSeeder(s, "10.0.0.2")
+			tt.other(s, "10.0.0.2")
+
+			timedOut := s.NextBlocksForPeer("10.0.0.1", 1)
+			if len(timedOut) != 1 {
+				t.Fatalf("claimed %v, want 1 block", timedOut)
+			}
+			s.ExpireRequests("10.0.0.1", time.Now().Add(time.Minute))
+
+			retried := refSet(s.NextBlocksForPeer("10.0.0.1", 4))
+			if retried[timedOut[0]] == tt.otherServes {
+				t.Fatalf("block %v handed back to the peer it timed out from: %v, want %v",
+					timedOut[0], retried[timedOut[0]], !tt.otherServes)
+			}
+			if !tt.otherServes {
+				return
+			}
+
+			// Once the other peer claims the block, the timeout is forgotten.
+			if !refSet(s.NextBlocksForPeer("10.0.0.2", 4))[timedOut[0]] {
+				t.Fatalf("block %v not handed to the other peer", timedOut[0])
+			}
+			piece, _ := s.GetPieceState(timedOut[0].Piece)
+			piece.Mu.Lock()
+			defer piece.Mu.Unlock()
+			if owner, ok := piece.TimedOutBlocks[timedOut[0].Block]; ok {
+				t.Fatalf("block %v still marked as timed out from %s", timedOut[0], owner)
+			}
+		})
+	}
+}
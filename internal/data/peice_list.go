@@ -1,9 +1,12 @@
 package data
 
 import (
-	"log"
 	"math/rand"
 	"sync"
+	"time"
+
+	"github.com/Jamescog/bttclient/pkg/protocol"
+	"github.com/Jamescog/bttclient/pkg/storage"
 )
 
 type PieceState struct {
@@ -21,60 +24,135 @@ type PieceState struct {
 	BlockSize       uint32
 	TotalBlocks     uint32
 	ReceivedBlocks  map[uint32]bool
-	RequestedBlocks map[uint32]bool
+	BlockSources    map[uint32]string // block index -> IP of the peer that sent it
+	RequestedBlocks map[uint32]string // block index -> IP of the peer it was requested from
+	TimedOutBlocks  map[uint32]string // block index -> IP of the peer whose request last timed out
 }
 
 type ClientState struct {
-	Mu     sync.Mutex
-	IP     string
-	Port   int
-	Choked bool
-	Pieces []uint32
-}
-
-var (
-	GlobalClientList = make(map[string]*ClientState)
-	globalMu         sync.RWMutex
-	GlobalPieceList  = make(map[uint32]*PieceState)
-	globalPieceMu    sync.RWMutex
-	TotalFileSize    int64
-	DownloadedBytes  int64
+	Mu       sync.Mutex
+	IP       string
+	Port     int
+	Choked   bool
+	Pieces   protocol.Bitfield
+	Requests map[BlockRef]time.Time // outstanding block requests sent to this peer
+	Pipeline PipelineStats
+
+	LastBlockAt      time.Time // last block received, or the time we were unchoked
+	Snubbed          bool
+	TimedOutRequests int
+}
+
+// Swarm holds the download state of a single torrent: the peers we know and
+// what they have, and the pieces we are fetching.
+type Swarm struct {
+	clientsMu sync.RWMutex
+	clients   map[string]*ClientState
+
+	piecesMu   sync.RWMutex
+	pieces     map[uint32]*PieceState
+	completed  protocol.Bitfield
+	wanted     protocol.Bitfield
+	priorities []int
+	windows    map[int]pieceWindow // reader id -> pieces it needs next
+	sequential bool
+	changed    chan struct{} // closed when a piece is verified
+
+	Geometry  storage.Geometry
+	NumPieces int
+
+	trustMu      sync.Mutex
+	trust        map[string]int // peer IP -> trust points
+	banned       map[string]bool
+	piecesPassed int64
+	piecesFailed int64
+
 	downloadedMu     sync.Mutex
-)
+	downloadedBytes  int64
+	uploadedBytes    int64
+	timedOutRequests int64
+}
 
-func AddPiecesForClient(ip string, port int, pieces []uint32) *ClientState {
-	globalMu.Lock()
-	defer globalMu.Unlock()
+func NewSwarm(geometry storage.Geometry) *Swarm {
+	numPieces := geometry.NumPieces()
+	wanted := protocol.NewBitfield(numPieces)
+	wanted.SetAll()
+	return &Swarm{
+		clients:   make(map[string]*ClientState),
+		pieces:    make(map[uint32]*PieceState),
+		completed: protocol.NewBitfield(numPieces),
+		wanted:    wanted,
+		trust:     make(map[string]int),
+		banned:    make(map[string]bool),
+		Geometry:  geometry,
+		NumPieces: numPieces,
+	}
+}
 
-	if client, exists := GlobalClientList[ip]; exists {
+// SwarmStats is a snapshot of a swarm's progress.
+type SwarmStats struct {
+	Peers            int
+	ActivePeers      int
+	SnubbedPeers     int
+	BannedPeers      int
+	TotalPieces      int
+	CompletedPieces  int
+	WantedPieces     int
+	InProgressPieces int
+	DownloadedBytes  int64
+	UploadedBytes    int64
+	TotalBytes       int64
+	// Totals since the swarm was created.
+	PiecesVerified   int64 // downloaded pieces that passed the hash check
+	PiecesFailed     int64 // downloaded pieces that failed it
+	TimedOutRequests int64
+}
+
+func (s *Swarm) AddPiecesForClient(ip string, port int, pieces protocol.Bitfield) *ClientState {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	if client, exists := s.clients[ip]; exists {
 		client.Mu.Lock()
-		client.Pieces = make([]uint32, len(pieces))
-		copy(client.Pieces, pieces)
+		client.Pieces = pieces.Clone()
 		client.Mu.Unlock()
 		return client
 	}
 
 	client := &ClientState{
-		IP:     ip,
-		Port:   port,
-		Choked: true,
-		Pieces: make([]uint32, len(pieces)),
+		IP:       ip,
+		Port:     port,
+		Choked:   true,
+		Pieces:   pieces.Clone(),
+		Requests: make(map[BlockRef]time.Time),
 	}
-	copy(client.Pieces, pieces)
-	GlobalClientList[ip] = client
+	s.clients[ip] = client
 	return client
 }
 
-func RemoveClient(ip string) {
-	globalMu.Lock()
-	defer globalMu.Unlock()
-	delete(GlobalClientList, ip)
+// RemoveClient drops a peer from the client list and returns any blocks it
+// still had outstanding to the pool so other peers can pick them up.
+func (s *Swarm) RemoveClient(ip string) {
+	s.ReleasePeerRequests(ip)
+
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	delete(s.clients, ip)
+}
+
+// GetClient returns the state tracked for a peer.
+func (s *Swarm) GetClient(ip string) (*ClientState, bool) {
+	s.clientsMu.RLock()
+	defer s.clientsMu.RUnlock()
+
+	client, exists := s.clients[ip]
+	return client, exists
 }
 
-func ChokeClient(ip string) *ClientState {
-	globalMu.RLock()
-	client, exists := GlobalClientList[ip]
-	globalMu.RUnlock()
+func (s *Swarm) ChokeClient(ip string) *ClientState {
+	s.clientsMu.RLock()
+	client, exists := s.clients[ip]
+	s.clientsMu.RUnlock()
 	if !exists {
 		return nil
 	}
@@ -85,83 +163,88 @@ func ChokeClient(ip string) *ClientState {
 	return client
 }
 
-func UnchokeClient(ip string) *ClientState {
-	globalMu.RLock()
-	client, exists := GlobalClientList[ip]
-	globalMu.RUnlock()
+func (s *Swarm) UnchokeClient(ip string) *ClientState {
+	s.clientsMu.RLock()
+	client, exists := s.clients[ip]
+	s.clientsMu.RUnlock()
 	if !exists {
 		return nil
 	}
 
 	client.Mu.Lock()
 	defer client.Mu.Unlock()
+	if client.Choked {
+		client.LastBlockAt = time.Now()
+	}
 	client.Choked = false
 	return client
 }
 
-// PrintClientStates logs the state of all clients in the global list.
-func PrintClientStates() {
-	globalMu.RLock()
-	defer globalMu.RUnlock()
+// Stats returns a snapshot of peer and piece counters.
+func (s *Swarm) Stats() SwarmStats {
+	var st SwarmStats
 
-	totalPeers := len(GlobalClientList)
-	unchokedCount := 0
-
-	for _, client := range GlobalClientList {
+	s.clientsMu.RLock()
+	st.Peers = len(s.clients)
+	for _, client := range s.clients {
 		client.Mu.Lock()
 		if !client.Choked {
-			unchokedCount++
+			st.ActivePeers++
+		}
+		if client.Snubbed {
+			st.SnubbedPeers++
 		}
 		client.Mu.Unlock()
 	}
+	s.clientsMu.RUnlock()
 
-	globalPieceMu.RLock()
-	completedPieces := 0
-	inProgressPieces := 0
-	for _, piece := range GlobalPieceList {
+	s.piecesMu.RLock()
+	for _, piece := range s.pieces {
 		piece.Mu.Lock()
-		if piece.IsComplete && piece.IsVerified {
-			completedPieces++
-		} else if piece.IsRequested {
-			inProgressPieces++
+		if piece.IsRequested && !piece.IsComplete {
+			st.InProgressPieces++
 		}
 		piece.Mu.Unlock()
 	}
-	totalPieces := len(GlobalPieceList)
-	globalPieceMu.RUnlock()
-
-	var piecePercentage float64
-	if totalPieces > 0 {
-		piecePercentage = (float64(completedPieces) / float64(totalPieces)) * 100
-	}
-
-	downloadedMu.Lock()
-	downloaded := DownloadedBytes
-	total := TotalFileSize
-	downloadedMu.Unlock()
-
-	var dataPercentage float64
-	if total > 0 {
-		dataPercentage = (float64(downloaded) / float64(total)) * 100
-	}
+	st.CompletedPieces = s.completed.Count()
+	st.WantedPieces = s.wanted.Count()
+	s.piecesMu.RUnlock()
+
+	s.trustMu.Lock()
+	st.BannedPeers = len(s.banned)
+	st.PiecesVerified = s.piecesPassed
+	st.PiecesFailed = s.piecesFailed
+	s.trustMu.Unlock()
+
+	st.TotalPieces = s.NumPieces
+	st.TotalBytes = s.Geometry.Length
+
+	s.downloadedMu.Lock()
+	st.DownloadedBytes = s.downloadedBytes
+	st.UploadedBytes = s.uploadedBytes
+	st.TimedOutRequests = s.timedOutRequests
+	s.downloadedMu.Unlock()
+
+	return st
+}
 
-	log.Printf("Progress: %d/%d pieces (%.1f%%) | Downloaded: %.2f MB / %.2f MB (%.1f%%) | Peers: %d total, %d active | In progress: %d",
-		completedPieces, totalPieces, piecePercentage,
-		float64(downloaded)/(1024*1024), float64(total)/(1024*1024), dataPercentage,
-		totalPeers, unchokedCount, inProgressPieces)
+func (s *Swarm) AddDownloadedBytes(bytes int64) {
+	s.downloadedMu.Lock()
+	s.downloadedBytes += bytes
+	s.downloadedMu.Unlock()
 }
 
-func AddDownloadedBytes(bytes int64) {
-	downloadedMu.Lock()
-	DownloadedBytes += bytes
-	downloadedMu.Unlock()
+func (s *Swarm) AddUploadedBytes(bytes int64) {
+	s.downloadedMu.Lock()
+	s.uploadedBytes += bytes
+	s.downloadedMu.Unlock()
 }
 
-func ResetPieceForRetry(pieceIndex uint32) {
-	globalPieceMu.Lock()
-	defer globalPieceMu.Unlock()
+func (s *Swarm) ResetPieceForRetry(pieceIndex uint32) {
+	s.piecesMu.Lock()
+	defer s.piecesMu.Unlock()
 
-	piece, exists := GlobalPieceList[pieceIndex]
+	piece, exists := s.pieces[pieceIndex]
 	if !exists {
 		return
 	}
@@ -173,35 +256,33 @@ func ResetPieceForRetry(pieceIndex uint32) {
 	piece.IsComplete = false
 	piece.IsVerified = false
 	piece.ReceivedBlocks = make(map[uint32]bool)
-	piece.RequestedBlocks = make(map[uint32]bool)
+	piece.BlockSources = make(map[uint32]string)
+	piece.RequestedBlocks = make(map[uint32]string)
+	piece.TimedOutBlocks = make(map[uint32]string)
 }
 
-func AddHavePiece(ip string, port int, piece uint32) *ClientState {
-	globalMu.Lock()
-	client, exists := GlobalClientList[ip]
+func (s *Swarm) AddHavePiece(ip string, port int, piece uint32) *ClientState {
+	s.clientsMu.Lock()
+	client, exists := s.clients[ip]
 	if !exists {
 		client = &ClientState{
-			IP:     ip,
-			Port:   port,
-			Choked: true,
-			Pieces: []uint32{piece},
+			IP:       ip,
+			Port:     port,
+			Choked:   true,
+			Pieces:   protocol.NewBitfield(s.NumPieces),
+			Requests: make(map[BlockRef]time.Time),
 		}
-		GlobalClientList[ip] = client
-		globalMu.Unlock()
-		return client
+		s.clients[ip] = client
 	}
-	globalMu.Unlock()
+	s.clientsMu.Unlock()
 
 	client.Mu.Lock()
 	defer client.Mu.Unlock()
 
-	for _, p := range client.Pieces {
-		if p == piece {
-			return client
-		}
+	if client.Pieces.Len() == 0 {
+		client.Pieces = protocol.NewBitfield(s.NumPieces)
 	}
-
-	client.Pieces = append(client.Pieces, piece)
+	client.Pieces.Set(piece)
 	return client
 }
 
@@ -215,12 +296,7 @@ func (cs *ClientState) IsChoked() bool {
 func (cs *ClientState) HasPiece(piece uint32) bool {
 	cs.Mu.Lock()
 	defer cs.Mu.Unlock()
-	for _, p := range cs.Pieces {
-		if p == piece {
-			return true
-		}
-	}
-	return false
+	return cs.Pieces.Has(piece)
 }
 
 func (cs *ClientState) SetChoked(choked bool) {
@@ -241,11 +317,11 @@ func (ps *PieceState) WriteData(offset uint64, data []byte) {
 	}
 }
 
-func IsPieceComplete(pieceIndex uint32) bool {
-	globalPieceMu.RLock()
-	defer globalPieceMu.RUnlock()
+func (s *Swarm) IsPieceComplete(pieceIndex uint32) bool {
+	s.piecesMu.RLock()
+	defer s.piecesMu.RUnlock()
 
-	piece, exists := GlobalPieceList[pieceIndex]
+	piece, exists := s.pieces[pieceIndex]
 	if !exists {
 		return false
 	}
@@ -255,11 +331,11 @@ func IsPieceComplete(pieceIndex uint32) bool {
 	return piece.IsComplete && piece.IsVerified
 }
 
-func IsPieceBeingRequested(pieceIndex uint32) bool {
-	globalPieceMu.RLock()
-	defer globalPieceMu.RUnlock()
+func (s *Swarm) IsPieceBeingRequested(pieceIndex uint32) bool {
+	s.piecesMu.RLock()
+	defer s.piecesMu.RUnlock()
 
-	piece, exists := GlobalPieceList[pieceIndex]
+	piece, exists := s.pieces[pieceIndex]
 	if !exists {
 		return false
 	}
@@ -269,10 +345,10 @@ func IsPieceBeingRequested(pieceIndex uint32) bool {
 	return piece.IsRequested && !piece.IsComplete
 }
 
-func MarkPieceAsRequested(pieceIndex uint32) {
-	globalPieceMu.RLock()
-	piece, exists := GlobalPieceList[pieceIndex]
-	globalPieceMu.RUnlock()
+func (s *Swarm) MarkPieceAsRequested(pieceIndex uint32) {
+	s.piecesMu.RLock()
+	piece, exists := s.pieces[pieceIndex]
+	s.piecesMu.RUnlock()
 
 	if !exists {
 		return
@@ -283,53 +359,105 @@ func MarkPieceAsRequested(pieceIndex uint32) {
 	piece.Mu.Unlock()
 }
 
-func SelectNextPiece(peerIP string) int32 {
-	globalMu.RLock()
-	client, exists := GlobalClientList[peerIP]
-	globalMu.RUnlock()
+func (s *Swarm) SelectNextPiece(peerIP string) int32 {
+	s.clientsMu.RLock()
+	client, exists := s.clients[peerIP]
+	s.clientsMu.RUnlock()
 
 	if !exists {
 		return -1
 	}
 
 	client.Mu.Lock()
-	peerPieces := make([]uint32, len(client.Pieces))
-	copy(peerPieces, client.Pieces)
+	peerPieces := client.Pieces.Clone()
 	client.Mu.Unlock()
 
+	if urgent := s.urgentPiece(peerPieces.Has); urgent >= 0 {
+		return urgent
+	}
+
+	s.piecesMu.RLock()
+	wanted := peerPieces.And(s.wanted.AndNot(s.completed))
+	sequential := s.sequential
+	s.piecesMu.RUnlock()
+
+	// Only the highest priority pieces the peer has are candidates.
 	candidates := []uint32{}
+	best := 0
 
-	for _, pieceIndex := range peerPieces {
-		if IsPieceComplete(pieceIndex) {
+	for pieceIndex := range wanted.All() {
+		if s.IsPieceBeingRequested(pieceIndex) {
 			continue
 		}
 
-		if IsPieceBeingRequested(pieceIndex) {
-			continue
+		priority := s.PiecePriority(pieceIndex)
+		if priority > best {
+			best = priority
+			candidates = candidates[:0]
+		}
+		if priority == best {
+			candidates = append(candidates, pieceIndex)
 		}
-
-		candidates = append(candidates, pieceIndex)
 	}
 
 	if len(candidates) == 0 {
 		return -1
 	}
 
+	if sequential {
+		return int32(candidates[0])
+	}
+
 	randomIndex := rand.Intn(len(candidates))
 	selectedPiece := candidates[randomIndex]
 
 	return int32(selectedPiece)
 }
 
-func GetOrCreatePieceState(pieceIndex uint32, pieceLength uint64) *PieceState {
-	globalPieceMu.Lock()
-	defer globalPieceMu.Unlock()
+// MarkPieceVerified records that a piece passed its hash check.
+func (s *Swarm) MarkPieceVerified(pieceIndex uint32) {
+	piece, exists := s.GetPieceState(pieceIndex)
+	if exists {
+		piece.Mu.Lock()
+		piece.IsVerified = true
+		piece.IsSaved = true
+		piece.Mu.Unlock()
+	}
+
+	s.piecesMu.Lock()
+	s.completed.Set(pieceIndex)
+	s.notifyLocked()
+	s.piecesMu.Unlock()
+}
+
+// MarkPieceUnverified drops a piece from the verified set so it is
+// downloaded again, e.g. after a recheck found its data corrupt.
+func (s *Swarm) MarkPieceUnverified(pieceIndex uint32) {
+	s.piecesMu.Lock()
+	s.completed.Clear(pieceIndex)
+	delete(s.pieces, pieceIndex)
+	s.piecesMu.Unlock()
+}
+
+// CompletedPieces returns a copy of the set of verified pieces.
+func (s *Swarm) CompletedPieces() protocol.Bitfield {
+	s.piecesMu.RLock()
+	defer s.piecesMu.RUnlock()
+	return s.completed.Clone()
+}
+
+// GetOrCreatePieceState returns the download state of a piece, sized to the
+// piece's true length.
+func (s *Swarm) GetOrCreatePieceState(pieceIndex uint32) *PieceState {
+	s.piecesMu.Lock()
+	defer s.piecesMu.Unlock()
 
-	piece, exists := GlobalPieceList[pieceIndex]
+	piece, exists := s.pieces[pieceIndex]
 	if exists {
 		return piece
 	}
 
+	pieceLength := uint64(s.Geometry.PieceSize(pieceIndex))
 	blockSize := uint32(16384)
 	totalBlocks := uint32((pieceLength + uint64(blockSize) - 1) / uint64(blockSize))
 
@@ -343,23 +471,25 @@ func GetOrCreatePieceState(pieceIndex uint32, pieceLength uint64) *PieceState {
 		BlockSize:       blockSize,
 		TotalBlocks:     totalBlocks,
 		ReceivedBlocks:  make(map[uint32]bool),
-		RequestedBlocks: make(map[uint32]bool),
+		BlockSources:    make(map[uint32]string),
+		RequestedBlocks: make(map[uint32]string),
+		TimedOutBlocks:  make(map[uint32]string),
 	}
 
-	GlobalPieceList[pieceIndex] = piece
+	s.pieces[pieceIndex] = piece
 	return piece
 }
 
-func GetPieceState(pieceIndex uint32) (*PieceState, bool) {
-	globalPieceMu.RLock()
-	defer globalPieceMu.RUnlock()
+func (s *Swarm) GetPieceState(pieceIndex uint32) (*PieceState, bool) {
+	s.piecesMu.RLock()
+	defer s.piecesMu.RUnlock()
 
-	piece, exists := GlobalPieceList[pieceIndex]
+	piece, exists := s.pieces[pieceIndex]
 	return piece, exists
 }
 
-func IsPieceFullyReceived(pieceIndex uint32) bool {
-	piece, exists := GetPieceState(pieceIndex)
+func (s *Swarm) IsPieceFullyReceived(pieceIndex uint32) bool {
+	piece, exists := s.GetPieceState(pieceIndex)
 	if !exists {
 		return false
 	}
@@ -370,24 +500,35 @@ func IsPieceFullyReceived(pieceIndex uint32) bool {
 	return uint32(len(piece.ReceivedBlocks)) == piece.TotalBlocks
 }
 
-func MarkBlockReceived(pieceIndex, blockIndex uint32) {
-	piece, exists := GetPieceState(pieceIndex)
+// MarkBlockReceived stores a block received from peerIP in the piece
+// buffer. It reports whether this call completed the piece, so that when
+// several peers deliver its last blocks at once only one of them goes on
+// to verify it. Duplicate blocks are dropped.
+func (s *Swarm) MarkBlockReceived(pieceIndex, blockIndex uint32, peerIP string, block []byte) bool {
+	piece, exists := s.GetPieceState(pieceIndex)
 	if !exists {
-		return
+		return false
 	}
 
 	piece.Mu.Lock()
 	defer piece.Mu.Unlock()
 
+	if piece.ReceivedBlocks[blockIndex] {
+		return false
+	}
+	copy(piece.Buffer[blockIndex*piece.BlockSize:], block)
 	piece.ReceivedBlocks[blockIndex] = true
+	piece.BlockSources[blockIndex] = peerIP
 
 	if uint32(len(piece.ReceivedBlocks)) == piece.TotalBlocks {
 		piece.IsComplete = true
+		return true
 	}
+	return false
 }
 
-func MarkBlockRequested(pieceIndex, blockIndex uint32) {
-	piece, exists := GetPieceState(pieceIndex)
+func (s *Swarm) MarkBlockRequested(pieceIndex, blockIndex uint32, peerIP string) {
+	piece, exists := s.GetPieceState(pieceIndex)
 	if !exists {
 		return
 	}
@@ -395,11 +536,11 @@ func MarkBlockRequested(pieceIndex, blockIndex uint32) {
 	piece.Mu.Lock()
 	defer piece.Mu.Unlock()
 
-	piece.RequestedBlocks[blockIndex] = true
+	piece.RequestedBlocks[blockIndex] = peerIP
 }
 
-func IsBlockRequested(pieceIndex, blockIndex uint32) bool {
-	piece, exists := GetPieceState(pieceIndex)
+func (s *Swarm) IsBlockRequested(pieceIndex, blockIndex uint32) bool {
+	piece, exists := s.GetPieceState(pieceIndex)
 	if !exists {
 		return false
 	}
@@ -407,11 +548,12 @@ func IsBlockRequested(pieceIndex, blockIndex uint32) bool {
 	piece.Mu.Lock()
 	defer piece.Mu.Unlock()
 
-	return piece.RequestedBlocks[blockIndex]
+	_, requested := piece.RequestedBlocks[blockIndex]
+	return requested
 }
 
-func IsBlockReceived(pieceIndex, blockIndex uint32) bool {
-	piece, exists := GetPieceState(pieceIndex)
+func (s *Swarm) IsBlockReceived(pieceIndex, blockIndex uint32) bool {
+	piece, exists := s.GetPieceState(pieceIndex)
 	if !exists {
 		return false
 	}
@@ -0,0 +1,111 @@
+package data
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// DefaultMaxRequests is the request queue limit assumed for peers that do
+	// not advertise reqq in their extension handshake.
+	DefaultMaxRequests = 250
+	// minPipelineDepth keeps a couple of requests in flight before we have any
+	// measurements and for very slow peers.
+	minPipelineDepth = 2
+	// initialPipelineDepth is used until the first throughput sample exists.
+	initialPipelineDepth = 5
+
+	throughputWindow = time.Second
+	throughputAlpha  = 0.3
+	latencyAlpha     = 0.125
+	pipelineBlock    = 16384
+)
+
+// PipelineStats holds the per-peer measurements used to size the request
+// pipeline.
+type PipelineStats struct {
+	Throughput  float64       // smoothed bytes per second received from the peer
+	Latency     time.Duration // smoothed time between a request and its block
+	MaxRequests int           // reqq advertised by the peer
+
+	windowStart time.Time
+	windowBytes int64
+}
+
+// recordBlock folds a received block into the throughput and latency
+// averages. requestedAt is zero if the block was not requested from this peer.
+func (ps *PipelineStats) recordBlock(size int, requestedAt, now time.Time) {
+	if !requestedAt.IsZero() {
+		sample := now.Sub(requestedAt)
+		if ps.Latency == 0 {
+			ps.Latency = sample
+		} else {
+			ps.Latency += time.Duration(latencyAlpha * float64(sample-ps.Latency))
+		}
+	}
+
+	if ps.windowStart.IsZero() {
+		ps.windowStart = now
+	}
+	ps.windowBytes += int64(size)
+
+	elapsed := now.Sub(ps.windowStart)
+	if elapsed < throughputWindow {
+		return
+	}
+
+	rate := float64(ps.windowBytes) / elapsed.Seconds()
+	if ps.Throughput == 0 {
+		ps.Throughput = rate
+	} else {
+		ps.Throughput += throughputAlpha * (rate - ps.Throughput)
+	}
+	ps.windowStart = now
+	ps.windowBytes = 0
+}
+
+// depth returns the number of requests to keep in flight: the
+// bandwidth-delay product in blocks plus one block of headroom, bounded by
+// the peer's advertised queue size.
+func (ps *PipelineStats) depth() int {
+	limit := ps.MaxRequests
+	if limit <= 0 {
+		limit = DefaultMaxRequests
+	}
+
+	depth := initialPipelineDepth
+	if ps.Throughput > 0 && ps.Latency > 0 {
+		bdp := ps.Throughput * ps.Latency.Seconds() / pipelineBlock
+		depth = int(math.Ceil(bdp)) + 1
+	}
+
+	return max(minPipelineDepth, min(depth, limit))
+}
+
+// PipelineDepth returns how many block requests should be outstanding to
+// peerIP at once.
+func (s *Swarm) PipelineDepth(peerIP string) int {
+	client, exists := s.GetClient(peerIP)
+	if !exists {
+		return minPipelineDepth
+	}
+
+	client.Mu.Lock()
+	defer client.Mu.Unlock()
+	if client.Snubbed {
+		return 1
+	}
+	return client.Pipeline.depth()
+}
+
+// SetPeerMaxRequests records the reqq value a peer advertised.
+func (s *Swarm) SetPeerMaxRequests(peerIP string, reqq int) {
+	client, exists := s.GetClient(peerIP)
+	if !exists {
+		return
+	}
+
+	client.Mu.Lock()
+	client.Pipeline.MaxRequests = reqq
+	client.Mu.Unlock()
+}
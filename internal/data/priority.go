@@ -0,0 +1,48 @@
+package data
+
+import "github.com/Jamescog/bttclient/pkg/protocol"
+
+// SetPiecePriorities sets how eagerly each piece is fetched. Priority 0
+// means the piece is not wanted; otherwise higher priorities are picked
+// first. Pieces missing from priorities keep priority 1.
+func (s *Swarm) SetPiecePriorities(priorities []int) {
+	wanted := protocol.NewBitfield(s.NumPieces)
+	for i := range s.NumPieces {
+		if i >= len(priorities) || priorities[i] > 0 {
+			wanted.Set(uint32(i))
+		}
+	}
+
+	s.piecesMu.Lock()
+	s.priorities = append([]int(nil), priorities...)
+	s.wanted = wanted
+	s.piecesMu.Unlock()
+}
+
+// PiecePriority returns the priority of a piece, 0 if it is not wanted.
+func (s *Swarm) PiecePriority(pieceIndex uint32) int {
+	s.piecesMu.RLock()
+	defer s.piecesMu.RUnlock()
+	return s.piecePriorityLocked(pieceIndex)
+}
+
+func (s *Swarm) piecePriorityLocked(pieceIndex uint32) int {
+	if int(pieceIndex) >= len(s.priorities) {
+		return 1
+	}
+	return s.priorities[pieceIndex]
+}
+
+// WantedPieces returns a copy of the set of pieces we want to download.
+func (s *Swarm) WantedPieces() protocol.Bitfield {
+	s.piecesMu.RLock()
+	defer s.piecesMu.RUnlock()
+	return s.wanted.Clone()
+}
+
+// IsComplete reports whether every wanted piece has been verified.
+func (s *Swarm) IsComplete() bool {
+	s.piecesMu.RLock()
+	defer s.piecesMu.RUnlock()
+	return s.wanted.AndNot(s.completed).Count() == 0
+}
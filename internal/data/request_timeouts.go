@@ -0,0 +1,85 @@
+package data
+
+import "time"
+
+const (
+	// SnubTimeout is how long an unchoked peer with outstanding requests may
+	// go without sending any block before it is considered snubbing us.
+	SnubTimeout = 60 * time.Second
+
+	minRequestTimeout     = 5 * time.Second
+	maxRequestTimeout     = 60 * time.Second
+	defaultRequestTimeout = 20 * time.Second
+	requestTimeoutFactor  = 4
+)
+
+// requestTimeout derives how long to wait for a single block from the peer's
+// latency history.
+func (ps *PipelineStats) requestTimeout() time.Duration {
+	if ps.Latency == 0 {
+		return defaultRequestTimeout
+	}
+	return max(minRequestTimeout, min(requestTimeoutFactor*ps.Latency, maxRequestTimeout))
+}
+
+// ExpireRequests returns timed-out block requests of peerIP to the pool and
+// flags the peer as snubbed when it has sent nothing for SnubTimeout while
+// unchoked. Blocks that timed out are remembered on the piece so they are not
+// handed straight back to the same peer while another peer can serve them. It
+// returns the expired blocks.
+func (s *Swarm) ExpireRequests(peerIP string, now time.Time) []BlockRef {
+	client, exists := s.GetClient(peerIP)
+	if !exists {
+		return nil
+	}
+
+	client.Mu.Lock()
+	newlySnubbed := false
+	if !client.Snubbed && !client.Choked && len(client.Requests) > 0 &&
+		!client.LastBlockAt.IsZero() && now.Sub(client.LastBlockAt) >= SnubTimeout {
+		client.Snubbed = true
+		newlySnubbed = true
+	}
+
+	timeout := client.Pipeline.requestTimeout()
+	var expired []BlockRef
+	for ref, requestedAt := range client.Requests {
+		if newlySnubbed || now.Sub(requestedAt) >= timeout {
+			expired = append(expired, ref)
+			delete(client.Requests, ref)
+		}
+	}
+	client.TimedOutRequests += len(expired)
+	client.Mu.Unlock()
+
+	s.downloadedMu.Lock()
+	s.timedOutRequests += int64(len(expired))
+	s.downloadedMu.Unlock()
+
+	for _, ref := range expired {
+		piece, exists := s.GetPieceState(ref.Piece)
+		if !exists {
+			continue
+		}
+		piece.Mu.Lock()
+		if owner, ok := piece.RequestedBlocks[ref.Block]; ok && owner == peerIP {
+			delete(piece.RequestedBlocks, ref.Block)
+			piece.TimedOutBlocks[ref.Block] = peerIP
+		}
+		piece.Mu.Unlock()
+	}
+
+	return expired
+}
+
+// IsSnubbed reports whether peerIP is currently flagged as snubbing us.
+func (s *Swarm) IsSnubbed(peerIP string) bool {
+	client, exists := s.GetClient(peerIP)
+	if !exists {
+		return false
+	}
+
+	client.Mu.Lock()
+	defer client.Mu.Unlock()
+	return client.Snubbed
+}
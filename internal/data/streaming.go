@@ -0,0 +1,82 @@
+package data
+
+// pieceWindow is a range of pieces [First, End) a reader needs soon.
+type pieceWindow struct {
+	First, End uint32
+}
+
+// SetPieceWindow registers the pieces a reader needs next. They are picked
+// before any other piece, nearest first, whatever their priority. id
+// identifies the reader; each reader has at most one window.
+func (s *Swarm) SetPieceWindow(id int, first, end uint32) {
+	s.piecesMu.Lock()
+	defer s.piecesMu.Unlock()
+
+	if s.windows == nil {
+		s.windows = make(map[int]pieceWindow)
+	}
+	s.windows[id] = pieceWindow{First: first, End: min(end, uint32(s.NumPieces))}
+}
+
+// ClearPieceWindow drops the window of a reader.
+func (s *Swarm) ClearPieceWindow(id int) {
+	s.piecesMu.Lock()
+	defer s.piecesMu.Unlock()
+	delete(s.windows, id)
+}
+
+// SetSequential makes the picker choose the lowest index among candidate
+// pieces instead of a random one.
+func (s *Swarm) SetSequential(sequential bool) {
+	s.piecesMu.Lock()
+	defer s.piecesMu.Unlock()
+	s.sequential = sequential
+}
+
+// PiecesChanged returns a channel that is closed the next time a piece is
+// verified.
+func (s *Swarm) PiecesChanged() <-chan struct{} {
+	s.piecesMu.Lock()
+	defer s.piecesMu.Unlock()
+
+	if s.changed == nil {
+		s.changed = make(chan struct{})
+	}
+	return s.changed
+}
+
+// notifyLocked wakes everyone waiting on PiecesChanged. s.piecesMu must be
+// held.
+func (s *Swarm) notifyLocked() {
+	if s.changed != nil {
+		close(s.changed)
+		s.changed = nil
+	}
+}
+
+// urgentPiece returns the piece a reader needs soonest that peerHas, that
+// is not verified and that nobody is fetching, or -1.
+func (s *Swarm) urgentPiece(peerHas func(uint32) bool) int32 {
+	s.piecesMu.RLock()
+	windows := make([]pieceWindow, 0, len(s.windows))
+	for _, w := range s.windows {
+		windows = append(windows, w)
+	}
+	completed := s.completed.Clone()
+	s.piecesMu.RUnlock()
+
+	best, bestDistance := int32(-1), uint32(0)
+	for _, w := range windows {
+		for piece := w.First; piece < w.End; piece++ {
+			if best >= 0 && piece-w.First >= bestDistance {
+				break
+			}
+			if completed.Has(piece) || s.IsPieceBeingRequested(piece) || !peerHas(piece) {
+				continue
+			}
+			best, bestDistance = int32(piece), piece-w.First
+			break
+		}
+	}
+	return best
+}
@@ -0,0 +1,82 @@
+package data
+
+import "slices"
+
+// Peers earn trust for every piece they help complete and lose it for every
+// piece that fails its hash check. A peer is banned once its trust falls to
+// banTrust, or at once if it sent every block of a failed piece.
+const (
+	maxTrust    = 8
+	passedTrust = 1
+	failedTrust = -2
+	banTrust    = -7
+)
+
+// PieceSources returns the peers that sent the received blocks of a piece.
+func (s *Swarm) PieceSources(pieceIndex uint32) []string {
+	piece, exists := s.GetPieceState(pieceIndex)
+	if !exists {
+		return nil
+	}
+
+	piece.Mu.Lock()
+	defer piece.Mu.Unlock()
+
+	var sources []string
+	for _, ip := range piece.BlockSources {
+		if !slices.Contains(sources, ip) {
+			sources = append(sources, ip)
+		}
+	}
+	return sources
+}
+
+// RecordPiecePassed credits the peers that sent a verified piece.
+func (s *Swarm) RecordPiecePassed(sources []string) {
+	s.trustMu.Lock()
+	defer s.trustMu.Unlock()
+
+	s.piecesPassed++
+	for _, ip := range sources {
+		s.trust[ip] = min(s.trust[ip]+passedTrust, maxTrust)
+	}
+}
+
+// RecordPieceFailed penalises the peers that sent a piece failing its hash
+// check and returns those that are newly banned as a result.
+func (s *Swarm) RecordPieceFailed(sources []string) []string {
+	s.trustMu.Lock()
+	defer s.trustMu.Unlock()
+
+	s.piecesFailed++
+	var banned []string
+	for _, ip := range sources {
+		s.trust[ip] += failedTrust
+		if s.banned[ip] || (len(sources) > 1 && s.trust[ip] > banTrust) {
+			continue
+		}
+		s.banned[ip] = true
+		banned = append(banned, ip)
+	}
+	return banned
+}
+
+// IsBanned reports whether a peer was banned for sending corrupt data.
+func (s *Swarm) IsBanned(ip string) bool {
+	s.trustMu.Lock()
+	defer s.trustMu.Unlock()
+	return s.banned[ip]
+}
+
+// BannedPeers returns the banned peers in sorted order.
+func (s *Swarm) BannedPeers() []string {
+	s.trustMu.Lock()
+	defer s.trustMu.Unlock()
+
+	banned := make([]string, 0, len(s.banned))
+	for ip := range s.banned {
+		banned = append(banned, ip)
+	}
+	slices.Sort(banned)
+	return banned
+}
@@ -0,0 +1,97 @@
+package data
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestTrust(t *testing.T) {
+	type event struct {
+		passed  bool
+		sources []string
+		banned  []string // newly banned by a failure
+	}
+	passed := func(sources ...string) event { return event{passed: true, sources: sources} }
+	failed := func(banned []string, sources ...string) event { return event{sources: sources, banned: banned} }
+	repeat := func(n int, e event) []event {
+		events := make([]event, n)
+		for i := range events {
+			events[i] = e
+		}
+		return events
+	}
+	a, b := []string{"a"}, []string{"b"}
+
+	tests := []struct {
+		name   string
+		events []event
+		want   []string // banned at the end
+	}{
+		{
+			"sole source banned at once",
+			[]event{failed(a, "a")},
+			a,
+		},
+		{
+			"sole source banned despite full trust",
+			append(repeat(20, passed("a")), failed(a, "a")),
+			a,
+		},
+		{
+			"shared sources banned at banTrust",
+			append(repeat(3, failed(nil, "a", "b")), failed([]string{"a", "b"}, "a", "b")),
+			[]string{"a", "b"},
+		},
+		{
+			"only the repeat offender",
+			append(repeat(3, failed(nil, "a", "b")), failed(a, "a", "c")),
+			a,
+		},
+		{
+			// 20 passes earn maxTrust, not 20: the eighth failure reaches
+			// banTrust. Each partner fails too few times to be banned.
+			"credit capped at maxTrust",
+			slices.Concat(repeat(20, passed("a")), repeat(3, failed(nil, "a", "b")), repeat(3, failed(nil, "a", "c")),
+				[]event{failed(nil, "a", "d"), failed(a, "a", "e")}),
+			a,
+		},
+		{
+			// Two pieces of credit leave a at -6 when b reaches banTrust.
+			"credit delays a ban",
+			slices.Concat(repeat(2, passed("a")), repeat(3, failed(nil, "a", "b")), []event{failed(b, "a", "b")}),
+			b,
+		},
+		{
+			"already banned peer not reported again",
+			slices.Concat([]event{failed(a, "a"), failed(nil, "a")}, repeat(3, failed(nil, "a", "b")), []event{failed(b, "a", "b")}),
+			[]string{"a", "b"},
+		},
+	}
+	for _, tt := range tests {
+		s := newTestSwarm(t)
+		var passes, failures int64
+		for i, e := range tt.events {
+			if e.passed {
+				passes++
+				s.RecordPiecePassed(e.sources)
+				continue
+			}
+			failures++
+			if got := s.RecordPieceFailed(e.sources); !slices.Equal(got, e.banned) {
+				t.Errorf("%s: event %d: failure of %v banned %v, want %v", tt.name, i, e.sources, got, e.banned)
+			}
+		}
+		if got := s.BannedPeers(); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: banned %v, want %v", tt.name, got, tt.want)
+		}
+		for _, ip := range tt.want {
+			if !s.IsBanned(ip) {
+				t.Errorf("%s: IsBanned(%s) = false", tt.name, ip)
+			}
+		}
+		if st := s.Stats(); st.PiecesVerified != passes || st.PiecesFailed != failures || st.BannedPeers != len(tt.want) {
+			t.Errorf("%s: stats show %d verified, %d failed and %d banned, want %d, %d and %d",
+				tt.name, st.PiecesVerified, st.PiecesFailed, st.BannedPeers, passes, failures, len(tt.want))
+		}
+	}
+}
@@ -0,0 +1,320 @@
+// Package mse implements Message Stream Encryption (also called Protocol
+// Encryption): a Diffie-Hellman key exchange that obfuscates the BitTorrent
+// handshake and optionally RC4-encrypts the rest of the connection.
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+)
+
+// Crypto methods offered in crypto_provide and chosen in crypto_select.
+const (
+	CryptoPlaintext uint32 = 0x01
+	CryptoRC4       uint32 = 0x02
+)
+
+const (
+	keyLen    = 96
+	maxPadLen = 512
+)
+
+var (
+	ErrNoSharedMethod = errors.New("mse: no crypto method in common")
+	ErrUnknownSKey    = errors.New("mse: peer asked for an unknown torrent")
+	ErrSyncNotFound   = errors.New("mse: handshake synchronisation failed")
+)
+
+var (
+	prime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+	vc        = make([]byte, 8)
+)
+
+// Conn is a connection after the MSE handshake. Reads first return the
+// initial payload the peer sent inside the handshake, if any.
+type Conn struct {
+	net.Conn
+	r io.Reader
+
+	wmu sync.Mutex
+	enc *rc4.Cipher // nil when plaintext was selected
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(p)
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	buf := make([]byte, len(p))
+	c.enc.XORKeyStream(buf, p)
+	return c.Conn.Write(buf)
+}
+
+// decryptReader decrypts everything read from r.
+type decryptReader struct {
+	r   io.Reader
+	dec *rc4.Cipher
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.dec.XORKeyStream(p[:n], p[:n])
+	return n, err
+}
+
+// Initiate runs the initiating side of the handshake for the torrent skey,
+// offering the methods in provide. initial is sent encrypted inside the
+// handshake, typically the BitTorrent handshake.
+func Initiate(conn net.Conn, skey [20]byte, provide uint32, initial []byte) (*Conn, uint32, error) {
+	private, public, err := keyPair()
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := writeWithPad(conn, public); err != nil {
+		return nil, 0, err
+	}
+
+	br := bufio.NewReaderSize(conn, 2*maxPadLen)
+	theirPublic := make([]byte, keyLen)
+	if _, err := io.ReadFull(br, theirPublic); err != nil {
+		return nil, 0, fmt.Errorf("mse: read public key: %w", err)
+	}
+	secret := sharedSecret(private, theirPublic)
+
+	enc := newCipher("keyA", secret, skey)
+	dec := newCipher("keyB", secret, skey)
+
+	var msg bytes.Buffer
+	msg.Write(hash("req1", secret))
+	msg.Write(xor(hash("req2", skey[:]), hash("req3", secret)))
+
+	var plain bytes.Buffer
+	plain.Write(vc)
+	binary.Write(&plain, binary.BigEndian, provide)
+	binary.Write(&plain, binary.BigEndian, uint16(0)) // no PadC
+	binary.Write(&plain, binary.BigEndian, uint16(len(initial)))
+	plain.Write(initial)
+	encrypted := make([]byte, plain.Len())
+	enc.XORKeyStream(encrypted, plain.Bytes())
+	msg.Write(encrypted)
+
+	if _, err := conn.Write(msg.Bytes()); err != nil {
+		return nil, 0, fmt.Errorf("mse: write: %w", err)
+	}
+
+	// The responder's VC follows its random padding.
+	want := make([]byte, len(vc))
+	dec.XORKeyStream(want, vc)
+	if err := syncTo(br, want); err != nil {
+		return nil, 0, err
+	}
+
+	var header [6]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, 0, fmt.Errorf("mse: read crypto_select: %w", err)
+	}
+	dec.XORKeyStream(header[:], header[:])
+	selected := binary.BigEndian.Uint32(header[:4])
+	padLen := binary.BigEndian.Uint16(header[4:])
+	if padLen > maxPadLen {
+		return nil, 0, fmt.Errorf("mse: padding too long")
+	}
+	if _, err := br.Discard(int(padLen)); err != nil {
+		return nil, 0, fmt.Errorf("mse: read padding: %w", err)
+	}
+	dec.XORKeyStream(make([]byte, padLen), make([]byte, padLen))
+
+	if selected&provide == 0 || (selected != CryptoPlaintext && selected != CryptoRC4) {
+		return nil, 0, ErrNoSharedMethod
+	}
+	return newConn(conn, br, selected, enc, dec, nil), selected, nil
+}
+
+// Accept runs the responding side of the handshake. peeked holds bytes
+// already read from conn. skeys are the torrents we serve; choose picks one
+// method from those the peer provides, or 0 to refuse. It returns the info
+// hash the peer asked for.
+func Accept(conn net.Conn, peeked []byte, skeys [][20]byte, choose func(provide uint32) uint32) (*Conn, [20]byte, uint32, error) {
+	var skey [20]byte
+
+	br := bufio.NewReaderSize(io.MultiReader(bytes.NewReader(peeked), conn), 2*maxPadLen)
+	theirPublic := make([]byte, keyLen)
+	if _, err := io.ReadFull(br, theirPublic); err != nil {
+		return nil, skey, 0, fmt.Errorf("mse: read public key: %w", err)
+	}
+
+	private, public, err := keyPair()
+	if err != nil {
+		return nil, skey, 0, err
+	}
+	if err := writeWithPad(conn, public); err != nil {
+		return nil, skey, 0, err
+	}
+	secret := sharedSecret(private, theirPublic)
+
+	if err := syncTo(br, hash("req1", secret)); err != nil {
+		return nil, skey, 0, err
+	}
+
+	obfuscated := make([]byte, 20)
+	if _, err := io.ReadFull(br, obfuscated); err != nil {
+		return nil, skey, 0, fmt.Errorf("mse: read skey hash: %w", err)
+	}
+	req3 := hash("req3", secret)
+	found := false
+	for _, candidate := range skeys {
+		if bytes.Equal(xor(hash("req2", candidate[:]), req3), obfuscated) {
+			skey, found = candidate, true
+			break
+		}
+	}
+	if !found {
+		return nil, skey, 0, ErrUnknownSKey
+	}
+
+	dec := newCipher("keyA", secret, skey)
+	enc := newCipher("keyB", secret, skey)
+
+	var header [14]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, skey, 0, fmt.Errorf("mse: read crypto_provide: %w", err)
+	}
+	dec.XORKeyStream(header[:], header[:])
+	if !bytes.Equal(header[:8], vc) {
+		return nil, skey, 0, fmt.Errorf("mse: bad verification constant")
+	}
+	provide := binary.BigEndian.Uint32(header[8:12])
+	padLen := binary.BigEndian.Uint16(header[12:])
+	if padLen > maxPadLen {
+		return nil, skey, 0, fmt.Errorf("mse: padding too long")
+	}
+
+	rest := make([]byte, int(padLen)+2)
+	if _, err := io.ReadFull(br, rest); err != nil {
+		return nil, skey, 0, fmt.Errorf("mse: read padding: %w", err)
+	}
+	dec.XORKeyStream(rest, rest)
+	initial := make([]byte, binary.BigEndian.Uint16(rest[padLen:]))
+	if _, err := io.ReadFull(br, initial); err != nil {
+		return nil, skey, 0, fmt.Errorf("mse: read initial payload: %w", err)
+	}
+	dec.XORKeyStream(initial, initial)
+
+	selected := choose(provide)
+	if selected&provide == 0 || (selected != CryptoPlaintext && selected != CryptoRC4) {
+		return nil, skey, 0, ErrNoSharedMethod
+	}
+
+	var reply bytes.Buffer
+	reply.Write(vc)
+	binary.Write(&reply, binary.BigEndian, selected)
+	binary.Write(&reply, binary.BigEndian, uint16(0)) // no PadD
+	encrypted := make([]byte, reply.Len())
+	enc.XORKeyStream(encrypted, reply.Bytes())
+	if _, err := conn.Write(encrypted); err != nil {
+		return nil, skey, 0, fmt.Errorf("mse: write: %w", err)
+	}
+
+	return newConn(conn, br, selected, enc, dec, initial), skey, selected, nil
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, selected uint32, enc, dec *rc4.Cipher, initial []byte) *Conn {
+	c := &Conn{Conn: conn}
+	var stream io.Reader = br
+	if selected == CryptoRC4 {
+		c.enc = enc
+		stream = &decryptReader{r: br, dec: dec}
+	}
+	c.r = io.MultiReader(bytes.NewReader(initial), stream)
+	return c
+}
+
+// syncTo discards bytes from br up to and including pattern, which must
+// appear within the maximum padding length.
+func syncTo(br *bufio.Reader, pattern []byte) error {
+	for offset := 0; offset <= maxPadLen; offset++ {
+		window, err := br.Peek(offset + len(pattern))
+		if err != nil {
+			return fmt.Errorf("mse: %w", err)
+		}
+		if bytes.Equal(window[offset:], pattern) {
+			_, err := br.Discard(offset + len(pattern))
+			return err
+		}
+	}
+	return ErrSyncNotFound
+}
+
+func keyPair() (private *big.Int, public []byte, err error) {
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, nil, err
+	}
+	private = new(big.Int).SetBytes(raw)
+	y := new(big.Int).Exp(generator, private, prime)
+	return private, y.FillBytes(make([]byte, keyLen)), nil
+}
+
+func sharedSecret(private *big.Int, theirPublic []byte) []byte {
+	y := new(big.Int).SetBytes(theirPublic)
+	return new(big.Int).Exp(y, private, prime).FillBytes(make([]byte, keyLen))
+}
+
+// writeWithPad sends our public key followed by random padding.
+func writeWithPad(conn net.Conn, public []byte) error {
+	var n [2]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		return err
+	}
+	pad := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(maxPadLen+1))
+	if _, err := rand.Read(pad); err != nil {
+		return err
+	}
+	if _, err := conn.Write(append(public, pad...)); err != nil {
+		return fmt.Errorf("mse: write public key: %w", err)
+	}
+	return nil
+}
+
+func hash(label string, parts ...[]byte) []byte {
+	h := sha1.New()
+	h.Write([]byte(label))
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+func xor(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+// newCipher returns the RC4 stream for one direction with the first 1024
+// bytes discarded, as the spec requires.
+func newCipher(label string, secret []byte, skey [20]byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(hash(label, secret, skey[:]))
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+	return c
+}
@@ -0,0 +1,329 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	torrentA = [20]byte{'a'}
+	torrentB = [20]byte{'b'}
+)
+
+// Choose functions matching the client's prefer and require policies.
+func preferRC4(provide uint32) uint32 {
+	if provide&CryptoRC4 != 0 {
+		return CryptoRC4
+	}
+	return provide & CryptoPlaintext
+}
+
+func requireRC4(provide uint32) uint32 {
+	return provide & CryptoRC4
+}
+
+type result struct {
+	conn     *Conn
+	skey     [20]byte
+	selected uint32
+	err      error
+}
+
+// handshake runs initiate and accept on the two ends of a pipe. A side that
+// fails closes its end so the other side fails too instead of hanging.
+func handshake(t *testing.T, initiate, accept func(net.Conn) result) (ini, acc result) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close(); b.Close() })
+	deadline := time.Now().Add(5 * time.Second)
+	a.SetDeadline(deadline)
+	b.SetDeadline(deadline)
+
+	done := make(chan result, 1)
+	go func() {
+		r := accept(b)
+		if r.err != nil {
+			b.Close()
+		}
+		done <- r
+	}()
+	ini = initiate(a)
+	if ini.err != nil {
+		a.Close()
+	}
+	return ini, <-done
+}
+
+func initiator(skey [20]byte, provide uint32, initial []byte) func(net.Conn) result {
+	return func(conn net.Conn) result {
+		c, selected, err := Initiate(conn, skey, provide, initial)
+		return result{conn: c, skey: skey, selected: selected, err: err}
+	}
+}
+
+// acceptor reads the first 20 bytes before calling Accept, as the client
+// does to tell an encrypted handshake from a plaintext one.
+func acceptor(skeys [][20]byte, choose func(uint32) uint32) func(net.Conn) result {
+	return func(conn net.Conn) result {
+		prefix := make([]byte, 20)
+		if _, err := io.ReadFull(conn, prefix); err != nil {
+			return result{err: err}
+		}
+		c, skey, selected, err := Accept(conn, prefix, skeys, choose)
+		return result{conn: c, skey: skey, selected: selected, err: err}
+	}
+}
+
+// exchange sends a message each way and checks both arrive intact.
+func exchange(t *testing.T, ini, acc *Conn) {
+	t.Helper()
+	for _, dir := range []struct {
+		from, to *Conn
+		msg      []byte
+	}{
+		{ini, acc, []byte("from the initiator")},
+		{acc, ini, []byte("from the acceptor")},
+	} {
+		go dir.from.Write(dir.msg)
+		got := make([]byte, len(dir.msg))
+		if _, err := io.ReadFull(dir.to, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, dir.msg) {
+			t.Fatalf("received %q, want %q", got, dir.msg)
+		}
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	tests := []struct {
+		name    string
+		provide uint32
+		choose  func(uint32) uint32
+		want    uint32
+	}{
+		{"prefer both", CryptoRC4 | CryptoPlaintext, preferRC4, CryptoRC4},
+		{"rc4 only", CryptoRC4, preferRC4, CryptoRC4},
+		{"plaintext only", CryptoPlaintext, preferRC4, CryptoPlaintext},
+		{"acceptor picks plaintext", CryptoRC4 | CryptoPlaintext, func(uint32) uint32 { return CryptoPlaintext }, CryptoPlaintext},
+		{"require", CryptoRC4 | CryptoPlaintext, requireRC4, CryptoRC4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			initial := []byte("\x13BitTorrent protocol handshake")
+			ini, acc := handshake(t,
+				initiator(torrentB, tt.provide, initial),
+				acceptor([][20]byte{torrentA, torrentB}, tt.choose))
+			if ini.err != nil || acc.err != nil {
+				t.Fatalf("initiator: %v, acceptor: %v", ini.err, acc.err)
+			}
+			if ini.selected != tt.want || acc.selected != tt.want {
+				t.Fatalf("selected %d and %d, want %d", ini.selected, acc.selected, tt.want)
+			}
+			if acc.skey != torrentB {
+				t.Fatalf("acceptor found torrent %x", acc.skey)
+			}
+			encrypted := tt.want == CryptoRC4
+			if (ini.conn.enc != nil) != encrypted || (acc.conn.enc != nil) != encrypted {
+				t.Fatalf("stream encryption does not match the selected method %d", tt.want)
+			}
+
+			// The initial payload comes out first on the acceptor's side.
+			got := make([]byte, len(initial))
+			if _, err := io.ReadFull(acc.conn, got); err != nil || !bytes.Equal(got, initial) {
+				t.Fatalf("initial payload %q, %v, want %q", got, err, initial)
+			}
+			exchange(t, ini.conn, acc.conn)
+		})
+	}
+}
+
+// paddedInitiator is Initiate sending padLen bytes of PadC.
+func paddedInitiator(skey [20]byte, provide uint32, padLen int) func(net.Conn) result {
+	return func(conn net.Conn) result {
+		private, public, err := keyPair()
+		if err != nil {
+			return result{err: err}
+		}
+		if err := writeWithPad(conn, public); err != nil {
+			return result{err: err}
+		}
+		br := bufio.NewReaderSize(conn, 2*maxPadLen)
+		theirPublic := make([]byte, keyLen)
+		if _, err := io.ReadFull(br, theirPublic); err != nil {
+			return result{err: err}
+		}
+		secret := sharedSecret(private, theirPublic)
+		enc := newCipher("keyA", secret, skey)
+		dec := newCipher("keyB", secret, skey)
+
+		var plain bytes.Buffer
+		plain.Write(vc)
+		binary.Write(&plain, binary.BigEndian, provide)
+		binary.Write(&plain, binary.BigEndian, uint16(padLen))
+		pad := make([]byte, padLen)
+		rand.Read(pad)
+		plain.Write(pad)
+		binary.Write(&plain, binary.BigEndian, uint16(0)) // no initial payload
+		encrypted := make([]byte, plain.Len())
+		enc.XORKeyStream(encrypted, plain.Bytes())
+
+		msg := append(hash("req1", secret), xor(hash("req2", skey[:]), hash("req3", secret))...)
+		if _, err := conn.Write(append(msg, encrypted...)); err != nil {
+			return result{err: err}
+		}
+
+		want := make([]byte, len(vc))
+		dec.XORKeyStream(want, vc)
+		if err := syncTo(br, want); err != nil {
+			return result{err: err}
+		}
+		var header [6]byte
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			return result{err: err}
+		}
+		dec.XORKeyStream(header[:], header[:])
+		selected := binary.BigEndian.Uint32(header[:4])
+		return result{conn: newConn(conn, br, selected, enc, dec, nil), skey: skey, selected: selected}
+	}
+}
+
+// paddedAcceptor is Accept for a single torrent sending padLen bytes of
+// PadD.
+func paddedAcceptor(skey [20]byte, choose func(uint32) uint32, padLen int) func(net.Conn) result {
+	return func(conn net.Conn) result {
+		br := bufio.NewReaderSize(conn, 2*maxPadLen)
+		theirPublic := make([]byte, keyLen)
+		if _, err := io.ReadFull(br, theirPublic); err != nil {
+			return result{err: err}
+		}
+		private, public, err := keyPair()
+		if err != nil {
+			return result{err: err}
+		}
+		if err := writeWithPad(conn, public); err != nil {
+			return result{err: err}
+		}
+		secret := sharedSecret(private, theirPublic)
+		if err := syncTo(br, hash("req1", secret)); err != nil {
+			return result{err: err}
+		}
+		if _, err := br.Discard(20); err != nil {
+			return result{err: err}
+		}
+		dec := newCipher("keyA", secret, skey)
+		enc := newCipher("keyB", secret, skey)
+
+		var header [14]byte
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			return result{err: err}
+		}
+		dec.XORKeyStream(header[:], header[:])
+		padC := binary.BigEndian.Uint16(header[12:])
+		rest := make([]byte, int(padC)+2)
+		if _, err := io.ReadFull(br, rest); err != nil {
+			return result{err: err}
+		}
+		dec.XORKeyStream(rest, rest)
+		initial := make([]byte, binary.BigEndian.Uint16(rest[padC:]))
+		if _, err := io.ReadFull(br, initial); err != nil {
+			return result{err: err}
+		}
+		dec.XORKeyStream(initial, initial)
+
+		selected := choose(binary.BigEndian.Uint32(header[8:12]))
+		var reply bytes.Buffer
+		reply.Write(vc)
+		binary.Write(&reply, binary.BigEndian, selected)
+		binary.Write(&reply, binary.BigEndian, uint16(padLen))
+		pad := make([]byte, padLen)
+		rand.Read(pad)
+		reply.Write(pad)
+		encrypted := make([]byte, reply.Len())
+		enc.XORKeyStream(encrypted, reply.Bytes())
+		if _, err := conn.Write(encrypted); err != nil {
+			return result{err: err}
+		}
+		return result{conn: newConn(conn, br, selected, enc, dec, initial), skey: skey, selected: selected}
+	}
+}
+
+// TestPadding checks that both sides skip the other's PadC or PadD and stay
+// in step on the RC4 stream, which the padding advances.
+func TestPadding(t *testing.T) {
+	for _, method := range []uint32{CryptoRC4, CryptoPlaintext} {
+		choose := func(uint32) uint32 { return method }
+		for _, padLen := range []int{1, 200, maxPadLen} {
+			ini, acc := handshake(t,
+				paddedInitiator(torrentA, CryptoRC4|CryptoPlaintext, padLen),
+				acceptor([][20]byte{torrentA}, choose))
+			if ini.err != nil || acc.err != nil {
+				t.Fatalf("PadC %d, method %d: initiator: %v, acceptor: %v", padLen, method, ini.err, acc.err)
+			}
+			exchange(t, ini.conn, acc.conn)
+
+			ini, acc = handshake(t,
+				initiator(torrentA, CryptoRC4|CryptoPlaintext, nil),
+				paddedAcceptor(torrentA, choose, padLen))
+			if ini.err != nil || acc.err != nil {
+				t.Fatalf("PadD %d, method %d: initiator: %v, acceptor: %v", padLen, method, ini.err, acc.err)
+			}
+			if ini.selected != method {
+				t.Fatalf("PadD %d: initiator selected %d, want %d", padLen, ini.selected, method)
+			}
+			exchange(t, ini.conn, acc.conn)
+		}
+	}
+}
+
+func TestUnknownSKey(t *testing.T) {
+	ini, acc := handshake(t,
+		initiator(torrentB, CryptoRC4, nil),
+		acceptor([][20]byte{torrentA}, preferRC4))
+	if !errors.Is(acc.err, ErrUnknownSKey) {
+		t.Fatalf("acceptor: %v, want ErrUnknownSKey", acc.err)
+	}
+	if ini.err == nil {
+		t.Fatal("initiator completed a handshake the acceptor refused")
+	}
+}
+
+func TestRequireRefusesPlaintext(t *testing.T) {
+	ini, acc := handshake(t,
+		initiator(torrentA, CryptoPlaintext, nil),
+		acceptor([][20]byte{torrentA}, requireRC4))
+	if !errors.Is(acc.err, ErrNoSharedMethod) {
+		t.Fatalf("acceptor: %v, want ErrNoSharedMethod", acc.err)
+	}
+	if ini.err == nil {
+		t.Fatal("initiator completed a handshake the acceptor refused")
+	}
+
+	// An acceptor answering with plaintext to an initiator that requires
+	// RC4 is refused by the initiator.
+	ini, acc = handshake(t,
+		initiator(torrentA, CryptoRC4, nil),
+		paddedAcceptor(torrentA, func(uint32) uint32 { return CryptoPlaintext }, 0))
+	if !errors.Is(ini.err, ErrNoSharedMethod) {
+		t.Fatalf("initiator: %v, want ErrNoSharedMethod", ini.err)
+	}
+
+	// A plaintext BitTorrent handshake is not an MSE handshake.
+	a, b := net.Pipe()
+	defer a.Close()
+	go func() {
+		a.Write(append([]byte("\x13BitTorrent protocol"), make([]byte, 48)...))
+		a.Close()
+	}()
+	b.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, _, _, err := Accept(b, nil, [][20]byte{torrentA}, requireRC4); err == nil {
+		t.Fatal("Accept took a plaintext BitTorrent handshake")
+	}
+}
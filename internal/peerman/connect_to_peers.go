@@ -2,14 +2,14 @@ package peerman
 
 import (
 	"context"
-	"encoding/binary"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
+	"strconv"
 	"time"
 
-	"github.com/Jamescog/bttclient/internal/data"
+	"github.com/Jamescog/bttclient/internal/mse"
 	"github.com/Jamescog/bttclient/pkg/protocol"
 )
 
@@ -18,155 +18,186 @@ type Peer struct {
 	Port int
 }
 
-// Build handshake message
-func buildHandshake(infoHash, peerID []byte) []byte {
-	pstr := "BitTorrent protocol"
-	buf := make([]byte, 1+len(pstr)+8+20+20) //<pstrlen><pstr><reserved><info_hash><peer_id>
-	buf[0] = byte(len(pstr))
+// DialFunc opens the transport connection to a peer, such as TCP or uTP.
+type DialFunc func(ctx context.Context, addr string) (net.Conn, error)
 
-	copy(buf[1:], []byte(pstr))
-
-	copy(buf[1+19+8:], infoHash)
-
-	copy(buf[1+19+8+20:], peerID)
-	return buf
-}
-
-func ConnectToPeer(ctx context.Context, peer Peer, infoHash, peerID [20]byte) (net.Conn, error) {
+// DialTCP is the DialFunc for plain TCP.
+func DialTCP(ctx context.Context, addr string) (net.Conn, error) {
 	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	return dialer.DialContext(ctx, "tcp", addr)
+}
 
-	conn, err := dialer.DialContext(ctx, "tcp", fmt.Sprintf("%s:%d", peer.IP, peer.Port))
+// ConnectToPeer dials a peer and exchanges handshakes. A non-zero provide
+// wraps the connection in MSE offering those crypto methods, with our
+// handshake sent as the initial payload; zero speaks plaintext. listenPort
+// is advertised in the extension handshake unless zero.
+func ConnectToPeer(ctx context.Context, dial DialFunc, peer Peer, infoHash, peerID [20]byte, provide uint32, listenPort uint16) (net.Conn, error) {
+	conn, err := dial(ctx, net.JoinHostPort(peer.IP, strconv.Itoa(peer.Port)))
 
 	if err != nil {
 		return nil, fmt.Errorf("dial faild: %w", err)
 	}
 
-	// defer conn.Close()
-
 	conn.SetDeadline(time.Now().Add(10 * time.Second))
 
-	handshake := buildHandshake(infoHash[:], peerID[:])
+	handshake := protocol.Handshake{InfoHash: infoHash, PeerID: peerID}
+	handshake.SetExtensions()
 
-	if _, err := conn.Write(handshake); err != nil {
+	if provide != 0 {
+		encrypted, _, err := mse.Initiate(conn, infoHash, provide, handshake.Marshal())
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("encryption handshake: %w", err)
+		}
+		conn = encrypted
+	} else if _, err := conn.Write(handshake.Marshal()); err != nil {
+		conn.Close()
 		return nil, fmt.Errorf("write handshake: %w", err)
-
 	}
 
-	resp := make([]byte, 68)
-
-	if _, err := conn.Read(resp); err != nil {
+	resp, err := protocol.ReadHandshake(conn)
+	if err != nil {
+		conn.Close()
 		return nil, fmt.Errorf("read handshake: %w", err)
 	}
 
-	peerInfoHash := resp[28:48]
+	if resp.InfoHash != infoHash {
+		conn.Close()
+		return nil, fmt.Errorf("info hash mismatch. got %x: expected: %x", resp.InfoHash, infoHash)
+	}
 
-	if string(peerInfoHash) != string(infoHash[:]) {
-		return nil, fmt.Errorf("info hash mismatch. got %s: expected: %s", string(peerInfoHash), string(infoHash[:]))
+	if resp.SupportsExtensions() {
+		if err := sendExtendedHandshake(protocol.NewWriter(conn), listenPort); err != nil {
+			conn.Close()
+			return nil, err
+		}
 	}
 
 	log.Printf("Successfully connected to peer %s:%d", peer.IP, peer.Port)
 	return conn, nil
-
 }
 
-func readMessage(conn net.Conn) ([]byte, error) {
-	lengthBuf := make([]byte, 4)
-
-	if _, err := io.ReadFull(conn, lengthBuf); err != nil {
-		return nil, err
-	}
-
-	length := binary.BigEndian.Uint32(lengthBuf)
+// AcceptHandshake answers the handshake of an inbound peer whose own
+// handshake has already been read by the listener. listenPort is
+// advertised as in ConnectToPeer.
+func AcceptHandshake(conn net.Conn, theirs protocol.Handshake, peerID [20]byte, listenPort uint16) error {
+	ours := protocol.Handshake{InfoHash: theirs.InfoHash, PeerID: peerID}
+	ours.SetExtensions()
 
-	if length == 0 {
-		return lengthBuf, nil
+	if _, err := conn.Write(ours.Marshal()); err != nil {
+		return fmt.Errorf("write handshake: %w", err)
 	}
 
-	msg := make([]byte, length)
-	if _, err := io.ReadFull(conn, msg); err != nil {
-		return nil, err
+	if theirs.SupportsExtensions() {
+		return sendExtendedHandshake(protocol.NewWriter(conn), listenPort)
 	}
-	return append(lengthBuf, msg...), nil
+	return nil
 }
 
-func HandlePeer(peer Peer, conn net.Conn, pieceLength int) {
+// HandlePeer runs the message loop for an established connection until the
+// peer disconnects or ctx is cancelled.
+func (d *Downloader) HandlePeer(ctx context.Context, peer Peer, conn net.Conn) {
 	defer conn.Close()
 
-	if _, err := conn.Write([]byte{0, 0, 0, 1, 2}); err != nil {
-		log.Printf("Failed to send 'interested' to %s: %v", peer.IP, err)
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if d.swarm.IsBanned(peer.IP) {
+		return
+	}
+
+	reader := protocol.NewReader(conn)
+	writer := protocol.NewWriter(conn)
+
+	d.registerSession(peer.IP, conn, writer)
+	defer d.unregisterSession(peer.IP)
+
+	done := make(chan struct{})
+	defer close(done)
+	go d.watchRequests(peer, done)
+
+	if err := d.sendBitfield(writer); err != nil {
+		log.Printf("Failed to send bitfield to %s: %v", peer.IP, err)
 		return
 	}
 
+	if !d.swarm.IsComplete() {
+		if err := writer.Send(protocol.Interested{}); err != nil {
+			log.Printf("Failed to send 'interested' to %s: %v", peer.IP, err)
+			return
+		}
+	}
+
 	for {
 		conn.SetDeadline(time.Now().Add(120 * time.Second))
-		msg, err := readMessage(conn)
+		msg, err := reader.ReadMessage()
+		if errors.Is(err, protocol.ErrUnknownMessage) {
+			continue
+		}
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				log.Printf("Peer %s timeout", peer.IP)
-				data.RemoveClient(peer.IP)
-			} else {
-				log.Printf("Peer %s disconnected", peer.IP)
-				data.RemoveClient(peer.IP)
+			} else if ctx.Err() == nil {
+				log.Printf("Peer %s disconnected: %v", peer.IP, err)
+			}
+			d.swarm.RemoveClient(peer.IP)
+			d.unregisterSession(peer.IP)
+			if ctx.Err() == nil {
+				d.reissueBlocks(peer.IP)
 			}
-
 			return
 		}
-		if len(msg) < 4 {
-			continue
-		}
-		if len(msg) == 4 {
-			continue
-		}
 
-		msgID := msg[4]
+		switch m := msg.(type) {
+		case protocol.Choke:
+			d.swarm.ChokeClient(peer.IP)
+			d.swarm.ReleasePeerRequests(peer.IP)
+		case protocol.Unchoke:
+			d.swarm.UnchokeClient(peer.IP)
 
-		switch msgID {
-		case 0:
-			data.ChokeClient(peer.IP)
-		case 1:
-			data.UnchokeClient(peer.IP)
-
-			pieceIndex := data.SelectNextPiece(peer.IP)
-			if pieceIndex >= 0 {
-				if err := RequestPiece(conn, uint32(pieceIndex), uint64(pieceLength), peer.IP); err != nil {
-					log.Printf("Failed to request piece %d: %v", pieceIndex, err)
-				}
+			if err := d.RequestBlocks(writer, peer.IP); err != nil {
+				log.Printf("Failed to request blocks from %s: %v", peer.IP, err)
+			}
+		case protocol.Interested:
+			if err := d.handleInterested(peer.IP); err != nil {
+				log.Printf("Failed to unchoke %s: %v", peer.IP, err)
 			}
-		case 2:
-		case 3:
-		case 4:
-			if len(msg) >= 9 {
-				pieceIndex := binary.BigEndian.Uint32(msg[5:9])
-				data.AddHavePiece(peer.IP, peer.Port, pieceIndex)
+		case protocol.NotInterested:
+			if err := d.handleNotInterested(peer.IP); err != nil {
+				log.Printf("Failed to choke %s: %v", peer.IP, err)
 			}
-		case 5:
-			payload := msg[5:]
-			bitfield := protocol.PiecesPeerHas(payload)
-			data.AddPiecesForClient(peer.IP, peer.Port, bitfield)
-		case 7:
-			if len(msg) >= 13 {
-				index := binary.BigEndian.Uint32(msg[5:9])
-				begin := binary.BigEndian.Uint32(msg[9:13])
-				blockData := msg[13:]
-
-				pieceComplete, err := HandleBlockReceived(index, begin, blockData, conn, peer.IP)
-				if err != nil {
-					log.Printf("Error handling block: %v", err)
-					continue
+		case protocol.Request:
+			if err := d.handleRequest(peer.IP, writer, m); err != nil {
+				log.Printf("Failed to serve request from %s: %v", peer.IP, err)
+			}
+		case protocol.Have:
+			client := d.swarm.AddHavePiece(peer.IP, peer.Port, m.Index)
+			if !client.IsChoked() && d.swarm.PendingRequests(peer.IP) == 0 {
+				if err := d.RequestBlocks(writer, peer.IP); err != nil {
+					log.Printf("Failed to request blocks from %s: %v", peer.IP, err)
 				}
+			}
+		case protocol.Bitfield:
+			bitfield, err := protocol.BitfieldFromBytes(m.Bytes(), d.swarm.NumPieces)
+			if err != nil {
+				log.Printf("Peer %s sent a bad bitfield: %v", peer.IP, err)
+				d.swarm.RemoveClient(peer.IP)
+				return
+			}
+			d.swarm.AddPiecesForClient(peer.IP, peer.Port, bitfield)
+		case protocol.Piece:
+			if _, err := d.HandleBlockReceived(m.Index, m.Begin, m.Block, peer.IP); err != nil {
+				log.Printf("Error handling block: %v", err)
+				continue
+			}
 
-				if pieceComplete {
-					nextPieceIndex := data.SelectNextPiece(peer.IP)
-					if nextPieceIndex >= 0 {
-						if err := RequestPiece(conn, uint32(nextPieceIndex), uint64(pieceLength), peer.IP); err != nil {
-							log.Printf("Failed to request next piece: %v", err)
-						}
-					}
+			if client, ok := d.swarm.GetClient(peer.IP); ok && !client.IsChoked() {
+				if err := d.RequestBlocks(writer, peer.IP); err != nil {
+					log.Printf("Failed to request blocks from %s: %v", peer.IP, err)
 				}
 			}
-		case 0xFF:
-		default:
+		case protocol.Extended:
+			d.handleExtendedMessage(peer, m)
 		}
 	}
-
 }
@@ -1,107 +1,130 @@
 package peerman
 
 import (
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
-	"net"
+	"net/netip"
+	"sync"
 
 	"github.com/Jamescog/bttclient/internal/data"
+	"github.com/Jamescog/bttclient/pkg/protocol"
+	"github.com/Jamescog/bttclient/pkg/storage"
 )
 
-func RequestPiece(conn net.Conn, pieceIndex uint32, pieceLength uint64, peerIP string) error {
-	piece := data.GetOrCreatePieceState(pieceIndex, pieceLength)
-
-	data.MarkPieceAsRequested(pieceIndex)
-
-	log.Printf("[Piece %d] Starting download from %s (%d blocks)", pieceIndex, peerIP, piece.TotalBlocks)
-
-	return RequestNextBlocks(conn, pieceIndex, 5)
+// Downloader fetches the pieces of one torrent from its peers and writes
+// them to storage.
+type Downloader struct {
+	swarm       *data.Swarm
+	pieceHashes []byte
+	store       storage.TorrentStorage
+
+	sessionsMu  sync.Mutex
+	sessions    map[string]*peerSession
+	uploadSlots int
+	onHolepunch HolepunchFunc
+	rendezvous  map[netip.AddrPort]*rendezvous // addresses we asked relays for
+
+	doneMu      sync.Mutex
+	done        chan struct{}   // replaced by Reopen
+	httpSources map[string]bool // keys of running web seed loops
 }
 
-func RequestNextBlocks(conn net.Conn, pieceIndex uint32, count int) error {
-	piece, exists := data.GetPieceState(pieceIndex)
-	if !exists {
-		return fmt.Errorf("piece %d not found", pieceIndex)
+// NewDownloader creates a downloader that keeps the torrent's data in store.
+// The downloader owns store and closes it in Close.
+// Piece sizes and offsets come from the swarm's geometry.
+func NewDownloader(swarm *data.Swarm, store storage.TorrentStorage, pieceHashes []byte) *Downloader {
+	return &Downloader{
+		swarm:       swarm,
+		pieceHashes: pieceHashes,
+		store:       store,
+		sessions:    make(map[string]*peerSession),
+		rendezvous:  make(map[netip.AddrPort]*rendezvous),
+		uploadSlots: DefaultUploadSlots,
+		done:        make(chan struct{}),
+		httpSources: make(map[string]bool),
 	}
+}
 
-	requested := 0
-	for blockIndex := uint32(0); blockIndex < piece.TotalBlocks && requested < count; blockIndex++ {
-		if data.IsBlockRequested(pieceIndex, blockIndex) {
-			continue
-		}
-
-		offset, length := CalculateBlockInfo(pieceIndex, blockIndex, piece.TotalLength, piece.BlockSize)
-
-		if err := sendBlockRequest(conn, pieceIndex, offset, length); err != nil {
-			return err
-		}
+// Done is closed once every wanted piece has been verified. After Reopen it
+// returns a new channel for the pieces still missing.
+func (d *Downloader) Done() <-chan struct{} {
+	d.doneMu.Lock()
+	defer d.doneMu.Unlock()
+	return d.done
+}
 
-		data.MarkBlockRequested(pieceIndex, blockIndex)
-		requested++
+func (d *Downloader) checkComplete() {
+	d.doneMu.Lock()
+	defer d.doneMu.Unlock()
+	if d.swarm.IsComplete() && !isClosed(d.done) {
+		close(d.done)
 	}
-
-	return nil
 }
 
-func CalculateBlockInfo(pieceIndex, blockIndex uint32, pieceLength uint64, blockSize uint32) (uint32, uint32) {
-	offset := blockIndex * blockSize
-	remaining := pieceLength - uint64(offset)
+// Reopen re-arms Done after the set of wanted pieces has grown past what
+// is verified. It reports whether the download is incomplete again, in
+// which case the caller should BroadcastInterested once it holds no locks.
+func (d *Downloader) Reopen() bool {
+	d.doneMu.Lock()
+	defer d.doneMu.Unlock()
 
-	length := blockSize
-	if uint64(length) > remaining {
-		length = uint32(remaining)
+	if !isClosed(d.done) || d.swarm.IsComplete() {
+		return false
 	}
-
-	return offset, length
+	d.done = make(chan struct{})
+	return true
 }
 
-func sendBlockRequest(conn net.Conn, pieceIndex, begin, length uint32) error {
-	req := make([]byte, 17)
-	binary.BigEndian.PutUint32(req[0:4], 13)
-	req[4] = 6
-	binary.BigEndian.PutUint32(req[5:9], pieceIndex)
-	binary.BigEndian.PutUint32(req[9:13], begin)
-	binary.BigEndian.PutUint32(req[13:17], length)
+// BroadcastInterested tells every connected peer we are interested again.
+// Sending may block on slow peers.
+func (d *Downloader) BroadcastInterested() {
+	d.broadcast(protocol.Interested{})
+}
 
-	if _, err := conn.Write(req); err != nil {
-		return fmt.Errorf("send request: %w", err)
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
 	}
-	return nil
 }
 
-func HandleBlockReceived(pieceIndex, offset uint32, blockData []byte, conn net.Conn, peerIP string) (bool, error) {
-	piece, exists := data.GetPieceState(pieceIndex)
+func (d *Downloader) HandleBlockReceived(pieceIndex, offset uint32, blockData []byte, peerIP string) (bool, error) {
+	piece, exists := d.swarm.GetPieceState(pieceIndex)
 	if !exists {
 		return false, fmt.Errorf("piece %d not found", pieceIndex)
 	}
 
-	blockIndex := offset / piece.BlockSize
-
-	if data.IsBlockReceived(pieceIndex, blockIndex) {
-		return false, nil
+	if !d.swarm.Geometry.Contains(pieceIndex, int64(offset), int64(len(blockData))) || offset%piece.BlockSize != 0 {
+		return false, fmt.Errorf("block at %d+%d does not fit piece %d", offset, len(blockData), pieceIndex)
 	}
 
-	piece.Mu.Lock()
-	copy(piece.Buffer[offset:], blockData)
-	piece.Mu.Unlock()
-
-	data.MarkBlockReceived(pieceIndex, blockIndex)
+	blockIndex := offset / piece.BlockSize
+	d.swarm.CompleteBlockRequest(peerIP, data.BlockRef{Piece: pieceIndex, Block: blockIndex}, len(blockData))
 
-	if data.IsPieceFullyReceived(pieceIndex) {
-		if err := VerifyAndSavePiece(pieceIndex); err != nil {
+	if d.swarm.MarkBlockReceived(pieceIndex, blockIndex, peerIP, blockData) {
+		sources := d.swarm.PieceSources(pieceIndex)
+		if err := d.VerifyAndSavePiece(pieceIndex); err != nil {
 			log.Printf("[Piece %d] Verification failed: %v - will retry", pieceIndex, err)
-			data.ResetPieceForRetry(pieceIndex)
+			d.swarm.ResetPieceForRetry(pieceIndex)
+			if !errors.Is(err, errHashMismatch) {
+				return false, nil
+			}
+			for _, ip := range d.swarm.RecordPieceFailed(sources) {
+				log.Printf("Banning %s for sending corrupt data", ip)
+				d.dropPeer(ip)
+			}
 			return false, nil
 		}
+		d.swarm.RecordPiecePassed(sources)
 
-		log.Printf("[Piece %d] Download complete and verified from %s", pieceIndex, peerIP)
+		log.Printf("[Piece %d] Download complete and verified (last block from %s)", pieceIndex, peerIP)
+		d.broadcastHave(pieceIndex)
+		d.checkComplete()
 		return true, nil
 	}
 
-	if err := RequestNextBlocks(conn, pieceIndex, 1); err != nil {
-		return false, err
-	}
-
 	return false, nil
 }
@@ -0,0 +1,76 @@
+package peerman
+
+import (
+	"fmt"
+
+	"github.com/Jamescog/bttclient/internal/data"
+	"github.com/Jamescog/bttclient/pkg/bencode"
+	"github.com/Jamescog/bttclient/pkg/protocol"
+)
+
+// Extended message ids we assign. Peers send us messages under these ids
+// and we send theirs, learned from their extension handshake.
+const (
+	extHandshakeID = 0
+	extHolepunchID = 1
+)
+
+// extHandshake advertises BEP 10 support with the extension messages we
+// understand, our own request queue size and the port we accept
+// connections on, which relays pass on for holepunching. A zero port is
+// left out.
+func extHandshake(listenPort uint16) []byte {
+	port := ""
+	if listenPort != 0 {
+		port = fmt.Sprintf("1:pi%de", listenPort)
+	}
+	return fmt.Appendf(nil, "d1:md12:ut_holepunchi%dee%s4:reqqi%dee", extHolepunchID, port, data.DefaultMaxRequests)
+}
+
+func sendExtendedHandshake(w *protocol.Writer, listenPort uint16) error {
+	msg := protocol.Extended{ExtendedID: extHandshakeID, Payload: extHandshake(listenPort)}
+	if err := w.Send(msg); err != nil {
+		return fmt.Errorf("send extended handshake: %w", err)
+	}
+	return nil
+}
+
+// handleExtendedMessage processes a BEP 10 message: the handshake or one
+// of the extensions we advertised.
+func (d *Downloader) handleExtendedMessage(peer Peer, msg protocol.Extended) {
+	switch msg.ExtendedID {
+	case extHandshakeID:
+	case extHolepunchID:
+		d.handleHolepunch(peer, msg.Payload)
+		return
+	default:
+		return
+	}
+
+	value, _, err := bencode.DecodeNext(msg.Payload, 0)
+	if err != nil {
+		return
+	}
+	dict, ok := value.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	if reqq, ok := dict["reqq"].(int); ok && reqq > 0 {
+		d.swarm.SetPeerMaxRequests(peer.IP, reqq)
+	}
+
+	m, _ := dict["m"].(map[string]interface{})
+	holepunchID, _ := m["ut_holepunch"].(int)
+	listenPort, _ := dict["p"].(int)
+	d.sessionsMu.Lock()
+	if s, ok := d.sessions[peer.IP]; ok {
+		if holepunchID > 0 && holepunchID < 256 {
+			s.holepunchID = uint8(holepunchID)
+		}
+		if listenPort > 0 && listenPort < 65536 {
+			s.listenPort = uint16(listenPort)
+		}
+	}
+	d.sessionsMu.Unlock()
+}
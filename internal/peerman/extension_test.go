@@ -0,0 +1,36 @@
+package peerman
+
+import (
+	"testing"
+
+	"github.com/Jamescog/bttclient/internal/data"
+	"github.com/Jamescog/bttclient/pkg/bencode"
+)
+
+func TestExtHandshake(t *testing.T) {
+	for _, port := range []uint16{0, 6881} {
+		value, _, err := bencode.DecodeNext(extHandshake(port), 0)
+		if err != nil {
+			t.Fatalf("port %d: %v", port, err)
+		}
+		dict, ok := value.(map[string]interface{})
+		if !ok {
+			t.Fatalf("port %d: handshake is %T, not a dictionary", port, value)
+		}
+
+		m, _ := dict["m"].(map[string]interface{})
+		if id, _ := m["ut_holepunch"].(int); id != extHolepunchID {
+			t.Errorf("port %d: ut_holepunch id %v, want %d", port, m["ut_holepunch"], extHolepunchID)
+		}
+		if reqq, _ := dict["reqq"].(int); reqq != data.DefaultMaxRequests {
+			t.Errorf("port %d: reqq %v, want %d", port, dict["reqq"], data.DefaultMaxRequests)
+		}
+		p, hasPort := dict["p"].(int)
+		if port == 0 && hasPort {
+			t.Errorf("port 0 advertised as %d", p)
+		}
+		if port != 0 && p != int(port) {
+			t.Errorf("advertised port %v, want %d", dict["p"], port)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package peerman
+
+import (
+	"log"
+	"net/netip"
+	"time"
+
+	"github.com/Jamescog/bttclient/pkg/protocol"
+)
+
+// Holepunching (BEP 55) lets two peers that cannot reach each other, such
+// as two peers behind NATs, connect over uTP with the help of a relay peer
+// connected to both.
+const (
+	// maxRelays bounds how many peers one rendezvous is sent to. Without
+	// PEX we do not know which peers are connected to the target.
+	maxRelays = 3
+	// rendezvousTimeout is how long after asking for a rendezvous a connect
+	// message marks us as its initiator.
+	rendezvousTimeout = 30 * time.Second
+	// rendezvousInterval is the minimum time between rendezvous requests
+	// for one address.
+	rendezvousInterval = 5 * time.Minute
+)
+
+// HolepunchFunc is called when a relay tells us to connect to addr.
+// initiator is set when we asked for the rendezvous, and is false when the
+// other peer did.
+type HolepunchFunc func(addr netip.AddrPort, initiator bool)
+
+type rendezvous struct {
+	asked     time.Time
+	connected bool
+}
+
+// SetHolepunchHandler sets the function that acts on connect messages.
+// Without one they are ignored, but we still relay for other peers.
+func (d *Downloader) SetHolepunchHandler(f HolepunchFunc) {
+	d.sessionsMu.Lock()
+	d.onHolepunch = f
+	d.sessionsMu.Unlock()
+}
+
+// Rendezvous asks connected peers that support ut_holepunch to relay a
+// connection to target. It returns how many peers were asked, which is 0
+// when none can help or target was tried recently.
+func (d *Downloader) Rendezvous(target netip.AddrPort) int {
+	target = netip.AddrPortFrom(target.Addr().Unmap(), target.Port())
+	now := time.Now()
+
+	d.sessionsMu.Lock()
+	for addr, r := range d.rendezvous {
+		if now.Sub(r.asked) >= rendezvousInterval {
+			delete(d.rendezvous, addr)
+		}
+	}
+	if _, recent := d.rendezvous[target]; recent {
+		d.sessionsMu.Unlock()
+		return 0
+	}
+	var relays []holepunchPeer
+	for _, s := range d.sessions {
+		if s.holepunchID != 0 && s.addr.Addr() != target.Addr() && len(relays) < maxRelays {
+			relays = append(relays, s.holepunchPeer())
+		}
+	}
+	if len(relays) > 0 {
+		d.rendezvous[target] = &rendezvous{asked: now}
+	}
+	d.sessionsMu.Unlock()
+
+	msg := protocol.Holepunch{Type: protocol.HolepunchRendezvous, Addr: target}
+	for _, p := range relays {
+		p.send(msg)
+	}
+	return len(relays)
+}
+
+func (d *Downloader) handleHolepunch(peer Peer, payload []byte) {
+	msg, err := protocol.ParseHolepunch(payload)
+	if err != nil {
+		log.Printf("Peer %s sent a bad holepunch message: %v", peer.IP, err)
+		return
+	}
+	msg.Addr = netip.AddrPortFrom(msg.Addr.Addr().Unmap(), msg.Addr.Port())
+
+	switch msg.Type {
+	case protocol.HolepunchRendezvous:
+		d.relay(peer, msg.Addr)
+	case protocol.HolepunchConnect:
+		d.sessionsMu.Lock()
+		r, ok := d.rendezvous[msg.Addr]
+		initiator := ok && !r.connected && time.Since(r.asked) < rendezvousTimeout
+		if initiator {
+			r.connected = true
+		}
+		handler := d.onHolepunch
+		d.sessionsMu.Unlock()
+
+		if handler != nil {
+			handler(msg.Addr, initiator)
+		}
+	case protocol.HolepunchError:
+		log.Printf("Peer %s cannot relay to %s: %s", peer.IP, msg.Addr, msg.ErrCode)
+	}
+}
+
+// relay introduces the peer asking for a rendezvous and its target to each
+// other, or tells the asking peer why it cannot.
+func (d *Downloader) relay(peer Peer, target netip.AddrPort) {
+	d.sessionsMu.Lock()
+	s, ok := d.sessions[peer.IP]
+	if !ok {
+		d.sessionsMu.Unlock()
+		return
+	}
+	from := s.holepunchPeer()
+	var to *holepunchPeer
+	for _, s := range d.sessions {
+		if s.addr.Addr() == target.Addr() && (s.addr.Port() == target.Port() || s.listenPort == target.Port()) {
+			p := s.holepunchPeer()
+			to = &p
+			break
+		}
+	}
+	d.sessionsMu.Unlock()
+
+	fail := func(code protocol.HolepunchErrCode) {
+		from.send(protocol.Holepunch{Type: protocol.HolepunchError, Addr: target, ErrCode: code})
+	}
+	switch {
+	case !target.IsValid() || target.Addr().IsUnspecified() || target.Port() == 0:
+		fail(protocol.HolepunchNoSuchPeer)
+	case to == nil:
+		fail(protocol.HolepunchNotConnected)
+	case to.writer == from.writer:
+		fail(protocol.HolepunchNoSuchPeer)
+	case to.id == 0:
+		fail(protocol.HolepunchNoSupport)
+	default:
+		from.send(protocol.Holepunch{Type: protocol.HolepunchConnect, Addr: to.endpoint})
+		to.send(protocol.Holepunch{Type: protocol.HolepunchConnect, Addr: from.endpoint})
+	}
+}
+
+// holepunchPeer is what is needed to send a session holepunch messages,
+// copied so it can be used without holding sessionsMu.
+type holepunchPeer struct {
+	writer   *protocol.Writer
+	id       uint8
+	endpoint netip.AddrPort
+}
+
+// holepunchPeer snapshots s. The caller holds sessionsMu.
+func (s *peerSession) holepunchPeer() holepunchPeer {
+	return holepunchPeer{writer: s.writer, id: s.holepunchID, endpoint: s.endpoint()}
+}
+
+// endpoint is where other peers can reach this one: the address it
+// connected from over uTP, since that is the mapping its NAT holds open,
+// or its listen port over TCP.
+func (s *peerSession) endpoint() netip.AddrPort {
+	if !s.overUTP && s.listenPort != 0 {
+		return netip.AddrPortFrom(s.addr.Addr(), s.listenPort)
+	}
+	return s.addr
+}
+
+// send writes msg unless the peer never announced ut_holepunch.
+func (p holepunchPeer) send(msg protocol.Holepunch) {
+	if p.id == 0 {
+		return
+	}
+	err := p.writer.Send(protocol.Extended{ExtendedID: p.id, Payload: msg.Marshal()})
+	if err != nil {
+		log.Printf("Failed to send holepunch message to %s: %v", p.endpoint, err)
+	}
+}
@@ -0,0 +1,86 @@
+package peerman
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTPSeed is a server speaking the Hoffman-style seeding protocol (BEP 17):
+// piece data is requested by info hash, piece index and ranges within the
+// piece.
+type HTTPSeed struct {
+	URL      string
+	InfoHash [20]byte
+	Client   *http.Client
+}
+
+// RunHTTPSeed downloads from an HTTP seed as if it were a peer that has
+// every piece, honouring the retry delay a busy seed asks for.
+func (d *Downloader) RunHTTPSeed(ctx context.Context, hs *HTTPSeed) {
+	d.runHTTPSource(ctx, "httpseed:"+hs.URL, hs)
+}
+
+func (hs *HTTPSeed) fetch(ctx context.Context, piece, begin uint32, offset int64, buf []byte) error {
+	u, err := url.Parse(hs.URL)
+	if err != nil {
+		return err
+	}
+	query := u.Query()
+	query.Set("info_hash", string(hs.InfoHash[:]))
+	query.Set("piece", strconv.FormatUint(uint64(piece), 10))
+	query.Set("ranges", fmt.Sprintf("%d-%d", begin, int(begin)+len(buf)-1))
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	client := hs.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusServiceUnavailable:
+		// The body holds the number of seconds to wait; some seeds use the
+		// Retry-After header instead.
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64))
+		after := parseRetryAfter(strings.TrimSpace(string(body)))
+		if after == 0 {
+			after = parseRetryAfter(resp.Header.Get("Retry-After"))
+		}
+		err := fmt.Errorf("%s: %s", hs.URL, resp.Status)
+		if after > 0 {
+			return &retryAfterError{after: after, err: err}
+		}
+		return err
+	default:
+		return fmt.Errorf("%s: %s", hs.URL, resp.Status)
+	}
+
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		return fmt.Errorf("%s: %w", hs.URL, err)
+	}
+	return nil
+}
+
+func parseRetryAfter(s string) time.Duration {
+	seconds, err := strconv.Atoi(s)
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,139 @@
+package peerman
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Jamescog/bttclient/pkg/storage"
+)
+
+func TestHTTPSeedQuery(t *testing.T) {
+	infoHash := [20]byte{0x00, '&', '=', ' ', 0xff, '%'}
+	var got url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.Query()
+		w.Write(make([]byte, 1000))
+	}))
+	defer ts.Close()
+
+	hs := &HTTPSeed{URL: ts.URL + "/seed?key=abc", InfoHash: infoHash, Client: ts.Client()}
+	if err := hs.fetch(context.Background(), 3, 16384, 0, make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		"info_hash": string(infoHash[:]),
+		"piece":     "3",
+		"ranges":    "16384-17383",
+		"key":       "abc",
+	} {
+		if v := got.Get(key); v != want {
+			t.Errorf("%s = %q, want %q", key, v, want)
+		}
+	}
+}
+
+func TestHTTPSeedRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		header string
+		want   time.Duration // 0 for a plain error
+	}{
+		{"body", "30\n", "", 30 * time.Second},
+		{"header", "", "45", 45 * time.Second},
+		{"body wins", "10", "45", 10 * time.Second},
+		{"bad body, header", "busy", "12", 12 * time.Second},
+		{"neither", "busy", "", 0},
+		{"http date", "", "Wed, 21 Oct 2015 07:28:00 GMT", 0},
+	}
+	for _, tt := range tests {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tt.header != "" {
+				w.Header().Set("Retry-After", tt.header)
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, tt.body)
+		}))
+
+		hs := &HTTPSeed{URL: ts.URL, Client: ts.Client()}
+		err := hs.fetch(context.Background(), 0, 0, 0, make([]byte, 10))
+		ts.Close()
+
+		var retry *retryAfterError
+		switch {
+		case err == nil:
+			t.Errorf("%s: fetch from a busy seed succeeded", tt.name)
+		case tt.want == 0 && errors.As(err, &retry):
+			t.Errorf("%s: retry after %v, want a plain error", tt.name, retry.after)
+		case tt.want != 0 && !errors.As(err, &retry):
+			t.Errorf("%s: %v, want a retry after %v", tt.name, err, tt.want)
+		case tt.want != 0 && retry.after != tt.want:
+			t.Errorf("%s: retry after %v, want %v", tt.name, retry.after, tt.want)
+		}
+	}
+}
+
+func TestHTTPSeedDownload(t *testing.T) {
+	content := make([]byte, 50000)
+	rand.New(rand.NewSource(1)).Read(content)
+	d, store, info := newTestTorrent(t, content, 16384, []storage.File{{Path: []string{"file.bin"}, Length: int64(len(content))}})
+
+	// The seed is busy for its first request and asks for a second's wait.
+	var served atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !served.Swap(true) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, "1")
+			return
+		}
+		query := r.URL.Query()
+		piece, err := strconv.ParseInt(query.Get("piece"), 10, 64)
+		var first, last int64
+		if err == nil {
+			_, err = fmt.Sscanf(query.Get("ranges"), "%d-%d", &first, &last)
+		}
+		start := info.PieceOffset(uint32(piece)) + first
+		end := info.PieceOffset(uint32(piece)) + last + 1
+		if err != nil || first > last || end > int64(len(content)) {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.Write(content[start:end])
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	started := time.Now()
+	go d.RunHTTPSeed(ctx, &HTTPSeed{URL: ts.URL, InfoHash: info.InfoHash, Client: ts.Client()})
+
+	select {
+	case <-d.Done():
+	case <-ctx.Done():
+		t.Fatalf("download did not complete: %+v", d.swarm.Stats())
+	}
+	if elapsed := time.Since(started); elapsed < time.Second {
+		t.Errorf("completed after %v, before the requested retry delay", elapsed)
+	}
+
+	got := make([]byte, len(content))
+	for piece := range uint32(info.NumPieces()) {
+		start := info.PieceOffset(piece)
+		if _, err := store.ReadAt(got[start:start+info.PieceSize(piece)], piece, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("downloaded data does not match")
+	}
+}
@@ -1 +1,41 @@
 package peerman
+
+import (
+	"fmt"
+
+	"github.com/Jamescog/bttclient/pkg/protocol"
+)
+
+// RequestBlocks tops up the peer's request pipeline with blocks chosen by the
+// block scheduler. The pipeline depth adapts to the peer's measured
+// bandwidth-delay product. Blocks may come from several pieces, and other
+// peers may be filling the remaining blocks of the same pieces.
+func (d *Downloader) RequestBlocks(w *protocol.Writer, peerIP string) error {
+	free := d.swarm.PipelineDepth(peerIP) - d.swarm.PendingRequests(peerIP)
+	for _, ref := range d.swarm.NextBlocksForPeer(peerIP, free) {
+		piece, exists := d.swarm.GetPieceState(ref.Piece)
+		if !exists {
+			continue
+		}
+
+		offset, length := CalculateBlockInfo(ref.Piece, ref.Block, piece.TotalLength, piece.BlockSize)
+		w.WriteMessage(protocol.Request{Index: ref.Piece, Begin: offset, Length: length})
+	}
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("send requests: %w", err)
+	}
+	return nil
+}
+
+func CalculateBlockInfo(pieceIndex, blockIndex uint32, pieceLength uint64, blockSize uint32) (uint32, uint32) {
+	offset := blockIndex * blockSize
+	remaining := pieceLength - uint64(offset)
+
+	length := blockSize
+	if uint64(length) > remaining {
+		length = uint32(remaining)
+	}
+
+	return offset, length
+}
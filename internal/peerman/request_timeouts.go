@@ -0,0 +1,103 @@
+package peerman
+
+import (
+	"log"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/Jamescog/bttclient/pkg/protocol"
+)
+
+const requestCheckInterval = 5 * time.Second
+
+type peerSession struct {
+	conn     net.Conn
+	writer   *protocol.Writer
+	unchoked bool // we let this peer download from us
+
+	addr        netip.AddrPort // remote end of the connection
+	overUTP     bool
+	listenPort  uint16 // from the extension handshake, if sent
+	holepunchID uint8  // the peer's id for ut_holepunch, 0 if unsupported
+}
+
+func (d *Downloader) registerSession(peerIP string, conn net.Conn, writer *protocol.Writer) {
+	s := &peerSession{conn: conn, writer: writer}
+	switch a := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		s.addr = a.AddrPort()
+	case *net.UDPAddr:
+		s.addr, s.overUTP = a.AddrPort(), true
+	}
+	s.addr = netip.AddrPortFrom(s.addr.Addr().Unmap(), s.addr.Port())
+
+	d.sessionsMu.Lock()
+	d.sessions[peerIP] = s
+	d.sessionsMu.Unlock()
+}
+
+// dropPeer closes the connection to peerIP, if any. Its message loop then
+// cleans up as for any disconnect.
+func (d *Downloader) dropPeer(peerIP string) {
+	d.sessionsMu.Lock()
+	s, ok := d.sessions[peerIP]
+	d.sessionsMu.Unlock()
+	if ok {
+		s.conn.Close()
+	}
+}
+
+func (d *Downloader) unregisterSession(peerIP string) {
+	d.sessionsMu.Lock()
+	delete(d.sessions, peerIP)
+	d.sessionsMu.Unlock()
+}
+
+// watchRequests periodically expires timed-out requests of a peer until done
+// is closed, and hands the freed blocks to the other connected peers.
+func (d *Downloader) watchRequests(peer Peer, done <-chan struct{}) {
+	ticker := time.NewTicker(requestCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			expired := d.swarm.ExpireRequests(peer.IP, now)
+			if len(expired) == 0 {
+				continue
+			}
+			if d.swarm.IsSnubbed(peer.IP) {
+				log.Printf("Peer %s is snubbing us, re-requesting %d blocks elsewhere", peer.IP, len(expired))
+			} else {
+				log.Printf("Peer %s: %d block requests timed out", peer.IP, len(expired))
+			}
+			d.reissueBlocks(peer.IP)
+		}
+	}
+}
+
+// reissueBlocks tops up the pipelines of every unchoked, non-snubbed peer
+// other than except so that released blocks are picked up immediately.
+func (d *Downloader) reissueBlocks(except string) {
+	d.sessionsMu.Lock()
+	others := make(map[string]*peerSession, len(d.sessions))
+	for ip, s := range d.sessions {
+		if ip != except {
+			others[ip] = s
+		}
+	}
+	d.sessionsMu.Unlock()
+
+	for ip, s := range others {
+		client, ok := d.swarm.GetClient(ip)
+		if !ok || client.IsChoked() || d.swarm.IsSnubbed(ip) {
+			continue
+		}
+		if err := d.RequestBlocks(s.writer, ip); err != nil {
+			log.Printf("Failed to re-request blocks from %s: %v", ip, err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package peerman
+
+import (
+	"fmt"
+
+	"github.com/Jamescog/bttclient/pkg/protocol"
+)
+
+const (
+	// DefaultUploadSlots is how many interested peers are unchoked at once.
+	DefaultUploadSlots = 4
+	// maxRequestLength is the largest block we serve, per common practice.
+	maxRequestLength = 128 * 1024
+)
+
+// SetUploadSlots changes how many peers may download from us at once. Zero
+// disables uploading.
+func (d *Downloader) SetUploadSlots(n int) {
+	d.sessionsMu.Lock()
+	d.uploadSlots = n
+	d.sessionsMu.Unlock()
+}
+
+// sendBitfield tells a new peer which pieces we already have.
+func (d *Downloader) sendBitfield(w *protocol.Writer) error {
+	have := d.swarm.CompletedPieces()
+	if have.Count() == 0 {
+		return nil
+	}
+	return w.Send(have)
+}
+
+// broadcastHave announces a newly verified piece to every connected peer.
+func (d *Downloader) broadcastHave(pieceIndex uint32) {
+	d.broadcast(protocol.Have{Index: pieceIndex})
+}
+
+// broadcast sends msg to every connected peer.
+func (d *Downloader) broadcast(msg protocol.Message) {
+	d.sessionsMu.Lock()
+	writers := make([]*protocol.Writer, 0, len(d.sessions))
+	for _, s := range d.sessions {
+		writers = append(writers, s.writer)
+	}
+	d.sessionsMu.Unlock()
+
+	for _, w := range writers {
+		w.Send(msg)
+	}
+}
+
+// handleInterested unchokes the peer if an upload slot is free.
+func (d *Downloader) handleInterested(peerIP string) error {
+	d.sessionsMu.Lock()
+	s, ok := d.sessions[peerIP]
+	if !ok || s.unchoked {
+		d.sessionsMu.Unlock()
+		return nil
+	}
+	unchoked := 0
+	for _, other := range d.sessions {
+		if other.unchoked {
+			unchoked++
+		}
+	}
+	if unchoked >= d.uploadSlots {
+		d.sessionsMu.Unlock()
+		return nil
+	}
+	s.unchoked = true
+	d.sessionsMu.Unlock()
+
+	return s.writer.Send(protocol.Unchoke{})
+}
+
+// handleNotInterested frees the peer's upload slot.
+func (d *Downloader) handleNotInterested(peerIP string) error {
+	d.sessionsMu.Lock()
+	s, ok := d.sessions[peerIP]
+	if !ok || !s.unchoked {
+		d.sessionsMu.Unlock()
+		return nil
+	}
+	s.unchoked = false
+	d.sessionsMu.Unlock()
+
+	return s.writer.Send(protocol.Choke{})
+}
+
+// handleRequest serves a block of a verified piece to an unchoked peer.
+// Requests from choked peers or for pieces we do not have are ignored.
+func (d *Downloader) handleRequest(peerIP string, w *protocol.Writer, req protocol.Request) error {
+	d.sessionsMu.Lock()
+	s, ok := d.sessions[peerIP]
+	allowed := ok && s.unchoked
+	d.sessionsMu.Unlock()
+
+	if !allowed || req.Length == 0 || req.Length > maxRequestLength {
+		return nil
+	}
+	if !d.swarm.CompletedPieces().Has(req.Index) {
+		return nil
+	}
+	if !d.swarm.Geometry.Contains(req.Index, int64(req.Begin), int64(req.Length)) {
+		return nil
+	}
+
+	block := make([]byte, req.Length)
+	if _, err := d.store.ReadAt(block, req.Index, int64(req.Begin)); err != nil {
+		return fmt.Errorf("read block for %s: %w", peerIP, err)
+	}
+
+	if err := w.Send(protocol.Piece{Index: req.Index, Begin: req.Begin, Block: block}); err != nil {
+		return err
+	}
+	d.swarm.AddUploadedBytes(int64(len(block)))
+	return nil
+}
@@ -2,43 +2,20 @@ package peerman
 
 import (
 	"crypto/sha1"
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"os"
-	"path/filepath"
 
-	"github.com/Jamescog/bttclient/internal/data"
+	"github.com/Jamescog/bttclient/pkg/storage"
 )
 
-var (
-	pieceHashes []byte
-	outputFile  *os.File
-	fileName    string
-)
-
-func InitializeDownload(torrentName string, pieceHashesData []byte, totalSize int64) error {
-	pieceHashes = pieceHashesData
-	fileName = torrentName
-
-	data.TotalFileSize = totalSize
-
-	var err error
-	outputFile, err = os.Create(fileName)
-	if err != nil {
-		return fmt.Errorf("failed to create output file: %w", err)
-	}
-
-	if err := outputFile.Truncate(totalSize); err != nil {
-		outputFile.Close()
-		return fmt.Errorf("failed to allocate file space: %w", err)
-	}
-
-	log.Printf("Initialized download: %s (%.2f MB)", fileName, float64(totalSize)/(1024*1024))
-	return nil
-}
+// errHashMismatch means a piece's data is corrupt, as opposed to failing to
+// be stored.
+var errHashMismatch = errors.New("hash mismatch")
 
-func VerifyAndSavePiece(pieceIndex uint32) error {
-	piece, exists := data.GetPieceState(pieceIndex)
+func (d *Downloader) VerifyAndSavePiece(pieceIndex uint32) error {
+	piece, exists := d.swarm.GetPieceState(pieceIndex)
 	if !exists {
 		return fmt.Errorf("piece %d not found", pieceIndex)
 	}
@@ -48,11 +25,11 @@ func VerifyAndSavePiece(pieceIndex uint32) error {
 	pieceLength := piece.TotalLength
 	piece.Mu.Unlock()
 
-	if len(pieceHashes) == 0 {
+	if len(d.pieceHashes) == 0 {
 		return fmt.Errorf("piece hashes not initialized")
 	}
 
-	expectedHash := pieceHashes[pieceIndex*20 : (pieceIndex+1)*20]
+	expectedHash := d.pieceHashes[pieceIndex*20 : (pieceIndex+1)*20]
 
 	actualHash := sha1.Sum(buffer[:pieceLength])
 
@@ -61,38 +38,106 @@ func VerifyAndSavePiece(pieceIndex uint32) error {
 		piece.IsVerified = false
 		piece.IsComplete = false
 		piece.Mu.Unlock()
-		return fmt.Errorf("hash mismatch for piece %d", pieceIndex)
+		return fmt.Errorf("piece %d: %w", pieceIndex, errHashMismatch)
 	}
 
-	offset := int64(pieceIndex) * int64(pieceLength)
-	if _, err := outputFile.WriteAt(buffer[:pieceLength], offset); err != nil {
-		return fmt.Errorf("failed to write piece %d to disk: %w", pieceIndex, err)
+	if _, err := d.store.WriteAt(buffer[:pieceLength], pieceIndex, 0); err != nil {
+		return fmt.Errorf("failed to write piece %d to storage: %w", pieceIndex, err)
+	}
+	if err := d.store.MarkComplete(pieceIndex); err != nil {
+		return fmt.Errorf("failed to complete piece %d in storage: %w", pieceIndex, err)
 	}
 
-	piece.Mu.Lock()
-	piece.IsVerified = true
-	piece.IsSaved = true
-	piece.Mu.Unlock()
+	d.swarm.MarkPieceVerified(pieceIndex)
 
-	data.AddDownloadedBytes(int64(pieceLength))
+	d.swarm.AddDownloadedBytes(int64(pieceLength))
 
 	return nil
 }
 
-func CloseDownload() error {
-	if outputFile != nil {
-		if err := outputFile.Sync(); err != nil {
-			return err
+// MarkPieceComplete records a piece as verified without rehashing it, for
+// pieces restored from resume data.
+func (d *Downloader) MarkPieceComplete(pieceIndex uint32) {
+	if err := d.store.MarkComplete(pieceIndex); err != nil {
+		log.Printf("[Piece %d] Failed to complete in storage: %v", pieceIndex, err)
+	}
+	d.swarm.MarkPieceVerified(pieceIndex)
+	d.swarm.AddDownloadedBytes(d.swarm.Geometry.PieceSize(pieceIndex))
+	d.checkComplete()
+}
+
+// MarkPieceUnverified undoes MarkPieceComplete for a piece whose data turned
+// out to be bad, so it is downloaded again.
+func (d *Downloader) MarkPieceUnverified(pieceIndex uint32) {
+	d.swarm.MarkPieceUnverified(pieceIndex)
+	d.swarm.AddDownloadedBytes(-d.swarm.Geometry.PieceSize(pieceIndex))
+}
+
+// PieceStatus is the result of checking a piece against data on disk.
+type PieceStatus int
+
+const (
+	PieceValid PieceStatus = iota
+	PieceMissing
+	PieceCorrupt
+)
+
+// CheckPiece hashes a piece from disk without changing any download state.
+// A piece whose data is absent or was never written (all zero) is missing;
+// one with data that does not match its hash is corrupt.
+func (d *Downloader) CheckPiece(pieceIndex uint32) (PieceStatus, error) {
+	if int(pieceIndex) >= len(d.pieceHashes)/20 {
+		return PieceMissing, fmt.Errorf("piece %d out of range", pieceIndex)
+	}
+
+	buffer := make([]byte, d.swarm.Geometry.PieceSize(pieceIndex))
+	n, err := d.store.ReadAt(buffer, pieceIndex, 0)
+	if errors.Is(err, io.EOF) && n < len(buffer) {
+		return PieceMissing, nil
+	}
+	if err != nil {
+		return PieceMissing, fmt.Errorf("read piece %d: %w", pieceIndex, err)
+	}
+
+	actualHash := sha1.Sum(buffer)
+	if string(actualHash[:]) == string(d.pieceHashes[pieceIndex*20:(pieceIndex+1)*20]) {
+		return PieceValid, nil
+	}
+	for _, b := range buffer {
+		if b != 0 {
+			return PieceCorrupt, nil
 		}
-		return outputFile.Close()
 	}
-	return nil
+	return PieceMissing, nil
 }
 
-func GetOutputPath() string {
-	if outputFile != nil {
-		absPath, _ := filepath.Abs(fileName)
-		return absPath
+// RecheckPiece hashes a piece from disk and updates the download state: a
+// valid piece is marked verified, anything else is queued for download.
+func (d *Downloader) RecheckPiece(pieceIndex uint32) (bool, error) {
+	status, err := d.CheckPiece(pieceIndex)
+	if err != nil {
+		return false, err
+	}
+
+	verified := d.swarm.CompletedPieces().Has(pieceIndex)
+	switch {
+	case status == PieceValid && !verified:
+		d.MarkPieceComplete(pieceIndex)
+	case status != PieceValid && verified:
+		d.MarkPieceUnverified(pieceIndex)
 	}
-	return ""
+	return status == PieceValid, nil
+}
+
+// Sync flushes written data if the storage buffers writes.
+func (d *Downloader) Sync() error {
+	if syncer, ok := d.store.(storage.Syncer); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+// Close closes the torrent's storage.
+func (d *Downloader) Close() error {
+	return d.store.Close()
 }
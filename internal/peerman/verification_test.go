@@ -0,0 +1,83 @@
+package peerman
+
+import (
+	"crypto/sha1"
+	"math/rand"
+	"testing"
+
+	"github.com/Jamescog/bttclient/internal/data"
+	"github.com/Jamescog/bttclient/pkg/storage"
+)
+
+// newTestDownloader returns a downloader over memory storage for content
+// split into pieces of pieceLength bytes.
+func newTestDownloader(t *testing.T, content []byte, pieceLength int64) (*Downloader, storage.TorrentStorage) {
+	t.Helper()
+	d, store, _ := newTestTorrent(t, content, pieceLength, []storage.File{{Path: []string{"test"}, Length: int64(len(content))}})
+	return d, store
+}
+
+// newTestTorrent is newTestDownloader for content laid out as files.
+func newTestTorrent(t *testing.T, content []byte, pieceLength int64, files []storage.File) (*Downloader, storage.TorrentStorage, *storage.Info) {
+	t.Helper()
+	info, err := storage.NewInfo([20]byte{1}, "test", pieceLength, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := storage.NewMemoryStorage().OpenTorrent(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hashes []byte
+	for off := int64(0); off < int64(len(content)); off += pieceLength {
+		h := sha1.Sum(content[off:min(off+pieceLength, int64(len(content)))])
+		hashes = append(hashes, h[:]...)
+	}
+	d := NewDownloader(data.NewSwarm(info.Geometry), store, hashes)
+	t.Cleanup(func() { d.Close() })
+	return d, store, info
+}
+
+func TestVerifyShortLastPiece(t *testing.T) {
+	const pieceLength = 32768
+	content := make([]byte, 2*pieceLength+20000)
+	rand.New(rand.NewSource(1)).Read(content)
+	d, store := newTestDownloader(t, content, pieceLength)
+
+	last := content[2*pieceLength:]
+	d.swarm.GetOrCreatePieceState(2)
+
+	// A block running past the end of the short piece is refused.
+	if _, err := d.HandleBlockReceived(2, 16384, make([]byte, 16384), "10.0.0.1"); err == nil {
+		t.Fatal("block past the end of the last piece was accepted")
+	}
+
+	done, err := d.HandleBlockReceived(2, 0, last[:16384], "10.0.0.1")
+	if err != nil || done {
+		t.Fatalf("first block: done %v, err %v", done, err)
+	}
+	done, err = d.HandleBlockReceived(2, 16384, last[16384:], "10.0.0.2")
+	if err != nil || !done {
+		t.Fatalf("last block: done %v, err %v", done, err)
+	}
+	if !d.swarm.CompletedPieces().Has(2) {
+		t.Fatal("short last piece not marked verified")
+	}
+	if st := d.swarm.Stats(); st.DownloadedBytes != 20000 || st.PiecesVerified != 1 {
+		t.Fatalf("downloaded %d bytes in %d pieces, want 20000 in 1", st.DownloadedBytes, st.PiecesVerified)
+	}
+
+	// A late duplicate of a block does not verify the piece again.
+	if done, _ := d.HandleBlockReceived(2, 16384, last[16384:], "10.0.0.3"); done {
+		t.Fatal("duplicate block completed the piece again")
+	}
+
+	if status, err := d.CheckPiece(2); err != nil || status != PieceValid {
+		t.Fatalf("CheckPiece(2) = %v, %v, want valid", status, err)
+	}
+	store.WriteAt([]byte{^last[19999]}, 2, 19999)
+	if status, err := d.CheckPiece(2); err != nil || status != PieceCorrupt {
+		t.Fatalf("CheckPiece(2) after corruption = %v, %v, want corrupt", status, err)
+	}
+}
@@ -0,0 +1,264 @@
+package peerman
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Jamescog/bttclient/internal/data"
+	"github.com/Jamescog/bttclient/pkg/protocol"
+	"github.com/Jamescog/bttclient/pkg/storage"
+)
+
+const (
+	webSeedBatch      = 64 // blocks fetched per round, 1 MiB
+	webSeedMinBackoff = 5 * time.Second
+	webSeedMaxBackoff = 5 * time.Minute
+	webSeedIdleCheck  = 10 * time.Second
+)
+
+// WebSeed is an HTTP server holding a copy of a torrent's files (BEP 19).
+type WebSeed struct {
+	URL    string
+	Files  []storage.File // as laid out in the torrent, paths start with the torrent name for multi-file torrents
+	Client *http.Client
+}
+
+// fileURL returns the URL of a torrent file on the web seed. A single-file
+// URL ending in a slash is a directory holding the file; multi-file URLs
+// always are.
+func (ws *WebSeed) fileURL(f storage.File) string {
+	multi := len(ws.Files) > 1 || len(f.Path) > 1
+	if !multi && !strings.HasSuffix(ws.URL, "/") {
+		return ws.URL
+	}
+
+	parts := make([]string, len(f.Path))
+	for i, p := range f.Path {
+		parts[i] = url.PathEscape(p)
+	}
+	base := ws.URL
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	return base + strings.Join(parts, "/")
+}
+
+// httpSource is a server that hands out torrent data over HTTP. fetch fills
+// buf with the data at begin in piece, which is offset in the torrent.
+type httpSource interface {
+	fetch(ctx context.Context, piece, begin uint32, offset int64, buf []byte) error
+}
+
+// retryAfterError is returned by sources whose server asked us to come back
+// later.
+type retryAfterError struct {
+	after time.Duration
+	err   error
+}
+
+func (e *retryAfterError) Error() string {
+	return fmt.Sprintf("%v (retry after %v)", e.err, e.after)
+}
+
+func (e *retryAfterError) Unwrap() error { return e.err }
+
+// RunWebSeed downloads from a web seed as if it were a peer that has every
+// piece, until ctx is done or the download completes. Blocks come from the
+// same picker as for other peers and are fetched with HTTP range requests;
+// after a failure the web seed backs off exponentially.
+func (d *Downloader) RunWebSeed(ctx context.Context, ws *WebSeed) {
+	d.runHTTPSource(ctx, "webseed:"+ws.URL, ws)
+}
+
+// runHTTPSource feeds src blocks from the picker until ctx is done or the
+// download completes. Only one loop runs per key, so a source can be started
+// again after Reopen without checking whether its old loop is still there.
+func (d *Downloader) runHTTPSource(ctx context.Context, key string, src httpSource) {
+	d.doneMu.Lock()
+	if d.httpSources[key] {
+		d.doneMu.Unlock()
+		return
+	}
+	d.httpSources[key] = true
+	d.doneMu.Unlock()
+
+	for {
+		completed := d.serveHTTPSource(ctx, key, src)
+
+		// Decided under doneMu so a concurrent Reopen either keeps this
+		// loop going or finds the key free to start it again.
+		d.doneMu.Lock()
+		if !completed || isClosed(d.done) {
+			delete(d.httpSources, key)
+			d.doneMu.Unlock()
+			return
+		}
+		d.doneMu.Unlock()
+	}
+}
+
+// serveHTTPSource registers src as a pseudo-peer under key and fetches
+// blocks for it. It reports whether it stopped because the download
+// completed.
+func (d *Downloader) serveHTTPSource(ctx context.Context, key string, src httpSource) bool {
+	done := d.Done()
+	all := protocol.NewBitfield(d.swarm.NumPieces)
+	all.SetAll()
+	d.swarm.AddPiecesForClient(key, 0, all)
+	d.swarm.UnchokeClient(key)
+	defer func() {
+		d.swarm.RemoveClient(key)
+		d.reissueBlocks(key)
+	}()
+
+	backoff := time.Duration(0)
+	for {
+		if backoff > 0 {
+			select {
+			case <-ctx.Done():
+				return false
+			case <-done:
+				return true
+			case <-time.After(backoff):
+			}
+		}
+
+		if d.swarm.IsBanned(key) {
+			return false
+		}
+
+		changed := d.swarm.PiecesChanged()
+		blocks := d.swarm.NextBlocksForPeer(key, webSeedBatch)
+		if len(blocks) == 0 {
+			select {
+			case <-ctx.Done():
+				return false
+			case <-done:
+				return true
+			case <-changed:
+			case <-time.After(webSeedIdleCheck):
+			}
+			continue
+		}
+
+		if err := d.fetchHTTPBlocks(ctx, src, key, blocks); err != nil {
+			d.swarm.ReleasePeerRequests(key)
+			if ctx.Err() != nil {
+				return false
+			}
+			backoff = nextBackoff(backoff, err)
+			log.Printf("%s failed, retrying in %v: %v", key, backoff, err)
+			d.reissueBlocks(key)
+			continue
+		}
+		backoff = 0
+	}
+}
+
+// nextBackoff returns how long to wait after a failed fetch, given the
+// previous wait: what the server asked for, or else twice as long as before.
+func nextBackoff(backoff time.Duration, err error) time.Duration {
+	var retry *retryAfterError
+	if errors.As(err, &retry) {
+		return min(max(retry.after, time.Second), webSeedMaxBackoff)
+	}
+	return min(max(2*backoff, webSeedMinBackoff), webSeedMaxBackoff)
+}
+
+// fetchHTTPBlocks downloads blocks, one fetch per run of consecutive blocks
+// in a piece, and feeds them to the downloader as if a peer had sent them.
+func (d *Downloader) fetchHTTPBlocks(ctx context.Context, src httpSource, key string, blocks []data.BlockRef) error {
+	for len(blocks) > 0 {
+		run := 1
+		for run < len(blocks) && blocks[run].Piece == blocks[0].Piece && blocks[run].Block == blocks[run-1].Block+1 {
+			run++
+		}
+
+		piece, ok := d.swarm.GetPieceState(blocks[0].Piece)
+		if !ok {
+			return fmt.Errorf("piece %d not found", blocks[0].Piece)
+		}
+		begin, _ := CalculateBlockInfo(blocks[0].Piece, blocks[0].Block, piece.TotalLength, piece.BlockSize)
+		lastBegin, lastLength := CalculateBlockInfo(blocks[0].Piece, blocks[run-1].Block, piece.TotalLength, piece.BlockSize)
+
+		buf := make([]byte, lastBegin+lastLength-begin)
+		offset := d.swarm.Geometry.Offset(blocks[0].Piece, int64(begin))
+		if err := src.fetch(ctx, blocks[0].Piece, begin, offset, buf); err != nil {
+			return err
+		}
+
+		for _, ref := range blocks[:run] {
+			blockBegin, blockLength := CalculateBlockInfo(ref.Piece, ref.Block, piece.TotalLength, piece.BlockSize)
+			block := buf[blockBegin-begin : blockBegin-begin+blockLength]
+			if _, err := d.HandleBlockReceived(ref.Piece, blockBegin, block, key); err != nil {
+				return err
+			}
+		}
+		blocks = blocks[run:]
+	}
+	return nil
+}
+
+// fetch issues a range request to each file the data touches.
+func (ws *WebSeed) fetch(ctx context.Context, piece, begin uint32, offset int64, buf []byte) error {
+	for _, f := range ws.Files {
+		if len(buf) == 0 {
+			break
+		}
+		if f.Length == 0 || offset >= f.Offset+f.Length {
+			continue
+		}
+		n := min(int64(len(buf)), f.Offset+f.Length-offset)
+		if err := ws.get(ctx, ws.fileURL(f), buf[:n], offset-f.Offset); err != nil {
+			return err
+		}
+		buf = buf[n:]
+		offset += n
+	}
+	if len(buf) > 0 {
+		return fmt.Errorf("range past end of torrent")
+	}
+	return nil
+}
+
+// get reads len(buf) bytes at off of the file at fileURL.
+func (ws *WebSeed) get(ctx context.Context, fileURL string, buf []byte, off int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(buf))-1))
+
+	client := ws.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the range and sends the whole file.
+		if _, err := io.CopyN(io.Discard, resp.Body, off); err != nil {
+			return fmt.Errorf("%s: %w", fileURL, err)
+		}
+	default:
+		return fmt.Errorf("%s: %s", fileURL, resp.Status)
+	}
+
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		return fmt.Errorf("%s: %w", fileURL, err)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package peerman
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Jamescog/bttclient/pkg/storage"
+)
+
+func TestWebSeedFileURL(t *testing.T) {
+	single := []storage.File{{Path: []string{"file.bin"}, Length: 10}}
+	multi := []storage.File{
+		{Path: []string{"name", "a b.txt"}, Length: 10},
+		{Path: []string{"name", "sub", "c#1"}, Length: 10, Offset: 10},
+	}
+
+	tests := []struct {
+		url   string
+		files []storage.File
+		file  int
+		want  string
+	}{
+		{"http://host/file.bin", single, 0, "http://host/file.bin"},
+		{"http://host/dir/", single, 0, "http://host/dir/file.bin"},
+		{"http://host/base", multi, 0, "http://host/base/name/a%20b.txt"},
+		{"http://host/base/", multi, 1, "http://host/base/name/sub/c%231"},
+	}
+	for _, tt := range tests {
+		ws := &WebSeed{URL: tt.url, Files: tt.files}
+		if got := ws.fileURL(tt.files[tt.file]); got != tt.want {
+			t.Errorf("fileURL(%q, %v) = %q, want %q", tt.url, tt.files[tt.file].Path, got, tt.want)
+		}
+	}
+}
+
+// webSeedServer serves files by path. Unless ranges is set it ignores
+// Range headers and answers 200 with the whole file.
+type webSeedServer struct {
+	files  map[string][]byte
+	ranges bool
+
+	mu       sync.Mutex
+	requests []string // Range headers received
+}
+
+func (s *webSeedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Header.Get("Range"))
+	s.mu.Unlock()
+
+	b, ok := s.files[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if s.ranges {
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(b))
+		return
+	}
+	w.Write(b)
+}
+
+func TestWebSeedDownload(t *testing.T) {
+	content := make([]byte, 65000)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	single := []storage.File{{Path: []string{"file.bin"}, Length: int64(len(content))}}
+	multi := []storage.File{
+		{Path: []string{"name", "a b.txt"}, Length: 10000},
+		{Path: []string{"name", "empty"}, Length: 0},
+		{Path: []string{"name", "sub", "c"}, Length: 30000},
+		{Path: []string{"name", "d"}, Length: 25000},
+	}
+	multiServed := map[string][]byte{
+		"/seed/name/a b.txt": content[:10000],
+		"/seed/name/sub/c":   content[10000:40000],
+		"/seed/name/d":       content[40000:],
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		files  []storage.File
+		served map[string][]byte
+		ranges bool
+	}{
+		{"single file 206", "/file.bin", single, map[string][]byte{"/file.bin": content}, true},
+		{"single file 200", "/file.bin", single, map[string][]byte{"/file.bin": content}, false},
+		{"multi file 206", "/seed", multi, multiServed, true},
+		{"multi file 200", "/seed/", multi, multiServed, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &webSeedServer{files: tt.served, ranges: tt.ranges}
+			ts := httptest.NewServer(srv)
+			defer ts.Close()
+
+			d, store, info := newTestTorrent(t, content, 16384, tt.files)
+			ws := &WebSeed{URL: ts.URL + tt.path, Files: info.Files, Client: ts.Client()}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			exited := make(chan struct{})
+			go func() {
+				defer close(exited)
+				d.RunWebSeed(ctx, ws)
+			}()
+
+			select {
+			case <-d.Done():
+			case <-ctx.Done():
+				t.Fatalf("download did not complete: %+v", d.swarm.Stats())
+			}
+			select {
+			case <-exited:
+			case <-time.After(time.Second):
+				t.Fatal("web seed still running after the download completed")
+			}
+
+			got := make([]byte, len(content))
+			for piece := range uint32(info.NumPieces()) {
+				start := info.PieceOffset(piece)
+				if _, err := store.ReadAt(got[start:start+info.PieceSize(piece)], piece, 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !bytes.Equal(got, content) {
+				t.Fatal("downloaded data does not match")
+			}
+			if banned := d.swarm.BannedPeers(); len(banned) > 0 {
+				t.Fatalf("banned %v", banned)
+			}
+			for _, r := range srv.requests {
+				if r == "" {
+					t.Fatal("request without a Range header")
+				}
+			}
+		})
+	}
+}
+
+func TestWebSeedBacksOffAfterErrors(t *testing.T) {
+	content := make([]byte, 40000)
+	d, _, info := newTestTorrent(t, content, 16384, []storage.File{{Path: []string{"file.bin"}, Length: int64(len(content))}})
+
+	var mu sync.Mutex
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		d.RunWebSeed(ctx, &WebSeed{URL: ts.URL + "/file.bin", Files: info.Files, Client: ts.Client()})
+	}()
+
+	time.Sleep(500 * time.Millisecond)
+	mu.Lock()
+	n := requests
+	mu.Unlock()
+	if n != 1 {
+		t.Fatalf("%d requests within the first backoff, want 1", n)
+	}
+	if got := d.swarm.Stats().DownloadedBytes; got != 0 {
+		t.Fatalf("downloaded %d bytes from a failing server", got)
+	}
+
+	// Cancelling interrupts the backoff wait.
+	cancel()
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatal("web seed did not stop while backing off")
+	}
+}
+
+func TestNextBackoff(t *testing.T) {
+	failed := errors.New("failed")
+	retry := func(after time.Duration) error { return &retryAfterError{after: after, err: failed} }
+
+	tests := []struct {
+		prev time.Duration
+		err  error
+		want time.Duration
+	}{
+		{0, failed, webSeedMinBackoff},
+		{webSeedMinBackoff, failed, 2 * webSeedMinBackoff},
+		{4 * time.Minute, failed, webSeedMaxBackoff},
+		{webSeedMaxBackoff, failed, webSeedMaxBackoff},
+		{0, retry(30 * time.Second), 30 * time.Second},
+		{time.Minute, retry(100 * time.Millisecond), time.Second},
+		{0, retry(time.Hour), webSeedMaxBackoff},
+	}
+	for _, tt := range tests {
+		if got := nextBackoff(tt.prev, tt.err); got != tt.want {
+			t.Errorf("nextBackoff(%v, %v) = %v, want %v", tt.prev, tt.err, got, tt.want)
+		}
+	}
+}
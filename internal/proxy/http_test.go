@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeHTTPProxy answers one CONNECT per connection with response, followed
+// in the same write by early bytes from the far end, then echoes. It sends
+// each request it received on requests.
+func fakeHTTPProxy(t *testing.T, response, early string) (*Proxy, <-chan *http.Request) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	requests := make(chan *http.Request, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				requests <- req
+				io.WriteString(conn, response+early)
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return &Proxy{Type: HTTP, Addr: ln.Addr().String()}, requests
+}
+
+func TestHTTPConnect(t *testing.T) {
+	p, requests := fakeHTTPProxy(t, "HTTP/1.1 200 Connection established\r\nVia: test\r\n\r\n", "early")
+	p.Username, p.Password = "alice", "secret"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := p.DialContext(ctx, "tcp", "tracker.example:6969")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req := <-requests
+	if req.Method != http.MethodConnect || req.RequestURI != "tracker.example:6969" || req.Host != "tracker.example:6969" {
+		t.Errorf("request %s %s for host %s", req.Method, req.RequestURI, req.Host)
+	}
+	if user, password, ok := req.BasicAuth(); ok || user != "" {
+		t.Errorf("credentials sent as Authorization: %q, %q", user, password)
+	}
+	if auth := req.Header.Get("Proxy-Authorization"); auth != "Basic YWxpY2U6c2VjcmV0" {
+		t.Errorf("Proxy-Authorization = %q", auth)
+	}
+
+	// Bytes that arrived with the response are read before the rest of the
+	// tunnel.
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	got := make([]byte, len("earlyping"))
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "earlyping" {
+		t.Errorf("tunnel returned %q, %v, want the early bytes then the echo", got, err)
+	}
+}
+
+func TestHTTPConnectUnbuffered(t *testing.T) {
+	p, requests := fakeHTTPProxy(t, "HTTP/1.1 200 OK\r\n\r\n", "")
+	conn, err := p.DialContext(context.Background(), "tcp", "1.2.3.4:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if req := <-requests; req.Header.Get("Proxy-Authorization") != "" {
+		t.Error("credentials sent without a user name")
+	}
+	if _, buffered := conn.(*bufferedConn); buffered {
+		t.Error("connection wrapped although nothing was buffered")
+	}
+}
+
+func TestHTTPConnectRefused(t *testing.T) {
+	p, _ := fakeHTTPProxy(t, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n", "")
+	_, err := p.DialContext(context.Background(), "tcp", "1.2.3.4:80")
+	if err == nil || !strings.Contains(err.Error(), "407") {
+		t.Errorf("dial = %v, want the 407 status", err)
+	}
+}
@@ -0,0 +1,341 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+const (
+	socksVersion = 5
+
+	authNone       = 0x00
+	authPassword   = 0x02
+	authNoneUsable = 0xff
+
+	cmdConnect      = 0x01
+	cmdUDPAssociate = 0x03
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+)
+
+var socksReplies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socksRequest authenticates and sends a command for addr, returning the
+// address the proxy bound for it.
+func (p *Proxy) socksRequest(conn net.Conn, cmd byte, addr string) (string, error) {
+	methods := []byte{authNone}
+	if p.Username != "" {
+		methods = append(methods, authPassword)
+	}
+	greeting := append([]byte{socksVersion, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return "", fmt.Errorf("proxy: write greeting: %w", err)
+	}
+
+	var choice [2]byte
+	if _, err := io.ReadFull(conn, choice[:]); err != nil {
+		return "", fmt.Errorf("proxy: read method: %w", err)
+	}
+	if choice[0] != socksVersion {
+		return "", fmt.Errorf("proxy: not a SOCKS5 server")
+	}
+	switch choice[1] {
+	case authNone:
+	case authPassword:
+		if err := p.socksAuth(conn); err != nil {
+			return "", err
+		}
+	default:
+		return "", errors.New("proxy: no acceptable authentication method")
+	}
+
+	req, err := appendAddr([]byte{socksVersion, cmd, 0}, addr)
+	if err != nil {
+		return "", err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return "", fmt.Errorf("proxy: write request: %w", err)
+	}
+
+	var reply [4]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return "", fmt.Errorf("proxy: read reply: %w", err)
+	}
+	if reply[1] != 0 {
+		reason, ok := socksReplies[reply[1]]
+		if !ok {
+			reason = fmt.Sprintf("error %d", reply[1])
+		}
+		return "", fmt.Errorf("proxy: %s: %s", addr, reason)
+	}
+	return readAddr(conn, reply[3])
+}
+
+// socksAuth performs username/password authentication (RFC 1929).
+func (p *Proxy) socksAuth(conn net.Conn) error {
+	if len(p.Username) > 255 || len(p.Password) > 255 {
+		return errors.New("proxy: credentials too long")
+	}
+	req := []byte{1, byte(len(p.Username))}
+	req = append(req, p.Username...)
+	req = append(req, byte(len(p.Password)))
+	req = append(req, p.Password...)
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("proxy: write credentials: %w", err)
+	}
+
+	var status [2]byte
+	if _, err := io.ReadFull(conn, status[:]); err != nil {
+		return fmt.Errorf("proxy: read auth status: %w", err)
+	}
+	if status[1] != 0 {
+		return errors.New("proxy: authentication failed")
+	}
+	return nil
+}
+
+// appendAddr encodes host:port in SOCKS form. Names are sent as domains so
+// the proxy resolves them.
+func appendAddr(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: %w", err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: bad port in %q", addr)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(append(b, atypIPv4), ip4...)
+		} else {
+			b = append(append(b, atypIPv6), ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("proxy: host name too long")
+		}
+		b = append(append(b, atypDomain, byte(len(host))), host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+func readAddr(r io.Reader, atyp byte) (string, error) {
+	var host []byte
+	switch atyp {
+	case atypIPv4:
+		host = make([]byte, net.IPv4len)
+	case atypIPv6:
+		host = make([]byte, net.IPv6len)
+	case atypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", fmt.Errorf("proxy: read address: %w", err)
+		}
+		host = make([]byte, n[0])
+	default:
+		return "", fmt.Errorf("proxy: unknown address type %d", atyp)
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, host); err != nil {
+		return "", fmt.Errorf("proxy: read address: %w", err)
+	}
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", fmt.Errorf("proxy: read address: %w", err)
+	}
+
+	h := string(host)
+	if atyp != atypDomain {
+		h = net.IP(host).String()
+	}
+	return net.JoinHostPort(h, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// hostAddr is a UDP destination that may still be a name for the proxy to
+// resolve.
+type hostAddr string
+
+func (a hostAddr) Network() string { return "udp" }
+func (a hostAddr) String() string  { return string(a) }
+
+// ListenPacket opens a UDP relay through a SOCKS5 proxy, for UDP trackers
+// and the DHT. The association lasts until the returned conn is closed.
+func (p *Proxy) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	if p.Type != SOCKS5 {
+		return nil, ErrNoUDP
+	}
+	ctrl, err := p.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		ctrl.SetDeadline(deadline)
+	}
+
+	local, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("proxy: %w", err)
+	}
+
+	// We do not know the address our datagrams will come from after NAT,
+	// so the association is requested for any source.
+	bound, err := p.socksRequest(ctrl, cmdUDPAssociate, "0.0.0.0:0")
+	if err != nil {
+		ctrl.Close()
+		local.Close()
+		return nil, err
+	}
+	ctrl.SetDeadline(time.Time{})
+
+	relay, err := net.ResolveUDPAddr("udp", bound)
+	if err != nil {
+		ctrl.Close()
+		local.Close()
+		return nil, fmt.Errorf("proxy: relay address: %w", err)
+	}
+	if relay.IP.IsUnspecified() {
+		relay.IP = ctrl.RemoteAddr().(*net.TCPAddr).IP
+	}
+
+	u := &udpRelay{PacketConn: local, ctrl: ctrl, relay: relay}
+	go u.watchControl()
+	return u, nil
+}
+
+// DialUDP returns a connected UDP conn to addr through a SOCKS5 proxy.
+func (p *Proxy) DialUDP(ctx context.Context, addr string) (net.Conn, error) {
+	pc, err := p.ListenPacket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &udpConn{relay: pc.(*udpRelay), target: hostAddr(addr)}, nil
+}
+
+// udpRelay wraps datagrams in the SOCKS5 UDP header and exchanges them with
+// the proxy's relay port.
+type udpRelay struct {
+	net.PacketConn
+	ctrl  net.Conn
+	relay *net.UDPAddr
+}
+
+// watchControl closes the relay when the proxy ends the association by
+// closing the control connection.
+func (u *udpRelay) watchControl() {
+	io.Copy(io.Discard, u.ctrl)
+	u.PacketConn.Close()
+}
+
+func (u *udpRelay) WriteTo(b []byte, addr net.Addr) (int, error) {
+	pkt, err := appendAddr([]byte{0, 0, 0}, addr.String())
+	if err != nil {
+		return 0, err
+	}
+	if _, err := u.PacketConn.WriteTo(append(pkt, b...), u.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (u *udpRelay) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(b)+262)
+	for {
+		n, from, err := u.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// Drop anything not relayed by the proxy, and fragments.
+		udp, ok := from.(*net.UDPAddr)
+		if !ok || !udp.IP.Equal(u.relay.IP) || udp.Port != u.relay.Port || n < 4 || buf[2] != 0 {
+			continue
+		}
+		r := &countingReader{b: buf[4:n]}
+		src, err := readAddr(r, buf[3])
+		if err != nil {
+			continue
+		}
+		return copy(b, buf[4+r.n:n]), hostAddr(src), nil
+	}
+}
+
+func (u *udpRelay) Close() error {
+	u.ctrl.Close()
+	return u.PacketConn.Close()
+}
+
+// udpConn is a udpRelay fixed to one destination.
+type udpConn struct {
+	relay  *udpRelay
+	target hostAddr
+}
+
+func (c *udpConn) Read(b []byte) (int, error) {
+	for {
+		n, from, err := c.relay.ReadFrom(b)
+		if err != nil {
+			return 0, err
+		}
+		if net.ParseIP(hostOf(string(c.target))) == nil || sameAddr(from.String(), string(c.target)) {
+			return n, nil
+		}
+	}
+}
+
+func (c *udpConn) Write(b []byte) (int, error)        { return c.relay.WriteTo(b, c.target) }
+func (c *udpConn) Close() error                       { return c.relay.Close() }
+func (c *udpConn) LocalAddr() net.Addr                { return c.relay.LocalAddr() }
+func (c *udpConn) RemoteAddr() net.Addr               { return c.target }
+func (c *udpConn) SetDeadline(t time.Time) error      { return c.relay.SetDeadline(t) }
+func (c *udpConn) SetReadDeadline(t time.Time) error  { return c.relay.SetReadDeadline(t) }
+func (c *udpConn) SetWriteDeadline(t time.Time) error { return c.relay.SetWriteDeadline(t) }
+
+func hostOf(addr string) string {
+	host, _, _ := net.SplitHostPort(addr)
+	return host
+}
+
+// sameAddr reports whether two IP:port strings name the same endpoint,
+// however the IPs are spelled.
+func sameAddr(a, b string) bool {
+	x, errA := netip.ParseAddrPort(a)
+	y, errB := netip.ParseAddrPort(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	return x.Addr().Unmap() == y.Addr().Unmap() && x.Port() == y.Port()
+}
+
+// countingReader reads from a byte slice and records how much was consumed.
+type countingReader struct {
+	b []byte
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	if r.n >= len(r.b) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b[r.n:])
+	r.n += n
+	return n, nil
+}
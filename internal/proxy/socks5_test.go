@@ -0,0 +1,387 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSOCKS is a SOCKS5 server on loopback. CONNECT requests are answered
+// with an echo of the tunnelled data; UDP ASSOCIATE requests get a relay
+// socket that answers each datagram with its payload reversed, from the
+// address it was sent to.
+type fakeSOCKS struct {
+	user     string // password authentication is required when set
+	password string
+	reply    byte // reply code for CONNECT, 0 for success
+	// unspecified binds the UDP relay as 0.0.0.0, leaving the client to
+	// use the proxy's address.
+	unspecified bool
+	// fragment sends a fragmented datagram ahead of each answer.
+	fragment bool
+
+	mu       sync.Mutex
+	requests [][]byte // address part of each request, as sent
+	methods  []byte   // authentication methods offered last
+	ctrl     net.Conn // control connection of the last association
+	udp      [][]byte // datagrams received by the relay
+}
+
+func newFakeSOCKS(t *testing.T, s *fakeSOCKS) *Proxy {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(t, conn)
+		}
+	}()
+
+	return &Proxy{Type: SOCKS5, Addr: ln.Addr().String(), Username: s.user, Password: s.password}
+}
+
+func (s *fakeSOCKS) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+
+	var greeting [2]byte
+	if _, err := io.ReadFull(conn, greeting[:]); err != nil || greeting[0] != socksVersion {
+		return
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.methods = methods
+	s.mu.Unlock()
+
+	if s.user == "" {
+		conn.Write([]byte{socksVersion, authNone})
+	} else {
+		if !bytes.Contains(methods, []byte{authPassword}) {
+			conn.Write([]byte{socksVersion, authNoneUsable})
+			return
+		}
+		conn.Write([]byte{socksVersion, authPassword})
+		var ver [2]byte
+		io.ReadFull(conn, ver[:])
+		user := make([]byte, ver[1])
+		io.ReadFull(conn, user)
+		var n [1]byte
+		io.ReadFull(conn, n[:])
+		password := make([]byte, n[0])
+		io.ReadFull(conn, password)
+		if string(user) != s.user || string(password) != s.password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	var req [3]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return
+	}
+	addr, err := readRawAddr(conn)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.requests = append(s.requests, addr)
+	s.mu.Unlock()
+
+	switch req[1] {
+	case cmdConnect:
+		if s.reply != 0 {
+			conn.Write([]byte{socksVersion, s.reply, 0, atypIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		// Bound address given as a domain, to exercise reading one.
+		conn.Write(append([]byte{socksVersion, 0, 0, atypDomain, 9}, "localhost\x00\x00"...))
+		io.Copy(conn, conn)
+	case cmdUDPAssociate:
+		s.associate(t, conn)
+	default:
+		conn.Write([]byte{socksVersion, 7, 0, atypIPv4, 0, 0, 0, 0, 0, 0})
+	}
+}
+
+func (s *fakeSOCKS) associate(t *testing.T, ctrl net.Conn) {
+	relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer relay.Close()
+
+	bound := relay.LocalAddr().(*net.UDPAddr)
+	ip := bound.IP.To4()
+	if s.unspecified {
+		ip = net.IPv4zero.To4()
+	}
+	reply := append([]byte{socksVersion, 0, 0, atypIPv4}, ip...)
+	ctrl.Write(binary.BigEndian.AppendUint16(reply, uint16(bound.Port)))
+	s.mu.Lock()
+	s.ctrl = ctrl
+	s.mu.Unlock()
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := relay.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pkt := append([]byte(nil), buf[:n]...)
+			s.mu.Lock()
+			s.udp = append(s.udp, pkt)
+			s.mu.Unlock()
+
+			// Answer from the destination: the same header, reversed data.
+			header, err := readRawAddr(bytes.NewReader(pkt[3:]))
+			if err != nil {
+				continue
+			}
+			payload := pkt[3+len(header):]
+			answer := append([]byte{0, 0, 0}, header...)
+			for i := len(payload) - 1; i >= 0; i-- {
+				answer = append(answer, payload[i])
+			}
+			if s.fragment {
+				frag := append([]byte(nil), answer...)
+				frag[2] = 1
+				relay.WriteTo(append(frag[:3+len(header)], "fragment"...), from)
+			}
+			relay.WriteTo(answer, from)
+		}
+	}()
+
+	// The association lasts as long as the control connection.
+	io.Copy(io.Discard, ctrl)
+}
+
+// readRawAddr reads a SOCKS address with its type byte and port and returns
+// it as sent.
+func readRawAddr(r io.Reader) ([]byte, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return nil, err
+	}
+	var n int
+	switch atyp[0] {
+	case atypIPv4:
+		n = 4
+	case atypIPv6:
+		n = 16
+	case atypDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return nil, err
+		}
+		rest := make([]byte, int(l[0])+2)
+		if _, err := io.ReadFull(r, rest); err != nil {
+			return nil, err
+		}
+		return append([]byte{atypDomain, l[0]}, rest...), nil
+	}
+	rest := make([]byte, n+2)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+	return append(atyp[:], rest...), nil
+}
+
+func (s *fakeSOCKS) offered() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.methods
+}
+
+func (s *fakeSOCKS) lastRequest() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.requests) == 0 {
+		return nil
+	}
+	return s.requests[len(s.requests)-1]
+}
+
+func (s *fakeSOCKS) lastDatagram() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.udp) == 0 {
+		return nil
+	}
+	return s.udp[len(s.udp)-1]
+}
+
+// Addresses with their SOCKS encoding.
+var socksAddrs = []struct {
+	addr string
+	want []byte
+}{
+	{"1.2.3.4:6881", []byte{atypIPv4, 1, 2, 3, 4, 0x1a, 0xe1}},
+	{"[2001:db8::1]:443", []byte{atypIPv6, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x01, 0xbb}},
+	{"tracker.example:80", append(append([]byte{atypDomain, 15}, "tracker.example"...), 0, 80)},
+	{"[::ffff:10.0.0.1]:1", []byte{atypIPv4, 10, 0, 0, 1, 0, 1}},
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	s := &fakeSOCKS{}
+	p := newFakeSOCKS(t, s)
+
+	for _, tt := range socksAddrs {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		conn, err := p.DialContext(ctx, "tcp", tt.addr)
+		cancel()
+		if err != nil {
+			t.Fatalf("dial %s: %v", tt.addr, err)
+		}
+		if got := s.lastRequest(); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s encoded as %x, want %x", tt.addr, got, tt.want)
+		}
+
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("ping"))
+		got := make([]byte, 4)
+		if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+			t.Errorf("%s: tunnel returned %q, %v", tt.addr, got, err)
+		}
+		conn.Close()
+	}
+
+	if methods := s.offered(); !bytes.Equal(methods, []byte{authNone}) {
+		t.Errorf("offered methods %v without credentials, want none only", methods)
+	}
+	if _, err := p.DialContext(context.Background(), "udp", "1.2.3.4:1"); err == nil {
+		t.Error("DialContext accepted a udp network")
+	}
+}
+
+func TestSOCKS5Auth(t *testing.T) {
+	s := &fakeSOCKS{user: "alice", password: "secret"}
+	p := newFakeSOCKS(t, s)
+
+	conn, err := p.DialContext(context.Background(), "tcp", "1.2.3.4:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if methods := s.offered(); !bytes.Equal(methods, []byte{authNone, authPassword}) {
+		t.Errorf("offered methods %v, want none and password", methods)
+	}
+
+	p.Password = "wrong"
+	if _, err := p.DialContext(context.Background(), "tcp", "1.2.3.4:80"); err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("dial with a wrong password = %v, want authentication failed", err)
+	}
+
+	// A server that requires a password refuses a client without one.
+	p.Username, p.Password = "", ""
+	if _, err := p.DialContext(context.Background(), "tcp", "1.2.3.4:80"); err == nil || !strings.Contains(err.Error(), "no acceptable authentication") {
+		t.Errorf("dial without credentials = %v, want no acceptable method", err)
+	}
+}
+
+func TestSOCKS5ConnectRefused(t *testing.T) {
+	p := newFakeSOCKS(t, &fakeSOCKS{reply: 5})
+	if _, err := p.DialContext(context.Background(), "tcp", "1.2.3.4:80"); err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("dial = %v, want connection refused", err)
+	}
+}
+
+func TestSOCKS5UDP(t *testing.T) {
+	for _, unspecified := range []bool{false, true} {
+		s := &fakeSOCKS{unspecified: unspecified}
+		p := newFakeSOCKS(t, s)
+
+		for _, tt := range socksAddrs {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			conn, err := p.DialUDP(ctx, tt.addr)
+			cancel()
+			if err != nil {
+				t.Fatalf("DialUDP %s: %v", tt.addr, err)
+			}
+			if got := s.lastRequest(); !bytes.Equal(got, []byte{atypIPv4, 0, 0, 0, 0, 0, 0}) {
+				t.Errorf("association requested for %x, want any source", got)
+			}
+
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Write([]byte("abc")); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, 16)
+			n, err := conn.Read(got)
+			if err != nil || string(got[:n]) != "cba" {
+				t.Fatalf("%s: read %q, %v, want the relayed answer", tt.addr, got[:n], err)
+			}
+			want := append(append([]byte{0, 0, 0}, tt.want...), "abc"...)
+			if dg := s.lastDatagram(); !bytes.Equal(dg, want) {
+				t.Errorf("%s: datagram %x, want %x", tt.addr, dg, want)
+			}
+			conn.Close()
+		}
+	}
+}
+
+func TestSOCKS5UDPReadFrom(t *testing.T) {
+	s := &fakeSOCKS{fragment: true}
+	p := newFakeSOCKS(t, s)
+
+	pc, err := p.ListenPacket(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Datagrams that do not come from the relay are dropped, and so are
+	// fragments from the relay.
+	stranger, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+	local := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: pc.LocalAddr().(*net.UDPAddr).Port}
+	stranger.WriteTo(append([]byte{0, 0, 0, atypIPv4, 9, 9, 9, 9, 0, 1}, "spoofed"...), local)
+
+	if _, err := pc.WriteTo([]byte("olleh"), hostAddr("tracker.example:80")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello" || from.String() != "tracker.example:80" {
+		t.Errorf("ReadFrom = %q from %v, want the relayed answer from tracker.example:80", buf[:n], from)
+	}
+
+	// Ending the association closes the relay.
+	s.mu.Lock()
+	s.ctrl.Close()
+	s.mu.Unlock()
+	if _, _, err := pc.ReadFrom(buf); err == nil {
+		t.Error("ReadFrom succeeded after the proxy ended the association")
+	}
+}
+
+func TestUDPNeedsSOCKS5(t *testing.T) {
+	p := &Proxy{Type: HTTP, Addr: "127.0.0.1:1"}
+	if _, err := p.DialUDP(context.Background(), "1.2.3.4:80"); err != ErrNoUDP {
+		t.Errorf("DialUDP through an HTTP proxy = %v, want ErrNoUDP", err)
+	}
+}
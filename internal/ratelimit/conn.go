@@ -0,0 +1,68 @@
+package ratelimit
+
+import (
+	"context"
+	"net"
+)
+
+// chunkSize bounds how much is read or written between limiter waits so
+// that several connections sharing a limiter interleave smoothly.
+const chunkSize = 16 * 1024
+
+// Conn applies a set of limiters to a connection. Reads are charged after
+// the data arrives, writes before it is sent. Every limiter in a chain must
+// grant the bytes, so a global, a per-torrent and a per-peer limit compose.
+// Create one with NewConn; Close wakes reads and writes waiting for a
+// limiter.
+type Conn struct {
+	net.Conn
+	ReadLimiters  []*Limiter
+	WriteLimiters []*Limiter
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewConn(conn net.Conn, read, write []*Limiter) *Conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Conn{Conn: conn, ReadLimiters: read, WriteLimiters: write, ctx: ctx, cancel: cancel}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if len(c.ReadLimiters) > 0 && len(p) > chunkSize {
+		p = p[:chunkSize]
+	}
+	n, err := c.Conn.Read(p)
+	for _, l := range c.ReadLimiters {
+		if waitErr := l.WaitN(c.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := p[written:]
+		if len(c.WriteLimiters) > 0 && len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		for _, l := range c.WriteLimiters {
+			if err := l.WaitN(c.ctx, len(chunk)); err != nil {
+				return written, err
+			}
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (c *Conn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
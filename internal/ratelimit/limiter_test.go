@@ -0,0 +1,180 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+const kib = 1024
+
+// idle pretends the limiter has been unused for an hour, so its bucket is
+// full.
+func idle(l *Limiter) {
+	l.mu.Lock()
+	l.last = time.Now().Add(-time.Hour)
+	l.mu.Unlock()
+}
+
+// timeWait returns how long WaitN(n) blocks.
+func timeWait(t *testing.T, l *Limiter, n int) time.Duration {
+	t.Helper()
+	start := time.Now()
+	if err := l.WaitN(context.Background(), n); err != nil {
+		t.Fatal(err)
+	}
+	return time.Since(start)
+}
+
+func checkAbout(t *testing.T, what string, got, want time.Duration) {
+	t.Helper()
+	if got < want*8/10 || got > want*15/10+50*time.Millisecond {
+		t.Errorf("%s took %v, want about %v", what, got, want)
+	}
+}
+
+func TestLimiterRate(t *testing.T) {
+	l := NewLimiter(100 * kib)
+	idle(l)
+	timeWait(t, l, 100*kib) // empty the bucket
+	checkAbout(t, "50 KiB at 100 KiB/s", timeWait(t, l, 50*kib), 500*time.Millisecond)
+}
+
+func TestLimiterBurst(t *testing.T) {
+	// A full bucket holds one second's worth, so the first 20 KiB pass at
+	// once but the next 10 KiB wait although the limiter was idle long.
+	l := NewLimiter(20 * kib)
+	idle(l)
+	if d := timeWait(t, l, 20*kib); d > 50*time.Millisecond {
+		t.Errorf("burst waited %v", d)
+	}
+	checkAbout(t, "10 KiB past the burst", timeWait(t, l, 10*kib), 500*time.Millisecond)
+
+	// Low rates still allow a whole block at once.
+	l = NewLimiter(kib)
+	idle(l)
+	if d := timeWait(t, l, minBurst); d > 50*time.Millisecond {
+		t.Errorf("block at a low rate waited %v", d)
+	}
+
+	// A request larger than the burst is charged in full.
+	l = NewLimiter(20 * kib)
+	idle(l)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := l.WaitN(ctx, 60*kib); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("WaitN past the burst = %v, want to wait until the deadline", err)
+	}
+}
+
+func TestLimiterSetRate(t *testing.T) {
+	l := NewLimiter(kib * kib)
+	idle(l)
+
+	// Lowering the rate shrinks the burst to the new rate.
+	l.SetRate(20 * kib)
+	if l.Rate() != 20*kib {
+		t.Fatalf("Rate() = %d", l.Rate())
+	}
+	timeWait(t, l, 20*kib)
+	checkAbout(t, "10 KiB after lowering the rate", timeWait(t, l, 10*kib), 500*time.Millisecond)
+
+	// 0 is unlimited, and negative rates are too.
+	for _, rate := range []int{0, -1} {
+		l.SetRate(rate)
+		if d := timeWait(t, l, 100*kib*kib); d > 50*time.Millisecond {
+			t.Errorf("unlimited at rate %d waited %v", rate, d)
+		}
+	}
+
+	// Raising the rate speeds up the next wait.
+	l.SetRate(100 * kib)
+	idle(l)
+	timeWait(t, l, 100*kib)
+	checkAbout(t, "50 KiB after raising the rate", timeWait(t, l, 50*kib), 500*time.Millisecond)
+}
+
+func TestLimiterShared(t *testing.T) {
+	l := NewLimiter(100 * kib)
+	idle(l)
+	timeWait(t, l, 100*kib)
+
+	// Two users taking 50 KiB each split the budget: together they need a
+	// second, where either alone would need half of one.
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 5 {
+				l.WaitN(context.Background(), 10*kib)
+			}
+		}()
+	}
+	wg.Wait()
+	checkAbout(t, "100 KiB shared", time.Since(start), time.Second)
+
+	var none *Limiter
+	if err := none.WaitN(context.Background(), kib); err != nil {
+		t.Errorf("nil limiter: %v", err)
+	}
+}
+
+func TestConnLimitsWrites(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	go io.Copy(io.Discard, b)
+
+	global, peer := NewLimiter(200*kib), NewLimiter(100*kib)
+	idle(global)
+	idle(peer)
+	c := NewConn(a, nil, []*Limiter{global, peer})
+	defer c.Close()
+
+	// The slower of the chained limiters sets the pace.
+	start := time.Now()
+	if n, err := c.Write(make([]byte, 150*kib)); n != 150*kib || err != nil {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	checkAbout(t, "150 KiB through a 100 KiB/s chain", time.Since(start), 500*time.Millisecond)
+}
+
+func TestConnCloseWakesWaiters(t *testing.T) {
+	for _, dir := range []string{"read", "write"} {
+		a, b := net.Pipe()
+		defer b.Close()
+
+		l := NewLimiter(kib)
+		var c *Conn
+		var op func() error
+		if dir == "read" {
+			c = NewConn(a, []*Limiter{l}, nil)
+			go b.Write(make([]byte, minBurst))
+			op = func() error { _, err := c.Read(make([]byte, minBurst)); return err }
+		} else {
+			c = NewConn(a, nil, []*Limiter{l})
+			go io.Copy(io.Discard, b)
+			op = func() error { _, err := c.Write(make([]byte, minBurst)); return err }
+		}
+
+		// The empty bucket needs 16 seconds for the block at 1 KiB/s.
+		result := make(chan error, 1)
+		go func() { result <- op() }()
+		time.Sleep(50 * time.Millisecond)
+		c.Close()
+
+		select {
+		case err := <-result:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("%s after Close = %v, want context.Canceled", dir, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s still waiting for the limiter after Close", dir)
+		}
+	}
+}
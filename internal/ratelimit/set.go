@@ -0,0 +1,47 @@
+package ratelimit
+
+import "sync"
+
+// Set hands out one limiter per connection, all following the same
+// adjustable rate, for per-peer limits that can change at runtime.
+type Set struct {
+	mu       sync.Mutex
+	rate     int
+	limiters map[*Limiter]struct{}
+}
+
+func NewSet(rate int) *Set {
+	return &Set{rate: rate, limiters: make(map[*Limiter]struct{})}
+}
+
+// New returns a limiter at the set's rate. Release it when the connection
+// closes.
+func (s *Set) New() *Limiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := NewLimiter(s.rate)
+	s.limiters[l] = struct{}{}
+	return l
+}
+
+func (s *Set) Release(l *Limiter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.limiters, l)
+}
+
+// SetRate changes the rate of every limiter in the set.
+func (s *Set) SetRate(rate int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rate = rate
+	for l := range s.limiters {
+		l.SetRate(rate)
+	}
+}
+
+func (s *Set) Rate() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rate
+}
@@ -0,0 +1,163 @@
+// Package resume persists enough of a torrent's state to restart it without
+// downloading or rehashing everything again.
+package resume
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Jamescog/bttclient/pkg/bencode"
+)
+
+// FileState records a data file as it was at the last checkpoint.
+type FileState struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Data is the content of a resume file.
+type Data struct {
+	InfoHash   [20]byte
+	NumPieces  int
+	Pieces     []byte // verified pieces, wire bitfield format
+	Files      []FileState
+	Priorities []int // per torrent file, empty when never changed
+	Peers      []net.TCPAddr
+	Uploaded   int64 // all-time; the downloaded total follows from Pieces
+	SavedAt    time.Time
+}
+
+// Load reads a resume file. A missing file is reported as os.ErrNotExist.
+func Load(path string) (*Data, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	value, _, err := bencode.DecodeNext(raw, 0)
+	if err != nil {
+		return nil, fmt.Errorf("decode resume file: %w", err)
+	}
+	dict, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("resume file is not a dictionary")
+	}
+
+	d := &Data{}
+	infoHash, _ := dict["info-hash"].([]byte)
+	if len(infoHash) != 20 {
+		return nil, fmt.Errorf("resume file has no valid info-hash")
+	}
+	copy(d.InfoHash[:], infoHash)
+
+	d.NumPieces, _ = dict["num pieces"].(int)
+	d.Pieces, _ = dict["pieces"].([]byte)
+	uploaded, _ := dict["uploaded"].(int)
+	savedAt, _ := dict["saved at"].(int)
+	d.Uploaded = int64(uploaded)
+	d.SavedAt = time.Unix(int64(savedAt), 0)
+
+	if files, ok := dict["files"].([]interface{}); ok {
+		for _, f := range files {
+			fm, ok := f.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			path, _ := fm["path"].([]byte)
+			size, _ := fm["size"].(int)
+			mtime, _ := fm["mtime"].(int)
+			d.Files = append(d.Files, FileState{Path: string(path), Size: int64(size), ModTime: time.Unix(0, int64(mtime))})
+		}
+	}
+
+	if priorities, ok := dict["file priorities"].([]interface{}); ok {
+		for _, p := range priorities {
+			priority, _ := p.(int)
+			d.Priorities = append(d.Priorities, priority)
+		}
+	}
+
+	if peers, ok := dict["peers"].([]byte); ok {
+		for i := 0; i+6 <= len(peers); i += 6 {
+			ip := net.IPv4(peers[i], peers[i+1], peers[i+2], peers[i+3])
+			port := binary.BigEndian.Uint16(peers[i+4 : i+6])
+			d.Peers = append(d.Peers, net.TCPAddr{IP: ip, Port: int(port)})
+		}
+	}
+
+	return d, nil
+}
+
+// Save writes d to path atomically, so a crash mid-write leaves the previous
+// checkpoint intact.
+func Save(path string, d *Data) error {
+	files := make([]interface{}, 0, len(d.Files))
+	for _, f := range d.Files {
+		files = append(files, map[string]interface{}{
+			"path":  f.Path,
+			"size":  f.Size,
+			"mtime": f.ModTime.UnixNano(),
+		})
+	}
+
+	priorities := make([]interface{}, 0, len(d.Priorities))
+	for _, p := range d.Priorities {
+		priorities = append(priorities, p)
+	}
+
+	var peers []byte
+	for _, p := range d.Peers {
+		ip4 := p.IP.To4()
+		if ip4 == nil {
+			continue
+		}
+		peers = append(peers, ip4...)
+		peers = binary.BigEndian.AppendUint16(peers, uint16(p.Port))
+	}
+
+	raw, err := bencode.Encode(map[string]interface{}{
+		"info-hash":       d.InfoHash[:],
+		"num pieces":      d.NumPieces,
+		"pieces":          d.Pieces,
+		"files":           files,
+		"file priorities": priorities,
+		"peers":           peers,
+		"uploaded":        d.Uploaded,
+		"saved at":        d.SavedAt.Unix(),
+	})
+	if err != nil {
+		return fmt.Errorf("encode resume data: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Stat captures the current size and modification time of a data file.
+func Stat(path string) (FileState, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return FileState{}, err
+	}
+	return FileState{Path: path, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Changed reports whether the file on disk differs from the checkpoint.
+func (f FileState) Changed() bool {
+	now, err := Stat(f.Path)
+	if err != nil {
+		return true
+	}
+	return now.Size != f.Size || !now.ModTime.Equal(f.ModTime)
+}
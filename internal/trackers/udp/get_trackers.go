@@ -25,7 +25,7 @@ func GenerateTransactionId() uint32 {
 	return mathrand.Uint32()
 }
 
-func SendConnect(conn *net.UDPConn) (uint64, uint32, error) {
+func SendConnect(conn net.Conn) (uint64, uint32, error) {
 	var buf [16]byte
 
 	binary.BigEndian.PutUint64(buf[0:8], protocolID)
@@ -68,7 +68,7 @@ func SendConnect(conn *net.UDPConn) (uint64, uint32, error) {
 
 }
 
-func SendAnnounce(conn *net.UDPConn, connectionID uint64, infoHash [20]byte, peerID [20]byte, port uint16, downloaded uint64, left uint64, uploaded uint64) ([]net.TCPAddr, error) {
+func SendAnnounce(conn net.Conn, connectionID uint64, infoHash [20]byte, peerID [20]byte, port uint16, downloaded uint64, left uint64, uploaded uint64) ([]net.TCPAddr, error) {
 
 	buf := bytes.NewBuffer(make([]byte, 0, 98))
 
@@ -0,0 +1,563 @@
+package utp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	maxPayload    = 1200
+	maxRecvBuffer = 1 << 20
+	maxSynRetries = 3
+	maxRetries    = 8
+	maxSackBytes  = 32
+	maxReorder    = 1024 // packets buffered ahead of a hole
+)
+
+type connState int
+
+const (
+	stateSynSent connState = iota
+	stateConnected
+	stateClosed
+)
+
+// outPacket is a sent packet awaiting acknowledgement.
+type outPacket struct {
+	typ           uint8
+	seq           uint16
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+	acked         bool // selectively acknowledged
+	needResend    bool // presumed lost, not counted in flight
+}
+
+type inPacket struct {
+	typ     uint8
+	payload []byte
+}
+
+// Conn is a uTP connection. It implements net.Conn.
+type Conn struct {
+	s      *Socket
+	raddr  net.Addr
+	recvID uint16
+	sendID uint16
+
+	mu          sync.Mutex
+	changed     chan struct{}
+	state       connState
+	err         error
+	localClosed bool
+	finSent     bool
+
+	// Sending.
+	seqNr      uint16 // next sequence number to send
+	outbound   []*outPacket
+	inFlight   int
+	peerWindow uint32
+	lastAck    uint16
+	dupAcks    int
+	fastResent uint16
+	cc         congestion
+	timer      *time.Timer
+
+	// Receiving.
+	ackNr          uint16 // last sequence number received in order
+	readBuf        bytes.Buffer
+	reorder        map[uint16]inPacket
+	reorderBytes   int
+	eof            bool
+	replyMicro     uint32
+	lastAdvertised uint32
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newConn(s *Socket, raddr net.Addr, recvID, sendID uint16) *Conn {
+	c := &Conn{
+		s:          s,
+		raddr:      raddr,
+		recvID:     recvID,
+		sendID:     sendID,
+		changed:    make(chan struct{}),
+		peerWindow: maxRecvBuffer,
+		cc:         newCongestion(),
+		reorder:    make(map[uint16]inPacket),
+	}
+	c.timer = time.AfterFunc(time.Hour, c.onTimer)
+	c.timer.Stop()
+	return c
+}
+
+// connect sends the SYN of an outgoing connection.
+func (c *Conn) connect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seqNr = 1
+	c.sendNewLocked(stSyn, nil)
+}
+
+// acceptSyn answers the SYN of an incoming connection.
+func (c *Conn) acceptSyn(h header) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != stateSynSent {
+		return false
+	}
+	c.state = stateConnected
+	c.ackNr = h.seqNr
+	c.seqNr = uint16(rand.Uint32())
+	c.lastAck = c.seqNr - 1
+	c.replyMicro = timestamp() - h.timestamp
+	c.peerWindow = h.wndSize
+	c.sendStateLocked()
+	return true
+}
+
+func (c *Conn) waitConnected(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.state == stateSynSent && c.err == nil {
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			c.mu.Lock()
+			return ctx.Err()
+		}
+		c.mu.Lock()
+	}
+	return c.err
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if c.localClosed {
+			return 0, net.ErrClosed
+		}
+		if c.readBuf.Len() > 0 {
+			n, _ := c.readBuf.Read(b)
+			if c.lastAdvertised < 4*maxPayload && c.recvWindow() >= 4*maxPayload && c.state == stateConnected {
+				c.sendStateLocked()
+			}
+			return n, nil
+		}
+		if c.eof {
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		if err := c.waitLocked(c.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	written := 0
+	for len(b) > 0 {
+		n := min(len(b), maxPayload)
+		for {
+			if c.localClosed {
+				return written, net.ErrClosed
+			}
+			if c.err != nil {
+				return written, c.err
+			}
+			if c.state == stateConnected && c.canSend(n) {
+				break
+			}
+			if err := c.waitLocked(c.writeDeadline); err != nil {
+				return written, err
+			}
+		}
+		c.sendNewLocked(stData, append([]byte(nil), b[:n]...))
+		b = b[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close sends a FIN. The connection stays registered until the FIN is
+// acknowledged or retransmission gives up.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.localClosed {
+		return nil
+	}
+	c.localClosed = true
+	if c.state == stateConnected && c.err == nil {
+		c.sendNewLocked(stFin, nil)
+		c.finSent = true
+	} else {
+		c.closeLocked()
+	}
+	c.broadcast()
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.s.pc.LocalAddr() }
+func (c *Conn) RemoteAddr() net.Addr { return c.raddr }
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.broadcast()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.broadcast()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.broadcast()
+	return nil
+}
+
+// receive handles a packet addressed to this connection.
+func (c *Conn) receive(h header, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateClosed {
+		return
+	}
+	defer c.broadcast()
+
+	c.replyMicro = timestamp() - h.timestamp
+	c.peerWindow = h.wndSize
+
+	switch h.typ {
+	case stReset:
+		c.failLocked(ErrReset)
+		return
+	case stSyn:
+		// Our answer to the SYN was lost.
+		c.sendStateLocked()
+		return
+	}
+
+	if c.state == stateSynSent {
+		c.state = stateConnected
+		c.ackNr = h.seqNr - 1
+	}
+
+	c.processAckLocked(h)
+
+	if h.typ == stData || h.typ == stFin {
+		c.receiveDataLocked(h, payload)
+		c.sendStateLocked()
+	}
+
+	if c.finSent && len(c.outbound) == 0 {
+		c.closeLocked()
+	}
+}
+
+func (c *Conn) processAckLocked(h header) {
+	now := time.Now()
+	acked := 0
+	newAck := false
+	for len(c.outbound) > 0 && !seqLess(h.ackNr, c.outbound[0].seq) {
+		acked += c.ackPacketLocked(c.outbound[0], now)
+		c.outbound = c.outbound[1:]
+		newAck = true
+	}
+	sacked := 0
+	for i := range len(h.sack) * 8 {
+		if h.sack[i/8]&(1<<(i%8)) == 0 {
+			continue
+		}
+		seq := h.ackNr + 2 + uint16(i)
+		for _, p := range c.outbound {
+			if p.seq == seq {
+				acked += c.ackPacketLocked(p, now)
+				sacked++
+				break
+			}
+		}
+	}
+	c.cc.onAck(acked, h.timeDiff, now)
+
+	if newAck {
+		c.dupAcks = 0
+	} else if h.typ == stState && h.ackNr == c.lastAck && len(c.outbound) > 0 {
+		c.dupAcks++
+	}
+	c.lastAck = h.ackNr
+
+	// Three duplicate acks, or three later packets received past a hole,
+	// mean the first unacked packet was lost.
+	if len(c.outbound) > 0 && (c.dupAcks >= 3 || sacked >= 3) {
+		p := c.outbound[0]
+		if !p.needResend && p.seq != c.fastResent {
+			c.fastResent = p.seq
+			c.cc.onLoss()
+			c.markLostLocked(p)
+		}
+	}
+
+	c.flushLocked()
+	if len(c.outbound) == 0 {
+		c.timer.Stop()
+	} else if newAck {
+		c.timer.Reset(c.cc.rto)
+	}
+}
+
+// ackPacketLocked accounts for an acknowledged packet and returns the bytes
+// newly acknowledged.
+func (c *Conn) ackPacketLocked(p *outPacket, now time.Time) int {
+	if p.acked {
+		return 0
+	}
+	p.acked = true
+	if p.needResend {
+		p.needResend = false
+	} else {
+		c.inFlight -= len(p.payload)
+	}
+	if p.transmissions == 1 {
+		c.cc.onRTTSample(now.Sub(p.sentAt))
+	}
+	return len(p.payload)
+}
+
+func (c *Conn) markLostLocked(p *outPacket) {
+	if p.acked || p.needResend {
+		return
+	}
+	p.needResend = true
+	c.inFlight -= len(p.payload)
+}
+
+func (c *Conn) receiveDataLocked(h header, payload []byte) {
+	if c.eof {
+		return
+	}
+	seq := h.seqNr
+	switch {
+	case seq == c.ackNr+1:
+		c.deliverLocked(h.typ, payload)
+		for !c.eof {
+			p, ok := c.reorder[c.ackNr+1]
+			if !ok {
+				break
+			}
+			delete(c.reorder, c.ackNr+1)
+			c.reorderBytes -= len(p.payload)
+			c.deliverLocked(p.typ, p.payload)
+		}
+	case seqLess(c.ackNr, seq) && seq-c.ackNr <= maxReorder:
+		if _, dup := c.reorder[seq]; !dup && c.recvWindow() >= uint32(len(payload)) {
+			c.reorder[seq] = inPacket{h.typ, payload}
+			c.reorderBytes += len(payload)
+		}
+	}
+}
+
+func (c *Conn) deliverLocked(typ uint8, payload []byte) {
+	c.ackNr++
+	if typ == stFin {
+		c.eof = true
+		c.reorder = make(map[uint16]inPacket)
+		c.reorderBytes = 0
+		return
+	}
+	c.readBuf.Write(payload)
+}
+
+func (c *Conn) recvWindow() uint32 {
+	return uint32(max(0, maxRecvBuffer-c.readBuf.Len()-c.reorderBytes))
+}
+
+func (c *Conn) canSend(size int) bool {
+	window := min(int(c.cc.window), int(c.peerWindow))
+	return c.inFlight == 0 || c.inFlight+size <= window
+}
+
+func (c *Conn) sendNewLocked(typ uint8, payload []byte) {
+	p := &outPacket{typ: typ, seq: c.seqNr, payload: payload}
+	c.seqNr++
+	c.outbound = append(c.outbound, p)
+	c.transmitLocked(p)
+	if len(c.outbound) == 1 {
+		c.timer.Reset(c.cc.rto)
+	}
+}
+
+func (c *Conn) transmitLocked(p *outPacket) {
+	connID := c.sendID
+	if p.typ == stSyn {
+		connID = c.recvID
+	}
+	h := header{
+		typ:      p.typ,
+		connID:   connID,
+		timeDiff: c.replyMicro,
+		wndSize:  c.recvWindow(),
+		seqNr:    p.seq,
+		ackNr:    c.ackNr,
+	}
+	p.sentAt = time.Now()
+	p.transmissions++
+	p.needResend = false
+	c.inFlight += len(p.payload)
+	c.lastAdvertised = h.wndSize
+	c.s.send(c.raddr, &h, p.payload)
+}
+
+// flushLocked retransmits lost packets as the window allows.
+func (c *Conn) flushLocked() {
+	for _, p := range c.outbound {
+		if !p.needResend {
+			continue
+		}
+		if !c.canSend(len(p.payload)) {
+			return
+		}
+		c.transmitLocked(p)
+	}
+}
+
+func (c *Conn) sendStateLocked() {
+	h := header{
+		typ:      stState,
+		connID:   c.sendID,
+		timeDiff: c.replyMicro,
+		wndSize:  c.recvWindow(),
+		seqNr:    c.seqNr,
+		ackNr:    c.ackNr,
+		sack:     c.sackLocked(),
+	}
+	c.lastAdvertised = h.wndSize
+	c.s.send(c.raddr, &h, nil)
+}
+
+// sackLocked builds the selective ack bitmask for packets received out of
+// order, or nil when there are none.
+func (c *Conn) sackLocked() []byte {
+	if len(c.reorder) == 0 {
+		return nil
+	}
+	mask := make([]byte, maxSackBytes)
+	last := -1
+	for seq := range c.reorder {
+		i := int(seq - c.ackNr - 2)
+		if i >= 0 && i < maxSackBytes*8 {
+			mask[i/8] |= 1 << (i % 8)
+			last = max(last, i)
+		}
+	}
+	if last < 0 {
+		return nil
+	}
+	return mask[:(last/32+1)*4]
+}
+
+// onTimer fires when the oldest unacked packet was not acknowledged in time:
+// everything in flight is presumed lost and the window collapses.
+func (c *Conn) onTimer() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateClosed || len(c.outbound) == 0 {
+		return
+	}
+	limit := maxRetries
+	if c.outbound[0].typ == stSyn {
+		limit = maxSynRetries
+	}
+	if c.outbound[0].transmissions >= limit {
+		c.failLocked(ErrTimeout)
+		return
+	}
+
+	c.cc.onTimeout()
+	for _, p := range c.outbound {
+		c.markLostLocked(p)
+	}
+	c.flushLocked()
+	c.timer.Reset(c.cc.rto)
+	c.broadcast()
+}
+
+// reset refuses a connection.
+func (c *Conn) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.s.send(c.raddr, &header{typ: stReset, connID: c.sendID, seqNr: c.seqNr, ackNr: c.ackNr}, nil)
+	c.failLocked(ErrReset)
+}
+
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failLocked(err)
+}
+
+func (c *Conn) failLocked(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.closeLocked()
+	c.broadcast()
+}
+
+func (c *Conn) closeLocked() {
+	if c.state == stateClosed {
+		return
+	}
+	c.state = stateClosed
+	c.timer.Stop()
+	if c.err == nil && !c.eof {
+		c.err = net.ErrClosed
+	}
+	c.s.remove(c)
+}
+
+// broadcast wakes every goroutine waiting for a state change.
+func (c *Conn) broadcast() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// waitLocked releases mu until the state changes or deadline passes.
+func (c *Conn) waitLocked(deadline time.Time) error {
+	changed := c.changed
+	c.mu.Unlock()
+	timeout, stop := deadlineTimer(deadline)
+	defer stop()
+
+	var err error
+	select {
+	case <-changed:
+	case <-timeout:
+		err = os.ErrDeadlineExceeded
+	}
+	c.mu.Lock()
+	return err
+}
@@ -0,0 +1,242 @@
+package utp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tapConn records the uTP packets written through it and can drop the
+// first transmission of one data packet.
+type tapConn struct {
+	net.PacketConn
+	dropNth int // data packet to lose once, counting from 1; 0 drops none
+
+	mu      sync.Mutex
+	data    map[uint16][]time.Time // transmissions of each data packet
+	dropped uint16                 // sequence number of the lost packet
+	sacks   int                    // state packets carrying a selective ack
+}
+
+func (c *tapConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if h, _, err := parsePacket(b); err == nil {
+		c.mu.Lock()
+		drop := false
+		switch h.typ {
+		case stData:
+			if len(c.data[h.seqNr]) == 0 && len(c.data)+1 == c.dropNth {
+				drop = true
+				c.dropped = h.seqNr
+			}
+			c.data[h.seqNr] = append(c.data[h.seqNr], time.Now())
+		case stState:
+			if len(h.sack) > 0 {
+				c.sacks++
+			}
+		}
+		c.mu.Unlock()
+		if drop {
+			return len(b), nil
+		}
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// retransmitted returns how many data packets were sent more than once.
+// Loopback drops datagrams too when a socket buffer overflows, so this
+// may count packets besides the one dropped on purpose.
+func (c *tapConn) retransmitted() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, times := range c.data {
+		if len(times) > 1 {
+			n++
+		}
+	}
+	return n
+}
+
+// resendDelay returns how long after its first transmission the dropped
+// packet was sent again.
+func (c *tapConn) resendDelay(t *testing.T) time.Duration {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	times := c.data[c.dropped]
+	if len(times) < 2 {
+		t.Fatalf("dropped packet %d was sent %d times", c.dropped, len(times))
+	}
+	return times[1].Sub(times[0])
+}
+
+func (c *tapConn) sackCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sacks
+}
+
+// loopbackSocket returns a socket on 127.0.0.1 that sends through tap and
+// then link, which loses, delays and reorders datagrams as configured.
+func loopbackSocket(t *testing.T, link lossyPacketConn, tap *tapConn, listen bool) *Socket {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link.PacketConn = pc
+	tap.PacketConn = &link
+	tap.data = make(map[uint16][]time.Time)
+	s := NewSocket(tap, listen)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// echo sends data from cli to srv, which sends it back, and checks that
+// both directions arrive intact.
+func echo(t *testing.T, cli, srv *Socket, data []byte) {
+	t.Helper()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		c, err := srv.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer c.Close()
+		c.SetReadDeadline(time.Now().Add(30 * time.Second))
+		got, err := io.ReadAll(io.LimitReader(c, int64(len(data))))
+		if err == nil {
+			_, err = c.Write(got)
+		}
+		serverErr <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := cli.DialContext(ctx, srv.Addr().String())
+	if err != nil {
+		t.Fatal("dial: ", err)
+	}
+	defer c.Close()
+
+	go c.Write(data)
+	c.SetReadDeadline(time.Now().Add(30 * time.Second))
+	back, err := io.ReadAll(io.LimitReader(c, int64(len(data))))
+	if err != nil {
+		t.Fatal("client read: ", err)
+	}
+	if err := <-serverErr; err != nil {
+		t.Fatal("server: ", err)
+	}
+	if !bytes.Equal(back, data) {
+		t.Fatalf("echoed %d bytes, want the %d sent", len(back), len(data))
+	}
+}
+
+func TestTransferOverLossyLink(t *testing.T) {
+	tests := []struct {
+		name string
+		link lossyPacketConn
+	}{
+		{"clean", lossyPacketConn{}},
+		{"loss", lossyPacketConn{Loss: 0.05}},
+		{"reorder", lossyPacketConn{Jitter: 5 * time.Millisecond}},
+		{"delay", lossyPacketConn{Delay: 30 * time.Millisecond}},
+		{"all", lossyPacketConn{Loss: 0.03, Delay: 10 * time.Millisecond, Jitter: 10 * time.Millisecond}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cliTap, srvTap tapConn
+			cli := loopbackSocket(t, tt.link, &cliTap, false)
+			srv := loopbackSocket(t, tt.link, &srvTap, true)
+
+			data := make([]byte, 256<<10)
+			rand.New(rand.NewSource(1)).Read(data)
+			echo(t, cli, srv, data)
+
+			if tt.link.Loss > 0 && cliTap.retransmitted()+srvTap.retransmitted() == 0 {
+				t.Error("nothing was retransmitted over a lossy link")
+			}
+			if tt.link.Jitter > 0 && cliTap.sackCount()+srvTap.sackCount() == 0 {
+				t.Error("no selective acks although packets were reordered")
+			}
+		})
+	}
+}
+
+func TestFastRetransmitOnSelectiveAck(t *testing.T) {
+	cliTap := tapConn{dropNth: 5}
+	var srvTap tapConn
+	cli := loopbackSocket(t, lossyPacketConn{}, &cliTap, false)
+	srv := loopbackSocket(t, lossyPacketConn{}, &srvTap, true)
+
+	data := make([]byte, 64<<10)
+	rand.New(rand.NewSource(2)).Read(data)
+	echo(t, cli, srv, data)
+
+	if srvTap.sackCount() == 0 {
+		t.Fatal("receiver did not acknowledge the packets after the hole selectively")
+	}
+	// The selective acks trigger the resend well before the retransmission
+	// timeout, which is at least 500ms.
+	if gap := cliTap.resendDelay(t); gap >= 500*time.Millisecond {
+		t.Fatalf("lost packet resent after %v, not by fast retransmit", gap)
+	}
+}
+
+func TestRetransmitOnTimeout(t *testing.T) {
+	// The only data packet is lost, so no later packet can reveal the hole
+	// and the retransmission timer has to resend it.
+	cliTap := tapConn{dropNth: 1}
+	var srvTap tapConn
+	cli := loopbackSocket(t, lossyPacketConn{}, &cliTap, false)
+	srv := loopbackSocket(t, lossyPacketConn{}, &srvTap, true)
+
+	echo(t, cli, srv, []byte("hello over a lossy link"))
+
+	if gap := cliTap.resendDelay(t); gap < 500*time.Millisecond {
+		t.Fatalf("lost packet resent after %v, before the retransmission timeout", gap)
+	}
+}
+
+func TestSelectiveAckMask(t *testing.T) {
+	tests := []struct {
+		ackNr    uint16
+		received []uint16
+		want     []byte
+	}{
+		{10, nil, nil},
+		{10, []uint16{12}, []byte{0x01, 0, 0, 0}},
+		{10, []uint16{12, 13, 20}, []byte{0x03, 0x01, 0, 0}},
+		{10, []uint16{45}, []byte{0, 0, 0, 0, 0x02, 0, 0, 0}},
+		{65535, []uint16{1, 2}, []byte{0x03, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		c := newConn(nil, nil, 1, 2)
+		c.ackNr = tt.ackNr
+		for _, seq := range tt.received {
+			c.reorder[seq] = inPacket{typ: stData}
+		}
+		got := c.sackLocked()
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("ackNr %d, received %v: mask %x, want %x", tt.ackNr, tt.received, got, tt.want)
+		}
+
+		// The mask survives the wire.
+		h := header{typ: stState, ackNr: tt.ackNr, sack: got}
+		parsed, _, err := parsePacket(h.marshal(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(parsed.sack, tt.want) {
+			t.Errorf("parsed mask %x, want %x", parsed.sack, tt.want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package utp
+
+import (
+	"time"
+)
+
+// LEDBAT congestion control: the window grows while the one-way queuing
+// delay stays below target and shrinks as it rises, so uTP yields to other
+// traffic on the same link.
+const (
+	targetDelay       = 100 * time.Millisecond
+	maxGainPerRTT     = 3000 // bytes
+	minWindow         = 2 * maxPayload
+	maxWindow         = 1 << 20
+	baseDelayInterval = time.Minute
+)
+
+type congestion struct {
+	window    float64 // bytes allowed in flight
+	slowStart bool
+
+	// The base delay is the smallest delay sample over the last two
+	// intervals; anything above it is queuing delay.
+	curMin, prevMin uint32
+	curStart        time.Time
+	haveMin         bool
+
+	rtt, rttVar time.Duration
+	rto         time.Duration
+}
+
+func newCongestion() congestion {
+	return congestion{
+		window:    minWindow,
+		slowStart: true,
+		rto:       time.Second,
+	}
+}
+
+// onAck grows or shrinks the window after bytes were acknowledged. delay is
+// the peer's measurement of our one-way delay, in microseconds of its clock
+// relative to ours; only differences between samples matter.
+func (c *congestion) onAck(acked int, delay uint32, now time.Time) {
+	if delay != 0 {
+		c.addDelaySample(delay, now)
+	}
+	if acked <= 0 {
+		return
+	}
+
+	queuing := time.Duration(0)
+	if c.haveMin {
+		queuing = time.Duration(delay-c.baseDelay()) * time.Microsecond
+		if delay == 0 || queuing < 0 || queuing > time.Minute {
+			queuing = 0
+		}
+	}
+
+	if c.slowStart && queuing < targetDelay/2 {
+		c.window += float64(acked)
+	} else {
+		c.slowStart = false
+		offTarget := float64(targetDelay-queuing) / float64(targetDelay)
+		c.window += maxGainPerRTT * offTarget * float64(acked) / c.window
+	}
+	c.window = min(max(c.window, minWindow), maxWindow)
+}
+
+// onLoss halves the window after a packet was detected lost.
+func (c *congestion) onLoss() {
+	c.slowStart = false
+	c.window = max(c.window/2, minWindow)
+}
+
+// onTimeout collapses the window after a retransmission timeout.
+func (c *congestion) onTimeout() {
+	c.slowStart = false
+	c.window = minWindow
+	c.rto = min(c.rto*2, 30*time.Second)
+}
+
+// onRTTSample updates the round trip estimate and timeout, as in TCP.
+func (c *congestion) onRTTSample(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = max(c.rtt+4*c.rttVar, 500*time.Millisecond)
+}
+
+func (c *congestion) addDelaySample(delay uint32, now time.Time) {
+	if !c.haveMin {
+		c.curMin, c.prevMin, c.curStart, c.haveMin = delay, delay, now, true
+		return
+	}
+	if now.Sub(c.curStart) > baseDelayInterval {
+		c.prevMin, c.curMin, c.curStart = c.curMin, delay, now
+	}
+	if int32(delay-c.curMin) < 0 {
+		c.curMin = delay
+	}
+}
+
+func (c *congestion) baseDelay() uint32 {
+	if int32(c.prevMin-c.curMin) < 0 {
+		return c.prevMin
+	}
+	return c.curMin
+}
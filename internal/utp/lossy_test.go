@@ -0,0 +1,35 @@
+package utp
+
+import (
+	"math/rand"
+	"net"
+	"time"
+)
+
+// lossyPacketConn wraps a PacketConn and drops or delays outgoing datagrams,
+// to exercise retransmission and congestion control over loopback.
+type lossyPacketConn struct {
+	net.PacketConn
+	// Loss is the probability in [0, 1] that a datagram is dropped.
+	Loss float64
+	// Delay is added to every datagram, plus a random extra up to Jitter,
+	// which also reorders them.
+	Delay  time.Duration
+	Jitter time.Duration
+}
+
+func (l *lossyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if l.Loss > 0 && rand.Float64() < l.Loss {
+		return len(b), nil
+	}
+	delay := l.Delay
+	if l.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(l.Jitter)))
+	}
+	if delay <= 0 {
+		return l.PacketConn.WriteTo(b, addr)
+	}
+	data := append([]byte(nil), b...)
+	time.AfterFunc(delay, func() { l.PacketConn.WriteTo(data, addr) })
+	return len(b), nil
+}
@@ -0,0 +1,102 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Packet types from BEP 29.
+const (
+	stData  = 0
+	stFin   = 1
+	stState = 2
+	stReset = 3
+	stSyn   = 4
+)
+
+const (
+	version    = 1
+	headerSize = 20
+
+	extNone         = 0
+	extSelectiveAck = 1
+)
+
+var errBadPacket = errors.New("utp: malformed packet")
+
+type header struct {
+	typ       uint8
+	connID    uint16
+	timestamp uint32 // sender's clock, microseconds
+	timeDiff  uint32 // sender's clock minus the timestamp of its last received packet
+	wndSize   uint32
+	seqNr     uint16
+	ackNr     uint16
+
+	// sack has bit i set when packet ackNr+2+i has been received.
+	sack []byte
+}
+
+// isUTP reports whether a datagram looks like a uTP packet rather than a
+// tracker or DHT message sharing the socket.
+func isUTP(b []byte) bool {
+	return len(b) >= headerSize && b[0]&0x0f == version && b[0]>>4 <= stSyn
+}
+
+func (h *header) marshal(payload []byte) []byte {
+	size := headerSize + len(payload)
+	if h.sack != nil {
+		size += 2 + len(h.sack)
+	}
+	b := make([]byte, headerSize, size)
+	b[0] = h.typ<<4 | version
+	if h.sack != nil {
+		b[1] = extSelectiveAck
+	}
+	binary.BigEndian.PutUint16(b[2:], h.connID)
+	binary.BigEndian.PutUint32(b[4:], h.timestamp)
+	binary.BigEndian.PutUint32(b[8:], h.timeDiff)
+	binary.BigEndian.PutUint32(b[12:], h.wndSize)
+	binary.BigEndian.PutUint16(b[16:], h.seqNr)
+	binary.BigEndian.PutUint16(b[18:], h.ackNr)
+	if h.sack != nil {
+		b = append(b, extNone, byte(len(h.sack)))
+		b = append(b, h.sack...)
+	}
+	return append(b, payload...)
+}
+
+// parsePacket decodes a header and its extensions and returns the payload.
+func parsePacket(b []byte) (header, []byte, error) {
+	var h header
+	if !isUTP(b) {
+		return h, nil, errBadPacket
+	}
+	h.typ = b[0] >> 4
+	h.connID = binary.BigEndian.Uint16(b[2:])
+	h.timestamp = binary.BigEndian.Uint32(b[4:])
+	h.timeDiff = binary.BigEndian.Uint32(b[8:])
+	h.wndSize = binary.BigEndian.Uint32(b[12:])
+	h.seqNr = binary.BigEndian.Uint16(b[16:])
+	h.ackNr = binary.BigEndian.Uint16(b[18:])
+
+	ext := b[1]
+	rest := b[headerSize:]
+	for ext != extNone {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return h, nil, errBadPacket
+		}
+		next, length := rest[0], int(rest[1])
+		if ext == extSelectiveAck {
+			h.sack = rest[2 : 2+length]
+		}
+		ext = next
+		rest = rest[2+length:]
+	}
+	return h, rest, nil
+}
+
+// seqLess compares 16-bit sequence numbers with wrap-around.
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
@@ -0,0 +1,373 @@
+// Package utp implements the Micro Transport Protocol (BEP 29): reliable,
+// ordered streams over UDP with LEDBAT congestion control. A Socket owns one
+// UDP socket and hands out net.Conn streams; datagrams that are not uTP are
+// passed on so UDP trackers and the DHT can share the same port.
+package utp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	acceptBacklog   = 32
+	unhandledQueue  = 64
+	maxDatagramSize = 64 * 1024
+)
+
+var (
+	ErrReset   = errors.New("utp: connection reset by peer")
+	ErrTimeout = errors.New("utp: connection timed out")
+)
+
+type connKey struct {
+	addr   string
+	recvID uint16
+}
+
+type datagram struct {
+	data []byte
+	addr net.Addr
+}
+
+// Socket multiplexes uTP connections and other UDP traffic over one
+// net.PacketConn. It is a net.Listener for incoming uTP connections.
+type Socket struct {
+	pc     net.PacketConn
+	listen bool
+
+	accepted  chan *Conn
+	unhandled chan datagram
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu     sync.Mutex
+	conns  map[connKey]*Conn
+	assocs map[string][]*packetConn
+	err    error
+}
+
+// NewSocket starts serving pc. Incoming uTP connections are refused unless
+// listen is set, in which case they are returned by Accept.
+func NewSocket(pc net.PacketConn, listen bool) *Socket {
+	s := &Socket{
+		pc:        pc,
+		listen:    listen,
+		accepted:  make(chan *Conn, acceptBacklog),
+		unhandled: make(chan datagram, unhandledQueue),
+		closed:    make(chan struct{}),
+		conns:     make(map[connKey]*Conn),
+		assocs:    make(map[string][]*packetConn),
+	}
+	go s.readLoop()
+	return s
+}
+
+// Accept waits for the next incoming uTP connection.
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accepted:
+		return c, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *Socket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// Close shuts the UDP socket and fails every connection on it.
+func (s *Socket) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.pc.Close()
+
+		s.mu.Lock()
+		s.err = net.ErrClosed
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+		for _, c := range conns {
+			c.fail(net.ErrClosed)
+		}
+	})
+	return err
+}
+
+// DialContext opens a uTP connection to addr ("host:port").
+func (s *Socket) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("utp: resolve: %w", err)
+	}
+
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	var recvID uint16
+	for {
+		recvID = uint16(rand.Uint32())
+		_, taken := s.conns[connKey{raddr.String(), recvID}]
+		if !taken {
+			break
+		}
+	}
+	c := newConn(s, raddr, recvID, recvID+1)
+	s.conns[connKey{raddr.String(), recvID}] = c
+	s.mu.Unlock()
+
+	c.connect()
+	if err := c.waitConnected(ctx); err != nil {
+		c.fail(err)
+		return nil, err
+	}
+	return c, nil
+}
+
+// DialPacket returns a connected datagram conn to addr for a non-uTP
+// protocol such as a UDP tracker. Datagrams from addr that are not uTP are
+// delivered to it instead of ReadFrom.
+func (s *Socket) DialPacket(addr *net.UDPAddr) net.Conn {
+	p := &packetConn{
+		s:       s,
+		raddr:   addr,
+		in:      make(chan []byte, 16),
+		changed: make(chan struct{}),
+	}
+	s.mu.Lock()
+	s.assocs[addr.String()] = append(s.assocs[addr.String()], p)
+	s.mu.Unlock()
+	return p
+}
+
+// ReadFrom returns the next datagram that is neither uTP nor claimed by a
+// DialPacket conn, so a DHT can share the socket. Such datagrams are dropped
+// when nobody reads them.
+func (s *Socket) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case d := <-s.unhandled:
+		return copy(b, d.data), d.addr, nil
+	case <-s.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+// WriteTo sends a raw datagram on the shared socket.
+func (s *Socket) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return s.pc.WriteTo(b, addr)
+}
+
+func (s *Socket) readLoop() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				s.Close()
+				return
+			}
+			// Errors such as ICMP port unreachable only concern one peer.
+			continue
+		}
+		data := append([]byte(nil), buf[:n]...)
+
+		if isUTP(data) {
+			s.dispatch(data, addr)
+			continue
+		}
+
+		s.mu.Lock()
+		assocs := s.assocs[addr.String()]
+		for _, p := range assocs {
+			select {
+			case p.in <- data:
+			default:
+			}
+		}
+		s.mu.Unlock()
+		if len(assocs) > 0 {
+			continue
+		}
+		select {
+		case s.unhandled <- datagram{data, addr}:
+		default:
+		}
+	}
+}
+
+func (s *Socket) dispatch(data []byte, addr net.Addr) {
+	h, payload, err := parsePacket(data)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	c, ok := s.conns[connKey{addr.String(), h.connID}]
+	if !ok && h.typ == stReset {
+		// A reset may carry the id we send with rather than receive on.
+		c, ok = s.conns[connKey{addr.String(), h.connID + 1}]
+		if !ok {
+			c, ok = s.conns[connKey{addr.String(), h.connID - 1}]
+		}
+	}
+	if !ok && h.typ == stSyn {
+		// A retransmitted SYN finds the connection under its receive id.
+		c, ok = s.conns[connKey{addr.String(), h.connID + 1}]
+		if !ok && s.listen && s.err == nil {
+			c = newConn(s, addr, h.connID+1, h.connID)
+			s.conns[connKey{addr.String(), h.connID + 1}] = c
+			s.mu.Unlock()
+			if c.acceptSyn(h) {
+				select {
+				case s.accepted <- c:
+				default:
+					c.reset()
+				}
+			}
+			return
+		}
+	}
+	s.mu.Unlock()
+
+	if ok {
+		c.receive(h, payload)
+		return
+	}
+	if h.typ != stReset {
+		s.send(addr, &header{typ: stReset, connID: h.connID, ackNr: h.seqNr}, nil)
+	}
+}
+
+func (s *Socket) send(addr net.Addr, h *header, payload []byte) {
+	h.timestamp = timestamp()
+	s.pc.WriteTo(h.marshal(payload), addr)
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := connKey{c.raddr.String(), c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+func timestamp() uint32 {
+	return uint32(time.Now().UnixMicro())
+}
+
+// packetConn is one non-uTP association on a shared Socket.
+type packetConn struct {
+	s     *Socket
+	raddr *net.UDPAddr
+	in    chan []byte
+
+	mu       sync.Mutex
+	deadline time.Time
+	changed  chan struct{}
+	closed   bool
+}
+
+func (p *packetConn) Read(b []byte) (int, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		deadline, changed := p.deadline, p.changed
+		p.mu.Unlock()
+
+		timeout, stop := deadlineTimer(deadline)
+		select {
+		case data := <-p.in:
+			stop()
+			return copy(b, data), nil
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		case <-changed:
+			stop()
+		case <-p.s.closed:
+			stop()
+			return 0, net.ErrClosed
+		}
+	}
+}
+
+func (p *packetConn) Write(b []byte) (int, error) {
+	return p.s.pc.WriteTo(b, p.raddr)
+}
+
+func (p *packetConn) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.changed)
+	p.mu.Unlock()
+
+	p.s.mu.Lock()
+	defer p.s.mu.Unlock()
+	key := p.raddr.String()
+	assocs := p.s.assocs[key]
+	for i, other := range assocs {
+		if other == p {
+			assocs = append(assocs[:i], assocs[i+1:]...)
+			break
+		}
+	}
+	if len(assocs) == 0 {
+		delete(p.s.assocs, key)
+	} else {
+		p.s.assocs[key] = assocs
+	}
+	return nil
+}
+
+func (p *packetConn) LocalAddr() net.Addr  { return p.s.pc.LocalAddr() }
+func (p *packetConn) RemoteAddr() net.Addr { return p.raddr }
+
+func (p *packetConn) SetDeadline(t time.Time) error { return p.SetReadDeadline(t) }
+
+func (p *packetConn) SetReadDeadline(t time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return net.ErrClosed
+	}
+	p.deadline = t
+	close(p.changed)
+	p.changed = make(chan struct{})
+	return nil
+}
+
+func (p *packetConn) SetWriteDeadline(time.Time) error { return nil }
+
+// deadlineTimer returns a channel that fires at deadline, or never for the
+// zero time, and a function releasing the timer.
+func deadlineTimer(deadline time.Time) (<-chan time.Time, func()) {
+	if deadline.IsZero() {
+		return nil, func() {}
+	}
+	t := time.NewTimer(time.Until(deadline))
+	return t.C, func() { t.Stop() }
+}
@@ -129,7 +129,11 @@ func DecodeTorrentFile(path string) (*Torrent, error) {
 	if err != nil {
 		return nil, err
 	}
+	return DecodeTorrent(data)
+}
 
+// DecodeTorrent decodes the contents of a torrent file
+func DecodeTorrent(data []byte) (*Torrent, error) {
 	value, _, err := DecodeNext(data, 0)
 	if err != nil {
 		return nil, err
@@ -152,6 +156,33 @@ func (t *Torrent) Announce() string {
 	return ""
 }
 
+// AnnounceList returns every tracker URL from announce-list, tier by tier,
+// falling back to the single announce URL
+func (t *Torrent) AnnounceList() []string {
+	var urls []string
+	seen := make(map[string]bool)
+	add := func(u string) {
+		if u != "" && !seen[u] {
+			seen[u] = true
+			urls = append(urls, u)
+		}
+	}
+
+	add(t.Announce())
+	if tiers, ok := t.Data["announce-list"].([]interface{}); ok {
+		for _, tier := range tiers {
+			if list, ok := tier.([]interface{}); ok {
+				for _, u := range list {
+					if s, ok := u.(string); ok {
+						add(s)
+					}
+				}
+			}
+		}
+	}
+	return urls
+}
+
 // Info returns the info dictionary
 func (t *Torrent) Info() map[string]interface{} {
 	if val, ok := t.Data["info"].(map[string]interface{}); ok {
@@ -227,3 +258,78 @@ func (t *Torrent) NumPieces() int {
 	}
 	return len(pieces) / 20
 }
+
+// File is one file of a torrent's data
+type File struct {
+	// Path is relative to the download directory. Paths of a multi-file
+	// torrent start with the torrent name.
+	Path   []string
+	Length int64
+}
+
+// Files lists the torrent's files in the order their data is laid out. A
+// single-file torrent has one file named after the torrent.
+func (t *Torrent) Files() []File {
+	info := t.Info()
+	if info == nil {
+		return nil
+	}
+
+	list, ok := info["files"].([]interface{})
+	if !ok {
+		return []File{{Path: []string{t.Name()}, Length: t.Length()}}
+	}
+
+	files := make([]File, 0, len(list))
+	for _, f := range list {
+		fileMap, ok := f.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		file := File{Path: []string{t.Name()}}
+		if length, ok := fileMap["length"].(int); ok {
+			file.Length = int64(length)
+		}
+		if parts, ok := fileMap["path"].([]interface{}); ok {
+			for _, p := range parts {
+				if s, ok := p.(string); ok {
+					file.Path = append(file.Path, s)
+				}
+			}
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+// URLList returns the web seed URLs of a torrent (BEP 19)
+func (t *Torrent) URLList() []string {
+	switch v := t.Data["url-list"].(type) {
+	case string:
+		if v != "" {
+			return []string{v}
+		}
+	case []interface{}:
+		var urls []string
+		for _, u := range v {
+			if s, ok := u.(string); ok && s != "" {
+				urls = append(urls, s)
+			}
+		}
+		return urls
+	}
+	return nil
+}
+
+// HTTPSeeds returns the Hoffman-style HTTP seed URLs of a torrent (BEP 17)
+func (t *Torrent) HTTPSeeds() []string {
+	var urls []string
+	if list, ok := t.Data["httpseeds"].([]interface{}); ok {
+		for _, u := range list {
+			if s, ok := u.(string); ok && s != "" {
+				urls = append(urls, s)
+			}
+		}
+	}
+	return urls
+}
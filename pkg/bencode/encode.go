@@ -0,0 +1,86 @@
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Encode bencodes a value built from the types DecodeNext produces: integers,
+// strings or byte slices, []interface{} lists and map[string]interface{}
+// dictionaries. Dictionary keys are written in sorted order.
+func Encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encodeValue(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeValue(buf *bytes.Buffer, v interface{}) error {
+	switch val := v.(type) {
+	case int:
+		writeInt(buf, int64(val))
+	case int64:
+		writeInt(buf, val)
+	case uint32:
+		writeInt(buf, int64(val))
+	case uint64:
+		writeInt(buf, int64(val))
+	case bool:
+		if val {
+			writeInt(buf, 1)
+		} else {
+			writeInt(buf, 0)
+		}
+	case string:
+		writeString(buf, []byte(val))
+	case []byte:
+		writeString(buf, val)
+	case []string:
+		buf.WriteByte('l')
+		for _, s := range val {
+			writeString(buf, []byte(s))
+		}
+		buf.WriteByte('e')
+	case []interface{}:
+		buf.WriteByte('l')
+		for _, item := range val {
+			if err := encodeValue(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		buf.WriteByte('d')
+		for _, k := range keys {
+			writeString(buf, []byte(k))
+			if err := encodeValue(buf, val[k]); err != nil {
+				return fmt.Errorf("key %q: %w", k, err)
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return fmt.Errorf("cannot bencode %T", v)
+	}
+	return nil
+}
+
+func writeInt(buf *bytes.Buffer, n int64) {
+	buf.WriteByte('i')
+	buf.WriteString(strconv.FormatInt(n, 10))
+	buf.WriteByte('e')
+}
+
+func writeString(buf *bytes.Buffer, s []byte) {
+	buf.WriteString(strconv.Itoa(len(s)))
+	buf.WriteByte(':')
+	buf.Write(s)
+}
@@ -0,0 +1,90 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/url"
+	"time"
+
+	tracker "github.com/Jamescog/bttclient/internal/trackers/udp"
+)
+
+const connectRetries = 3
+
+// announce asks the torrent's trackers for peers, trying each UDP tracker in
+// announce-list order until one answers.
+func (t *Torrent) announce(ctx context.Context) ([]net.TCPAddr, error) {
+	left := t.meta.Length() - t.swarm.Stats().DownloadedBytes
+	if left < 0 {
+		left = 0
+	}
+
+	var lastErr error
+	for _, announceURL := range t.meta.AnnounceList() {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		u, err := url.Parse(announceURL)
+		if err != nil {
+			lastErr = fmt.Errorf("parse announce URL %q: %w", announceURL, err)
+			continue
+		}
+		if u.Scheme != "udp" {
+			continue
+		}
+
+		start := time.Now()
+		peers, err := t.client.announceUDP(ctx, u.Host, t.infoHash, t.client.peerID, t.client.announcePort(), uint64(left))
+		if ctx.Err() == nil {
+			t.client.metrics.announceDuration.With(u.Host).ObserveSince(start)
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				t.client.metrics.announceErrors.With(u.Host).Inc()
+			}
+			lastErr = fmt.Errorf("announce to %s: %w", u.Host, err)
+			log.Printf("%v", lastErr)
+			continue
+		}
+		return peers, nil
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no usable UDP tracker")
+	}
+	return nil, lastErr
+}
+
+func (c *Client) announceUDP(ctx context.Context, trackerAddr string, infoHash, peerID [20]byte, port uint16, left uint64) ([]net.TCPAddr, error) {
+	conn, err := c.dialTracker(ctx, trackerAddr)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	var connectionID uint64
+	for i := 0; i < connectRetries; i++ {
+		connectionID, _, err = tracker.SendConnect(conn)
+		if err == nil {
+			break
+		}
+		log.Printf("connect attempt %d to %s failed: %v", i+1, trackerAddr, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(math.Pow(2, float64(i))) * time.Second):
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connect failed after retries: %w", err)
+	}
+
+	return tracker.SendAnnounce(conn, connectionID, infoHash, peerID, port, 0, left, 0)
+}
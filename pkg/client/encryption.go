@@ -0,0 +1,140 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+
+	"github.com/Jamescog/bttclient/internal/mse"
+	"github.com/Jamescog/bttclient/internal/peerman"
+	"github.com/Jamescog/bttclient/internal/utp"
+	"github.com/Jamescog/bttclient/pkg/protocol"
+)
+
+// EncryptionPolicy controls the use of Message Stream Encryption on peer
+// connections.
+type EncryptionPolicy int
+
+const (
+	// EncryptionDisabled speaks plaintext only and refuses encrypted peers.
+	EncryptionDisabled EncryptionPolicy = iota
+	// EncryptionPrefer tries encryption first and falls back to plaintext.
+	EncryptionPrefer
+	// EncryptionRequire only accepts RC4-encrypted connections.
+	EncryptionRequire
+)
+
+func (p EncryptionPolicy) String() string {
+	switch p {
+	case EncryptionDisabled:
+		return "disabled"
+	case EncryptionPrefer:
+		return "prefer"
+	case EncryptionRequire:
+		return "require"
+	}
+	return fmt.Sprintf("EncryptionPolicy(%d)", int(p))
+}
+
+// ParseEncryptionPolicy parses the name returned by String.
+func ParseEncryptionPolicy(s string) (EncryptionPolicy, error) {
+	for _, p := range []EncryptionPolicy{EncryptionDisabled, EncryptionPrefer, EncryptionRequire} {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown encryption policy %q", s)
+}
+
+// provide returns the crypto methods offered on outgoing connections, or 0
+// for a plaintext handshake.
+func (p EncryptionPolicy) provide() uint32 {
+	switch p {
+	case EncryptionPrefer:
+		return mse.CryptoRC4 | mse.CryptoPlaintext
+	case EncryptionRequire:
+		return mse.CryptoRC4
+	}
+	return 0
+}
+
+// choose picks the method for an incoming encrypted connection.
+func (p EncryptionPolicy) choose(provide uint32) uint32 {
+	if provide&mse.CryptoRC4 != 0 {
+		return mse.CryptoRC4
+	}
+	if p == EncryptionPrefer {
+		return provide & mse.CryptoPlaintext
+	}
+	return 0
+}
+
+// dialPeer connects to a peer following the encryption policy. With prefer, a
+// peer that fails the encrypted handshake is redialled in plaintext over the
+// transport that answered the first time.
+func (c *Client) dialPeer(ctx context.Context, p peerman.Peer, infoHash [20]byte) (net.Conn, error) {
+	tcpOnly := false
+	dial := func(ctx context.Context, addr string) (net.Conn, error) {
+		if tcpOnly {
+			return c.dialTCP(ctx, addr)
+		}
+		conn, err := c.dialTransport(ctx, addr)
+		if _, isUTP := conn.(*utp.Conn); err == nil && !isUTP {
+			tcpOnly = true
+		}
+		return conn, err
+	}
+
+	policy := c.config.Encryption
+	conn, err := peerman.ConnectToPeer(ctx, dial, p, infoHash, c.peerID, policy.provide(), c.listenPort())
+	if err == nil || policy != EncryptionPrefer || ctx.Err() != nil {
+		return conn, err
+	}
+	return peerman.ConnectToPeer(ctx, dial, p, infoHash, c.peerID, 0, c.listenPort())
+}
+
+// readInboundHandshake reads the handshake of an incoming connection, running
+// the encryption handshake first when the peer did not open with a plaintext
+// one. The returned connection replaces conn.
+func (c *Client) readInboundHandshake(conn net.Conn) (net.Conn, protocol.Handshake, error) {
+	prefix := make([]byte, 20)
+	if _, err := io.ReadFull(conn, prefix); err != nil {
+		return nil, protocol.Handshake{}, err
+	}
+
+	policy := c.config.Encryption
+	if prefix[0] == byte(len(protocol.ProtocolString)) && string(prefix[1:]) == protocol.ProtocolString {
+		if policy == EncryptionRequire {
+			return nil, protocol.Handshake{}, fmt.Errorf("plaintext connection refused")
+		}
+		hs, err := protocol.ReadHandshake(io.MultiReader(bytes.NewReader(prefix), conn))
+		return conn, hs, err
+	}
+	if policy == EncryptionDisabled {
+		return nil, protocol.Handshake{}, fmt.Errorf("encrypted connection refused")
+	}
+
+	c.mu.Lock()
+	skeys := make([][20]byte, 0, len(c.torrents))
+	for infoHash := range c.torrents {
+		skeys = append(skeys, infoHash)
+	}
+	c.mu.Unlock()
+
+	encrypted, skey, _, err := mse.Accept(conn, prefix, skeys, policy.choose)
+	if err != nil {
+		return nil, protocol.Handshake{}, err
+	}
+	hs, err := protocol.ReadHandshake(encrypted)
+	if err != nil {
+		return nil, protocol.Handshake{}, err
+	}
+	if hs.InfoHash != skey {
+		log.Printf("Peer %s asked for %x inside an encrypted stream for %x", conn.RemoteAddr(), hs.InfoHash, skey)
+		return nil, protocol.Handshake{}, fmt.Errorf("info hash mismatch")
+	}
+	return encrypted, hs, nil
+}
@@ -0,0 +1,162 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Jamescog/bttclient/internal/peerman"
+	"github.com/Jamescog/bttclient/pkg/protocol"
+)
+
+// socksRelay is a SOCKS5 proxy without authentication that only supports
+// CONNECT. It records the local address of each connection it opens, so a
+// peer can tell relayed connections from direct ones.
+type socksRelay struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	relayed map[string]bool
+}
+
+func newSOCKSRelay(t *testing.T) *socksRelay {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	r := &socksRelay{ln: ln, relayed: make(map[string]bool)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *socksRelay) serve(conn net.Conn) {
+	defer conn.Close()
+
+	// Greeting, then a CONNECT to an IPv4 address.
+	var greeting [2]byte
+	if _, err := io.ReadFull(conn, greeting[:]); err != nil {
+		return
+	}
+	if _, err := io.CopyN(io.Discard, conn, int64(greeting[1])); err != nil {
+		return
+	}
+	conn.Write([]byte{5, 0})
+	var req [10]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil || req[1] != 1 || req[3] != 1 {
+		return
+	}
+	target := net.JoinHostPort(net.IP(req[4:8]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(req[8:]))))
+
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	r.mu.Lock()
+	r.relayed[upstream.LocalAddr().String()] = true
+	r.mu.Unlock()
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
+
+func (r *socksRelay) isRelayed(addr net.Addr) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.relayed[addr.String()]
+}
+
+// TestDialPeerUsesProxy connects to a peer that refuses encryption, so the
+// prefer policy redials it in plaintext. Both dials must go through the
+// proxy.
+func TestDialPeerUsesProxy(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+
+	for _, proxyOnly := range []bool{false, true} {
+		relay := newSOCKSRelay(t)
+
+		peer, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer peer.Close()
+
+		var mu sync.Mutex
+		var from []net.Addr
+		go func() {
+			for {
+				conn, err := peer.Accept()
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				from = append(from, conn.RemoteAddr())
+				mu.Unlock()
+
+				// Answer a plaintext handshake; hang up on anything else.
+				go func() {
+					defer conn.Close()
+					theirs, err := protocol.ReadHandshake(conn)
+					if err != nil {
+						return
+					}
+					ours := protocol.Handshake{InfoHash: theirs.InfoHash, PeerID: [20]byte{9}}
+					conn.Write(ours.Marshal())
+					io.Copy(io.Discard, conn)
+				}()
+			}
+		}()
+
+		config := DefaultConfig()
+		config.DataDir = t.TempDir()
+		config.ListenPort = -1
+		config.PortMapping = false
+		config.Encryption = EncryptionPrefer
+		config.Proxy = "socks5://" + relay.ln.Addr().String()
+		config.ProxyOnly = proxyOnly
+		c, err := NewClient(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		addr := peer.Addr().(*net.TCPAddr)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		conn, err := c.dialPeer(ctx, peerman.Peer{IP: addr.IP.String(), Port: addr.Port}, infoHash)
+		if err != nil {
+			t.Fatalf("proxy only %v: %v", proxyOnly, err)
+		}
+		conn.Close()
+
+		// The relay records a connection before answering the CONNECT, so
+		// every relayed dial is known by now.
+		mu.Lock()
+		if len(from) != 2 {
+			t.Errorf("proxy only %v: peer was dialled %d times, want an encrypted and a plaintext attempt", proxyOnly, len(from))
+		}
+		for _, addr := range from {
+			if !relay.isRelayed(addr) {
+				t.Errorf("proxy only %v: connection from %v bypassed the proxy", proxyOnly, addr)
+			}
+		}
+		mu.Unlock()
+	}
+}
@@ -0,0 +1,54 @@
+package client
+
+import (
+	"log"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// holepunchDialDelay is the head start the peer that asked for a
+// rendezvous gets before the other end dials too.
+const holepunchDialDelay = 2 * time.Second
+
+// holepunch acts on a relay's connect message. Both ends send a datagram so
+// their NATs let the other's packets in, and both try to connect, as BEP 55
+// asks. The peer that asked for the rendezvous dials at once; the other
+// waits for that connection first, so the two rarely open duplicate
+// connections, and dials only if it has not arrived.
+func (t *Torrent) holepunch(addr netip.AddrPort, initiator bool) {
+	c := t.client
+	if c.utp == nil || !c.config.Holepunch {
+		return
+	}
+	if t.swarm.IsBanned(addr.Addr().String()) || c.blocked(addr.Addr(), &c.filterCounts.holepunch) {
+		return
+	}
+
+	if _, err := c.utp.WriteTo(nil, net.UDPAddrFromAddrPort(addr)); err != nil {
+		log.Printf("[%s] holepunch to %s: %v", t.Name(), addr, err)
+	}
+
+	connect := func() {
+		t.mu.Lock()
+		ctx := t.runCtx
+		t.mu.Unlock()
+		if ctx != nil {
+			t.connectPeer(ctx, *net.TCPAddrFromAddrPort(addr))
+		}
+	}
+	if initiator {
+		connect()
+	} else {
+		time.AfterFunc(holepunchDialDelay, connect)
+	}
+}
+
+// Holepunch asks connected peers to relay a uTP connection to addr, for
+// peers we cannot reach directly. It returns how many peers were asked.
+func (t *Torrent) Holepunch(addr netip.AddrPort) int {
+	if t.client.utp == nil || !t.client.config.Holepunch {
+		return 0
+	}
+	return t.downloader.Rendezvous(addr)
+}
@@ -0,0 +1,129 @@
+package client
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// HTTPHandler serves the files of the client's torrents while they
+// download, so media players and browsers can play them. Each file is at
+// /<info hash>/<path inside the torrent>; / and /<info hash>/ list links.
+// Range requests are supported, and the requested range is fetched before
+// other pieces.
+func (c *Client) HTTPHandler() http.Handler {
+	return http.HandlerFunc(c.serveHTTP)
+}
+
+// FileURL returns the path HTTPHandler serves file i of t at.
+func (t *Torrent) FileURL(i int) string {
+	parts := []string{hex.EncodeToString(t.infoHash[:])}
+	for _, part := range filePath(t.layout.Files[i].Path) {
+		parts = append(parts, url.PathEscape(part))
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// filePath drops the torrent name that prefixes multi-file paths.
+func filePath(p []string) []string {
+	if len(p) > 1 {
+		return p[1:]
+	}
+	return p
+}
+
+func (c *Client) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	hash, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if hash == "" {
+		c.serveIndex(w)
+		return
+	}
+
+	raw, err := hex.DecodeString(hash)
+	if err != nil || len(raw) != 20 {
+		http.NotFound(w, r)
+		return
+	}
+	t, ok := c.Torrent([20]byte(raw))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if rest == "" {
+		t.serveFileList(w)
+		return
+	}
+
+	file := -1
+	for i, f := range t.layout.Files {
+		if strings.Join(filePath(f.Path), "/") == rest {
+			file = i
+			break
+		}
+	}
+	if file < 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	reader, err := t.NewReader(r.Context(), file)
+	if errors.Is(err, ErrFileSkipped) {
+		http.Error(w, "file is not selected for download", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+
+	// Set the type up front: sniffing it would block on the first piece.
+	name := path.Base(rest)
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, name, time.Time{}, reader)
+}
+
+func (c *Client) serveIndex(w http.ResponseWriter) {
+	torrents := c.Torrents()
+	sort.Slice(torrents, func(i, j int) bool { return torrents[i].Name() < torrents[j].Name() })
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintln(w, "<!DOCTYPE html><ul>")
+	for _, t := range torrents {
+		fmt.Fprintf(w, "<li><a href=\"/%s/\">%s</a></li>\n", hex.EncodeToString(t.infoHash[:]), html.EscapeString(t.Name()))
+	}
+	fmt.Fprintln(w, "</ul>")
+}
+
+func (t *Torrent) serveFileList(w http.ResponseWriter) {
+	priorities := t.FilePriorities()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<!DOCTYPE html><h1>%s</h1><ul>\n", html.EscapeString(t.Name()))
+	for i, f := range t.layout.Files {
+		name := html.EscapeString(strings.Join(filePath(f.Path), "/"))
+		if priorities[i] == PrioritySkip {
+			fmt.Fprintf(w, "<li>%s (skipped)</li>\n", name)
+			continue
+		}
+		fmt.Fprintf(w, "<li><a href=\"%s\">%s</a> (%d bytes)</li>\n", t.FileURL(i), name, f.Length)
+	}
+	fmt.Fprintln(w, "</ul>")
+}
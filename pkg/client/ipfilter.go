@@ -0,0 +1,76 @@
+package client
+
+import (
+	"net"
+	"net/netip"
+	"sync/atomic"
+
+	"github.com/Jamescog/bttclient/pkg/ipfilter"
+)
+
+// FilterStats counts connection attempts refused by the IP filter, by where
+// the peer address came from.
+type FilterStats struct {
+	Tracker   int64
+	Resume    int64
+	Inbound   int64
+	Holepunch int64
+}
+
+type filterCounters struct {
+	tracker, resume, inbound, holepunch atomic.Int64
+}
+
+// SetIPFilter replaces the blocklist. It applies to connections attempted
+// from now on; nil blocks nothing.
+func (c *Client) SetIPFilter(f *ipfilter.Filter) {
+	c.ipFilter.Store(f)
+}
+
+// IPFilter returns the blocklist in use, or nil.
+func (c *Client) IPFilter() *ipfilter.Filter {
+	return c.ipFilter.Load()
+}
+
+// FilterStats returns how many peers the IP filter has refused.
+func (c *Client) FilterStats() FilterStats {
+	return FilterStats{
+		Tracker:   c.filterCounts.tracker.Load(),
+		Resume:    c.filterCounts.resume.Load(),
+		Inbound:   c.filterCounts.inbound.Load(),
+		Holepunch: c.filterCounts.holepunch.Load(),
+	}
+}
+
+// blocked reports whether ip is filtered, counting the refusal if so.
+func (c *Client) blocked(ip netip.Addr, counter *atomic.Int64) bool {
+	if !c.ipFilter.Load().Blocked(ip) {
+		return false
+	}
+	counter.Add(1)
+	return true
+}
+
+// filterPeers drops filtered addresses from a list of candidate peers.
+func (c *Client) filterPeers(peers []net.TCPAddr, counter *atomic.Int64) []net.TCPAddr {
+	allowed := peers[:0:0]
+	for _, addr := range peers {
+		if !c.blocked(addr.AddrPort().Addr(), counter) {
+			allowed = append(allowed, addr)
+		}
+	}
+	return allowed
+}
+
+// blockedConn reports whether an incoming connection comes from a filtered
+// address.
+func (c *Client) blockedConn(conn net.Conn) bool {
+	var ip netip.Addr
+	switch a := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		ip = a.AddrPort().Addr()
+	case *net.UDPAddr:
+		ip = a.AddrPort().Addr()
+	}
+	return c.blocked(ip, &c.filterCounts.inbound)
+}
@@ -0,0 +1,133 @@
+package client
+
+import (
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/Jamescog/bttclient/pkg/metrics"
+	"github.com/Jamescog/bttclient/pkg/storage"
+)
+
+// clientMetrics are the client's Prometheus metrics. Per torrent totals are
+// kept by the torrents themselves and copied in on every scrape; latencies
+// are observed as they happen.
+type clientMetrics struct {
+	registry *metrics.Registry
+
+	downloaded      *metrics.Vec
+	uploaded        *metrics.Vec
+	piecesVerified  *metrics.Vec
+	piecesFailed    *metrics.Vec
+	pieces          *metrics.Vec
+	peers           *metrics.Vec
+	requestTimeouts *metrics.Vec
+	filtered        *metrics.Vec
+
+	announceDuration *metrics.HistogramVec
+	announceErrors   *metrics.Vec
+	diskDuration     *metrics.HistogramVec
+}
+
+func newClientMetrics(c *Client) *clientMetrics {
+	r := metrics.NewRegistry()
+	m := &clientMetrics{
+		registry: r,
+
+		downloaded: r.Counter("bttclient_torrent_downloaded_bytes_total",
+			"Bytes of verified piece data downloaded.", "infohash", "name"),
+		uploaded: r.Counter("bttclient_torrent_uploaded_bytes_total",
+			"Bytes of piece data uploaded to peers.", "infohash", "name"),
+		piecesVerified: r.Counter("bttclient_torrent_pieces_verified_total",
+			"Downloaded pieces that passed the hash check.", "infohash", "name"),
+		piecesFailed: r.Counter("bttclient_torrent_pieces_failed_total",
+			"Downloaded pieces that failed the hash check.", "infohash", "name"),
+		pieces: r.Gauge("bttclient_torrent_pieces",
+			"Pieces by state: completed, wanted, in_progress or total.", "infohash", "name", "state"),
+		peers: r.Gauge("bttclient_torrent_peers",
+			"Peers by state: connected, active (unchoking us), snubbed or banned.", "infohash", "name", "state"),
+		requestTimeouts: r.Counter("bttclient_torrent_request_timeouts_total",
+			"Block requests that peers did not answer in time.", "infohash", "name"),
+		filtered: r.Counter("bttclient_ipfilter_blocked_total",
+			"Peers refused by the IP filter, by where their address came from.", "source"),
+
+		announceDuration: r.Histogram("bttclient_tracker_announce_duration_seconds",
+			"Time taken by tracker announces, successful or not.", nil, "tracker"),
+		announceErrors: r.Counter("bttclient_tracker_announce_errors_total",
+			"Tracker announces that failed.", "tracker"),
+		diskDuration: r.Histogram("bttclient_disk_io_duration_seconds",
+			"Time taken by storage reads and writes.", nil, "op"),
+	}
+	r.OnScrape(func() { m.collect(c) })
+	return m
+}
+
+// collect copies the current totals of every torrent.
+func (m *clientMetrics) collect(c *Client) {
+	for _, v := range []*metrics.Vec{m.downloaded, m.uploaded, m.piecesVerified, m.piecesFailed, m.pieces, m.peers, m.requestTimeouts} {
+		v.Reset()
+	}
+	for _, t := range c.Torrents() {
+		hash, name := hex.EncodeToString(t.infoHash[:]), t.Name()
+		st := t.Stats()
+		m.downloaded.With(hash, name).Set(float64(st.DownloadedBytes))
+		m.uploaded.With(hash, name).Set(float64(st.UploadedBytes))
+		m.piecesVerified.With(hash, name).Set(float64(st.PiecesVerified))
+		m.piecesFailed.With(hash, name).Set(float64(st.PiecesFailed))
+		m.requestTimeouts.With(hash, name).Set(float64(st.TimedOutRequests))
+
+		m.pieces.With(hash, name, "completed").Set(float64(st.CompletedPieces))
+		m.pieces.With(hash, name, "wanted").Set(float64(st.WantedPieces))
+		m.pieces.With(hash, name, "in_progress").Set(float64(st.InProgressPieces))
+		m.pieces.With(hash, name, "total").Set(float64(st.TotalPieces))
+
+		m.peers.With(hash, name, "connected").Set(float64(st.Peers))
+		m.peers.With(hash, name, "active").Set(float64(st.ActivePeers))
+		m.peers.With(hash, name, "snubbed").Set(float64(st.SnubbedPeers))
+		m.peers.With(hash, name, "banned").Set(float64(st.BannedPeers))
+	}
+
+	fs := c.FilterStats()
+	m.filtered.With("tracker").Set(float64(fs.Tracker))
+	m.filtered.With("resume").Set(float64(fs.Resume))
+	m.filtered.With("inbound").Set(float64(fs.Inbound))
+	m.filtered.With("holepunch").Set(float64(fs.Holepunch))
+}
+
+// MetricsHandler serves the client's metrics in the Prometheus text
+// format.
+func (c *Client) MetricsHandler() http.Handler {
+	return c.metrics.registry
+}
+
+// timedStorage records the latency of reads and writes to a torrent's
+// storage. Sync is passed through so buffered storage is still flushed.
+type timedStorage struct {
+	storage.TorrentStorage
+	reads, writes metrics.Histogram
+}
+
+func (m *clientMetrics) timeStorage(s storage.TorrentStorage) *timedStorage {
+	return &timedStorage{
+		TorrentStorage: s,
+		reads:          m.diskDuration.With("read"),
+		writes:         m.diskDuration.With("write"),
+	}
+}
+
+func (s *timedStorage) ReadAt(p []byte, piece uint32, off int64) (int, error) {
+	defer s.reads.ObserveSince(time.Now())
+	return s.TorrentStorage.ReadAt(p, piece, off)
+}
+
+func (s *timedStorage) WriteAt(p []byte, piece uint32, off int64) (int, error) {
+	defer s.writes.ObserveSince(time.Now())
+	return s.TorrentStorage.WriteAt(p, piece, off)
+}
+
+func (s *timedStorage) Sync() error {
+	if syncer, ok := s.TorrentStorage.(storage.Syncer); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package client
+
+import (
+	"net/netip"
+
+	"github.com/Jamescog/bttclient/pkg/portmap"
+)
+
+// startPortMapping forwards the listen port on the router in the
+// background, for uTP too when it shares the port.
+func (c *Client) startPortMapping() {
+	port := int(c.listenPort())
+	ports := []portmap.Port{{Protocol: "tcp", Port: port}}
+	if c.utp != nil {
+		ports = append(ports, portmap.Port{Protocol: "udp", Port: port})
+	}
+
+	opts := c.config.PortMapOptions
+	if opts.Description == "" {
+		opts.Description = "bttclient"
+	}
+	c.portmap = portmap.Start(opts, ports)
+}
+
+// PortMappings returns the ports the router currently forwards to us.
+func (c *Client) PortMappings() []portmap.Mapping {
+	if c.portmap == nil {
+		return nil
+	}
+	return c.portmap.Mappings()
+}
+
+// ExternalAddr returns our public address as reported by the router, once
+// a port mapping is in place.
+func (c *Client) ExternalAddr() (netip.Addr, bool) {
+	if c.portmap == nil {
+		return netip.Addr{}, false
+	}
+	return c.portmap.ExternalAddr()
+}
+
+// announcePort is the port trackers should give out: the router's external
+// port when it forwards a different one, else the listen port.
+func (c *Client) announcePort() uint16 {
+	port := c.listenPort()
+	if c.portmap != nil {
+		if external, ok := c.portmap.ExternalPort(portmap.Port{Protocol: "tcp", Port: int(port)}); ok {
+			return uint16(external)
+		}
+	}
+	return port
+}
@@ -0,0 +1,142 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/Jamescog/bttclient/pkg/storage"
+)
+
+// Priority controls whether and how eagerly a file is downloaded.
+type Priority int
+
+const (
+	PrioritySkip Priority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PrioritySkip:
+		return "skip"
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	}
+	return fmt.Sprintf("Priority(%d)", int(p))
+}
+
+// Files returns the torrent's files in the order their data is laid out.
+func (t *Torrent) Files() []storage.File {
+	return t.layout.Files
+}
+
+// FilePriorities returns the priority of each file.
+func (t *Torrent) FilePriorities() []Priority {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Priority(nil), t.priorities...)
+}
+
+// SetFilePriority changes the priority of one file. Selecting more files
+// once the torrent has finished resumes the download; Wait still returns at
+// the first completion.
+func (t *Torrent) SetFilePriority(file int, p Priority) error {
+	t.mu.Lock()
+	if file < 0 || file >= len(t.priorities) {
+		t.mu.Unlock()
+		return fmt.Errorf("file %d out of range", file)
+	}
+	priorities := append([]Priority(nil), t.priorities...)
+	priorities[file] = p
+	reopened, err := t.setPrioritiesLocked(priorities)
+	t.mu.Unlock()
+
+	if reopened {
+		t.downloader.BroadcastInterested()
+	}
+	return err
+}
+
+// SetFilePriorities sets the priority of every file at once.
+func (t *Torrent) SetFilePriorities(priorities []Priority) error {
+	if len(priorities) != len(t.layout.Files) {
+		return fmt.Errorf("got %d priorities for %d files", len(priorities), len(t.layout.Files))
+	}
+
+	t.mu.Lock()
+	reopened, err := t.setPrioritiesLocked(append([]Priority(nil), priorities...))
+	t.mu.Unlock()
+
+	if reopened {
+		t.downloader.BroadcastInterested()
+	}
+	return err
+}
+
+// setPrioritiesLocked applies file priorities to the piece picker and the
+// storage. A piece takes the highest priority of the files it overlaps, so
+// pieces shared with a wanted file are still fetched. It reports whether
+// the download was reopened, so the caller can tell peers we are interested
+// after releasing t.mu. t.mu must be held.
+func (t *Torrent) setPrioritiesLocked(priorities []Priority) (bool, error) {
+	for _, p := range priorities {
+		if p < PrioritySkip || p > PriorityHigh {
+			return false, fmt.Errorf("invalid priority %d", int(p))
+		}
+	}
+
+	pieces := make([]int, t.swarm.NumPieces)
+	for i, f := range t.layout.Files {
+		first, end := t.layout.PieceRange(f.Offset, f.Length)
+		for piece := first; piece < end; piece++ {
+			pieces[piece] = max(pieces[piece], int(priorities[i]))
+		}
+	}
+
+	if selective, ok := t.store.(storage.Selective); ok {
+		for i, p := range priorities {
+			if err := selective.SetFileWanted(i, p != PrioritySkip); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	t.priorities = priorities
+	t.swarm.SetPiecePriorities(pieces)
+	if !t.downloader.Reopen() {
+		return false, nil
+	}
+	t.resumeLocked()
+	return true, nil
+}
+
+// resumeLocked goes back to downloading after the wanted set grew past what
+// has been verified. A paused torrent picks the new pieces up when it is
+// started. t.mu must be held.
+func (t *Torrent) resumeLocked() {
+	switch t.state {
+	case StateSeeding:
+		t.state = StateDownloading
+		fallthrough
+	case StateDownloading:
+		select {
+		case t.reopened <- struct{}{}:
+		default:
+		}
+	case StateCompleted:
+		// The finished run may still be winding down; start a new one
+		// once it has.
+		prev := t.runDone
+		go func() {
+			if prev != nil {
+				<-prev
+			}
+			t.Start()
+		}()
+	}
+}
@@ -0,0 +1,143 @@
+package client
+
+import (
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Jamescog/bttclient/internal/ratelimit"
+)
+
+// scheduleCheckInterval is how often rate schedules are re-evaluated.
+const scheduleCheckInterval = 30 * time.Second
+
+// RateSchedule replaces the global rate limits during a daily time window,
+// such as slower limits during working hours.
+type RateSchedule struct {
+	// Days the window starts on. Empty means every day.
+	Days []time.Weekday
+	// Start and End are offsets from local midnight. An End before Start
+	// runs past midnight into the next day.
+	Start, End time.Duration
+	// DownloadRateLimit and UploadRateLimit apply while the window is
+	// active, in bytes per second. 0 means unlimited.
+	DownloadRateLimit int
+	UploadRateLimit   int
+}
+
+// Active reports whether the window covers now.
+func (s RateSchedule) Active(now time.Time) bool {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	offset := now.Sub(midnight)
+	onDay := func(d time.Weekday) bool { return len(s.Days) == 0 || slices.Contains(s.Days, d) }
+
+	if s.Start <= s.End {
+		return onDay(now.Weekday()) && offset >= s.Start && offset < s.End
+	}
+	yesterday := (now.Weekday() + 6) % 7
+	return (onDay(now.Weekday()) && offset >= s.Start) || (onDay(yesterday) && offset < s.End)
+}
+
+// SetRateLimits changes the global limits in bytes per second, 0 for
+// unlimited. While a rate schedule is active its limits apply instead.
+func (c *Client) SetRateLimits(download, upload int) {
+	c.mu.Lock()
+	c.config.DownloadRateLimit = download
+	c.config.UploadRateLimit = upload
+	c.mu.Unlock()
+	c.applyRateLimits(time.Now())
+}
+
+// RateLimits returns the global limits currently in effect.
+func (c *Client) RateLimits() (download, upload int) {
+	return c.downloadLimit.Rate(), c.uploadLimit.Rate()
+}
+
+// SetRateSchedules replaces the rate schedules. The first active schedule
+// wins.
+func (c *Client) SetRateSchedules(schedules []RateSchedule) {
+	c.mu.Lock()
+	c.config.RateSchedules = slices.Clone(schedules)
+	c.mu.Unlock()
+	c.applyRateLimits(time.Now())
+}
+
+// SetPeerRateLimits changes the limits applied to each peer connection on
+// its own, including connections already open.
+func (c *Client) SetPeerRateLimits(download, upload int) {
+	c.peerDownloadLimits.SetRate(download)
+	c.peerUploadLimits.SetRate(upload)
+}
+
+// applyRateLimits sets the global limiters from the active schedule or the
+// configured limits.
+func (c *Client) applyRateLimits(now time.Time) {
+	c.mu.Lock()
+	download, upload := c.config.DownloadRateLimit, c.config.UploadRateLimit
+	for _, s := range c.config.RateSchedules {
+		if s.Active(now) {
+			download, upload = s.DownloadRateLimit, s.UploadRateLimit
+			break
+		}
+	}
+	c.mu.Unlock()
+
+	if c.downloadLimit.Rate() != download || c.uploadLimit.Rate() != upload {
+		c.downloadLimit.SetRate(download)
+		c.uploadLimit.SetRate(upload)
+	}
+}
+
+// scheduleLoop keeps the global limits in line with the rate schedules.
+func (c *Client) scheduleLoop() {
+	ticker := time.NewTicker(scheduleCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			c.applyRateLimits(now)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// SetRateLimits limits this torrent's peer traffic in bytes per second, 0
+// for unlimited, within the global limits.
+func (t *Torrent) SetRateLimits(download, upload int) {
+	t.downloadLimit.SetRate(download)
+	t.uploadLimit.SetRate(upload)
+}
+
+func (t *Torrent) RateLimits() (download, upload int) {
+	return t.downloadLimit.Rate(), t.uploadLimit.Rate()
+}
+
+// limitConn charges a peer connection to the global, torrent and per-peer
+// limits.
+func (t *Torrent) limitConn(conn net.Conn) net.Conn {
+	c := t.client
+	peerDown, peerUp := c.peerDownloadLimits.New(), c.peerUploadLimits.New()
+	return &limitedConn{
+		Conn: ratelimit.NewConn(conn,
+			[]*ratelimit.Limiter{c.downloadLimit, t.downloadLimit, peerDown},
+			[]*ratelimit.Limiter{c.uploadLimit, t.uploadLimit, peerUp}),
+		release: func() {
+			c.peerDownloadLimits.Release(peerDown)
+			c.peerUploadLimits.Release(peerUp)
+		},
+	}
+}
+
+// limitedConn releases its per-peer limiters when closed.
+type limitedConn struct {
+	*ratelimit.Conn
+	release func()
+	once    sync.Once
+}
+
+func (l *limitedConn) Close() error {
+	l.once.Do(l.release)
+	return l.Conn.Close()
+}
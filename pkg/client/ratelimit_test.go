@@ -0,0 +1,51 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateScheduleActive(t *testing.T) {
+	// 16 October 2026 is a Friday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, time.October, day, hour, minute, 0, 0, time.Local)
+	}
+	night := RateSchedule{Start: 22 * time.Hour, End: 7 * time.Hour}
+	fridayNight := RateSchedule{Days: []time.Weekday{time.Friday}, Start: 22 * time.Hour, End: 7 * time.Hour}
+	workHours := RateSchedule{
+		Days:  []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+		Start: 9 * time.Hour,
+		End:   17 * time.Hour,
+	}
+
+	tests := []struct {
+		name     string
+		schedule RateSchedule
+		now      time.Time
+		want     bool
+	}{
+		{"before the night", night, at(16, 21, 59), false},
+		{"night starts", night, at(16, 22, 0), true},
+		{"before midnight", night, at(16, 23, 30), true},
+		{"after midnight", night, at(17, 3, 0), true},
+		{"night ends", night, at(17, 7, 0), false},
+		{"midday", night, at(17, 12, 0), false},
+
+		{"friday night", fridayNight, at(16, 23, 0), true},
+		{"into saturday", fridayNight, at(17, 6, 59), true},
+		{"friday early morning belongs to thursday", fridayNight, at(16, 3, 0), false},
+		{"saturday night", fridayNight, at(17, 23, 0), false},
+		{"thursday night", fridayNight, at(15, 23, 0), false},
+
+		{"monday morning", workHours, at(12, 9, 0), true},
+		{"monday evening", workHours, at(12, 17, 0), false},
+		{"friday afternoon", workHours, at(16, 16, 59), true},
+		{"saturday", workHours, at(17, 12, 0), false},
+		{"sunday", workHours, at(18, 12, 0), false},
+	}
+	for _, tt := range tests {
+		if got := tt.schedule.Active(tt.now); got != tt.want {
+			t.Errorf("%s: Active(%s) = %v, want %v", tt.name, tt.now.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Jamescog/bttclient/pkg/storage"
+)
+
+// DefaultReadahead is how far ahead of its position a Reader asks for
+// pieces, in bytes. At least two pieces are always requested.
+const DefaultReadahead = 8 << 20
+
+var ErrFileSkipped = errors.New("file is skipped")
+
+var nextReaderID atomic.Int64
+
+// SetSequential turns streaming mode on or off. In streaming mode pieces
+// are fetched in order instead of at random, so the data fills in from the
+// start of the torrent.
+func (t *Torrent) SetSequential(sequential bool) {
+	t.swarm.SetSequential(sequential)
+}
+
+// Reader reads one file of a torrent while it downloads. Reads block until
+// the pieces they need are verified, and the pieces just ahead of the
+// position are fetched before anything else. A Reader is not safe for
+// concurrent use.
+type Reader struct {
+	t    *Torrent
+	ctx  context.Context
+	file storage.File
+	id   int
+
+	mu        sync.Mutex
+	pos       int64
+	readahead int64
+	closed    bool
+}
+
+// NewReader returns a Reader for a file of the torrent. Blocking reads give
+// up with ctx's error once ctx is done. The torrent must be started for the
+// reads to make progress.
+func (t *Torrent) NewReader(ctx context.Context, file int) (*Reader, error) {
+	if file < 0 || file >= len(t.layout.Files) {
+		return nil, fmt.Errorf("file %d out of range", file)
+	}
+	if t.FilePriorities()[file] == PrioritySkip {
+		return nil, ErrFileSkipped
+	}
+
+	r := &Reader{
+		t:         t,
+		ctx:       ctx,
+		file:      t.layout.Files[file],
+		id:        int(nextReaderID.Add(1)),
+		readahead: DefaultReadahead,
+	}
+	r.updateWindow()
+	return r, nil
+}
+
+// SetReadahead changes how many bytes ahead of the position are fetched
+// first.
+func (r *Reader) SetReadahead(n int64) {
+	r.mu.Lock()
+	r.readahead = n
+	r.mu.Unlock()
+	r.updateWindow()
+}
+
+// updateWindow tells the picker which pieces the reader needs next.
+func (r *Reader) updateWindow() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed || r.pos >= r.file.Length {
+		r.t.swarm.ClearPieceWindow(r.id)
+		return
+	}
+
+	g := r.t.layout.Geometry
+	start := r.file.Offset + r.pos
+	length := min(max(r.readahead, 2*g.PieceLength), r.file.Offset+r.file.Length-start)
+	first, end := g.PieceRange(start, length)
+	r.t.swarm.SetPieceWindow(r.id, first, end)
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	pos, closed := r.pos, r.closed
+	r.mu.Unlock()
+
+	if closed {
+		return 0, fmt.Errorf("read from closed reader")
+	}
+	if pos >= r.file.Length {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	g := r.t.layout.Geometry
+	offset := r.file.Offset + pos
+	piece := uint32(offset / g.PieceLength)
+	if err := r.waitPiece(piece); err != nil {
+		return 0, err
+	}
+
+	pieceOff := offset - g.PieceOffset(piece)
+	n := min(int64(len(p)), g.PieceSize(piece)-pieceOff, r.file.Length-pos)
+	// Stop closes the storage after closing stopped, so checking both
+	// before and after the read catches a read that raced with Stop and
+	// would otherwise return zeros.
+	if r.stopped() {
+		return 0, ErrTorrentStopped
+	}
+	read, err := r.t.disk.ReadAt(p[:n], piece, pieceOff)
+	if r.stopped() {
+		return 0, ErrTorrentStopped
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return read, err
+	}
+
+	r.mu.Lock()
+	r.pos += int64(read)
+	r.mu.Unlock()
+	r.updateWindow()
+	return read, nil
+}
+
+// stopped reports whether the torrent has been stopped.
+func (r *Reader) stopped() bool {
+	select {
+	case <-r.t.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitPiece blocks until piece is verified, the torrent stops or the
+// reader's context is done.
+func (r *Reader) waitPiece(piece uint32) error {
+	for {
+		changed := r.t.swarm.PiecesChanged()
+		if r.t.swarm.CompletedPieces().Has(piece) {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-r.t.stopped:
+			return ErrTorrentStopped
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		}
+	}
+}
+
+// Seek moves the position and refocuses the picker on the pieces there.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	r.mu.Lock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.file.Length
+	default:
+		r.mu.Unlock()
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		r.mu.Unlock()
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+	r.pos = offset
+	r.mu.Unlock()
+
+	r.updateWindow()
+	return offset, nil
+}
+
+// Close releases the reader's claim on upcoming pieces.
+func (r *Reader) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+
+	r.t.swarm.ClearPieceWindow(r.id)
+	return nil
+}
@@ -0,0 +1,193 @@
+package client
+
+import (
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Jamescog/bttclient/internal/resume"
+	"github.com/Jamescog/bttclient/pkg/protocol"
+	"github.com/Jamescog/bttclient/pkg/storage"
+)
+
+func (t *Torrent) resumePath() string {
+	return filepath.Join(t.client.config.ResumeDir, hex.EncodeToString(t.infoHash[:])+".resume")
+}
+
+// restore loads the torrent's resume file, if any. Pieces recorded as
+// verified are trusted when their data file is unchanged since the
+// checkpoint; every piece of a changed or new file is rehashed instead.
+func (t *Torrent) restore() error {
+	data, err := resume.Load(t.resumePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		log.Printf("[%s] ignoring resume data: %v", t.Name(), err)
+		return nil
+	}
+	if data.InfoHash != t.infoHash || data.NumPieces != t.swarm.NumPieces {
+		log.Printf("[%s] ignoring resume data for a different torrent", t.Name())
+		return nil
+	}
+
+	have, err := protocol.BitfieldFromBytes(data.Pieces, data.NumPieces)
+	if err != nil {
+		log.Printf("[%s] ignoring resume data: %v", t.Name(), err)
+		return nil
+	}
+
+	if len(data.Priorities) == len(t.layout.Files) {
+		priorities := make([]Priority, len(data.Priorities))
+		for i, p := range data.Priorities {
+			priorities[i] = Priority(p)
+		}
+		if err := t.SetFilePriorities(priorities); err != nil {
+			log.Printf("[%s] ignoring saved file priorities: %v", t.Name(), err)
+		}
+	}
+
+	saved := make(map[string]resume.FileState, len(data.Files))
+	for _, f := range data.Files {
+		saved[f.Path] = f
+	}
+
+	// Data outside local files cannot be checked for changes, and a file
+	// that disappeared since the checkpoint may have held any piece, so
+	// both cases rehash everything.
+	files := t.localFiles()
+	changed := len(files) == 0
+	rehash := protocol.NewBitfield(data.NumPieces)
+	for _, f := range files {
+		state, ok := saved[f.Path]
+		delete(saved, f.Path)
+		if ok && !state.Changed() {
+			continue
+		}
+		first, end := t.layout.PieceRange(f.Offset, f.Length)
+		for p := first; p < end; p++ {
+			rehash.Set(p)
+		}
+	}
+	if changed || len(saved) > 0 {
+		rehash.SetAll()
+	}
+
+	trusted, rechecked := 0, 0
+	for piece := range have.AndNot(rehash).All() {
+		t.downloader.MarkPieceComplete(piece)
+		trusted++
+	}
+	for piece := range rehash.All() {
+		ok, err := t.downloader.RecheckPiece(piece)
+		if err != nil {
+			log.Printf("[%s] recheck: %v", t.Name(), err)
+			continue
+		}
+		if ok {
+			rechecked++
+		}
+	}
+
+	t.swarm.AddUploadedBytes(data.Uploaded)
+	t.resumed = data.Peers
+
+	log.Printf("[%s] resumed: %d pieces from checkpoint, %d of %d rehashed pieces valid",
+		t.Name(), trusted, rechecked, rehash.Count())
+	return nil
+}
+
+// localFiles returns the local files holding the torrent's data, if the
+// storage keeps any.
+func (t *Torrent) localFiles() []storage.LocalFile {
+	if local, ok := t.store.(storage.Local); ok {
+		return local.Files()
+	}
+	return nil
+}
+
+// checkpoint saves the verified pieces, file layout, peers and upload
+// counter. The downloaded counter is rebuilt from the verified pieces on
+// restore, so it is not saved.
+func (t *Torrent) checkpoint() {
+	if err := t.downloader.Sync(); err != nil {
+		log.Printf("[%s] sync before checkpoint: %v", t.Name(), err)
+		return
+	}
+
+	var files []resume.FileState
+	for _, lf := range t.localFiles() {
+		f, err := resume.Stat(lf.Path)
+		if err != nil {
+			log.Printf("[%s] checkpoint: %v", t.Name(), err)
+			return
+		}
+		files = append(files, f)
+	}
+
+	var priorities []int
+	for _, p := range t.FilePriorities() {
+		priorities = append(priorities, int(p))
+	}
+
+	st := t.swarm.Stats()
+	data := &resume.Data{
+		InfoHash:   t.infoHash,
+		NumPieces:  t.swarm.NumPieces,
+		Pieces:     t.swarm.CompletedPieces().Bytes(),
+		Files:      files,
+		Priorities: priorities,
+		Peers:      t.knownPeers(),
+		Uploaded:   st.UploadedBytes,
+		SavedAt:    time.Now(),
+	}
+	if err := resume.Save(t.resumePath(), data); err != nil {
+		log.Printf("[%s] checkpoint: %v", t.Name(), err)
+	}
+}
+
+// savedPeers returns the peers restored from resume data, once.
+func (t *Torrent) savedPeers() []net.TCPAddr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	peers := t.resumed
+	t.resumed = nil
+	return peers
+}
+
+// maxRecentPeers bounds how many peer addresses are kept for resume data.
+const maxRecentPeers = 200
+
+// rememberPeer records a peer we completed a handshake with.
+func (t *Torrent) rememberPeer(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.recentPeers) >= maxRecentPeers {
+		for old := range t.recentPeers {
+			delete(t.recentPeers, old)
+			break
+		}
+	}
+	t.recentPeers[key] = true
+}
+
+// knownPeers returns the addresses of peers we recently talked to.
+func (t *Torrent) knownPeers() []net.TCPAddr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var peers []net.TCPAddr
+	for key := range t.recentPeers {
+		addr, err := net.ResolveTCPAddr("tcp", key)
+		if err == nil {
+			peers = append(peers, *addr)
+		}
+	}
+	return peers
+}
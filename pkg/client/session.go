@@ -0,0 +1,312 @@
+package client
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// SessionConfig limits how many torrents of a Session run at once.
+type SessionConfig struct {
+	// MaxActiveDownloads and MaxActiveSeeds cap the torrents downloading and
+	// seeding at the same time. 0 means no limit.
+	MaxActiveDownloads int
+	MaxActiveSeeds     int
+	// StallTimeout is how long a download may go without progress before it
+	// yields its slot to the next queued torrent. 0 disables stall handling.
+	StallTimeout time.Duration
+	// CheckInterval is how often the queue is re-evaluated.
+	CheckInterval time.Duration
+}
+
+func DefaultSessionConfig() SessionConfig {
+	return SessionConfig{
+		MaxActiveDownloads: 3,
+		MaxActiveSeeds:     5,
+		StallTimeout:       5 * time.Minute,
+		CheckInterval:      10 * time.Second,
+	}
+}
+
+// Session runs a batch of torrents on a Client. Torrents are ordered by
+// priority (higher first, then by the order they were queued); the first
+// MaxActiveDownloads incomplete torrents download and the first
+// MaxActiveSeeds complete torrents seed. Finished and stalled downloads make
+// room for the next queued torrent. A Session owns the lifecycle of the
+// torrents added to it, so they should not be started or paused directly.
+// Connection and bandwidth budgets are the Client's and are shared by every
+// torrent.
+type Session struct {
+	client *Client
+	config SessionConfig
+
+	mu      sync.Mutex
+	entries map[*Torrent]*sessionEntry
+	nextSeq uint64
+	changed *sync.Cond
+
+	kick chan struct{}
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+type sessionEntry struct {
+	torrent  *Torrent
+	priority int
+	seq      uint64
+
+	lastBytes    int64
+	lastProgress time.Time
+}
+
+// NewSession starts a session on c. Close stops its scheduler.
+func NewSession(c *Client, config SessionConfig) *Session {
+	if config.CheckInterval <= 0 {
+		config.CheckInterval = DefaultSessionConfig().CheckInterval
+	}
+
+	s := &Session{
+		client:  c,
+		config:  config,
+		entries: make(map[*Torrent]*sessionEntry),
+		kick:    make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+	}
+	s.changed = sync.NewCond(&s.mu)
+
+	s.wg.Add(1)
+	go s.loop()
+	return s
+}
+
+// AddTorrentFile adds a .torrent file to the client and queues it.
+func (s *Session) AddTorrentFile(path string, priority int) (*Torrent, error) {
+	t, err := s.client.AddTorrentFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s.Add(t, priority)
+	return t, nil
+}
+
+// Add queues a torrent that was already added to the session's client.
+func (s *Session) Add(t *Torrent, priority int) {
+	s.mu.Lock()
+	if _, exists := s.entries[t]; !exists {
+		s.entries[t] = &sessionEntry{torrent: t, priority: priority, seq: s.nextSeq}
+		s.nextSeq++
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			select {
+			case <-t.done:
+				s.trigger()
+			case <-s.quit:
+			}
+		}()
+	}
+	s.mu.Unlock()
+
+	s.trigger()
+}
+
+// SetPriority changes a torrent's place in the queue.
+func (s *Session) SetPriority(t *Torrent, priority int) {
+	s.mu.Lock()
+	if e, ok := s.entries[t]; ok {
+		e.priority = priority
+	}
+	s.mu.Unlock()
+
+	s.trigger()
+}
+
+// Remove takes a torrent out of the session and stops it.
+func (s *Session) Remove(t *Torrent) error {
+	s.mu.Lock()
+	delete(s.entries, t)
+	s.changed.Broadcast()
+	s.mu.Unlock()
+
+	s.trigger()
+	return s.client.Remove(t)
+}
+
+// Torrents returns the session's torrents in queue order.
+func (s *Session) Torrents() []*Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := s.sortedLocked()
+	torrents := make([]*Torrent, len(entries))
+	for i, e := range entries {
+		torrents[i] = e.torrent
+	}
+	return torrents
+}
+
+// Wait blocks until every torrent in the session has completed or stopped.
+func (s *Session) Wait() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for !s.allDoneLocked() {
+		s.changed.Wait()
+	}
+}
+
+// Close stops the scheduler. The torrents keep their current state.
+func (s *Session) Close() {
+	select {
+	case <-s.quit:
+	default:
+		close(s.quit)
+	}
+	s.wg.Wait()
+
+	s.mu.Lock()
+	s.changed.Broadcast()
+	s.mu.Unlock()
+}
+
+func (s *Session) trigger() {
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Session) loop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.config.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		s.schedule(time.Now())
+
+		select {
+		case <-s.quit:
+			return
+		case <-s.kick:
+		case <-ticker.C:
+		}
+	}
+}
+
+// schedule starts and pauses torrents so the highest priority ones hold the
+// active slots.
+func (s *Session) schedule(now time.Time) {
+	s.mu.Lock()
+	stalled := s.requeueStalledLocked(now)
+
+	var downloads, seeds []*Torrent
+	for _, e := range s.sortedLocked() {
+		switch e.torrent.State() {
+		case StateStopped, StateCompleted:
+			continue
+		}
+		if e.torrent.Complete() {
+			seeds = append(seeds, e.torrent)
+		} else {
+			downloads = append(downloads, e.torrent)
+		}
+	}
+	s.changed.Broadcast()
+	s.mu.Unlock()
+
+	// Pause first so slots are free before anything new starts.
+	for _, t := range stalled {
+		t.Pause()
+	}
+	applyLimit(downloads, s.config.MaxActiveDownloads, true)
+	applyLimit(seeds, s.config.MaxActiveSeeds, true)
+	applyLimit(downloads, s.config.MaxActiveDownloads, false)
+	applyLimit(seeds, s.config.MaxActiveSeeds, false)
+}
+
+// applyLimit pauses the torrents past limit (pause true) or starts the ones
+// within it (pause false). torrents must be in queue order.
+func applyLimit(torrents []*Torrent, limit int, pause bool) {
+	for i, t := range torrents {
+		within := limit <= 0 || i < limit
+		if pause && !within {
+			t.Pause()
+		}
+		if !pause && within {
+			t.Start()
+		}
+	}
+}
+
+// requeueStalledLocked moves downloads that made no progress for
+// StallTimeout to the back of their priority band, but only when another
+// download is waiting for a slot, and returns them for the caller to pause
+// once s.mu is released. s.mu must be held.
+func (s *Session) requeueStalledLocked(now time.Time) []*Torrent {
+	waiting := false
+	for _, e := range s.entries {
+		if e.torrent.State() == StatePaused && !e.torrent.Complete() {
+			waiting = true
+			break
+		}
+	}
+
+	var stalled []*Torrent
+	for _, e := range s.entries {
+		t := e.torrent
+		if t.State() != StateDownloading {
+			e.lastProgress = time.Time{}
+			continue
+		}
+
+		bytes := t.Stats().DownloadedBytes
+		if e.lastProgress.IsZero() || bytes != e.lastBytes {
+			e.lastBytes = bytes
+			e.lastProgress = now
+			continue
+		}
+
+		if waiting && s.config.StallTimeout > 0 && now.Sub(e.lastProgress) >= s.config.StallTimeout {
+			e.seq = s.nextSeq
+			s.nextSeq++
+			e.lastProgress = time.Time{}
+			stalled = append(stalled, t)
+		}
+	}
+	return stalled
+}
+
+// sortedLocked returns the entries by priority, then queue order. s.mu must
+// be held.
+func (s *Session) sortedLocked() []*sessionEntry {
+	entries := make([]*sessionEntry, 0, len(s.entries))
+	for _, e := range s.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].priority != entries[j].priority {
+			return entries[i].priority > entries[j].priority
+		}
+		return entries[i].seq < entries[j].seq
+	})
+	return entries
+}
+
+func (s *Session) allDoneLocked() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+	}
+
+	for _, e := range s.entries {
+		select {
+		case <-e.torrent.done:
+		default:
+			return false
+		}
+	}
+	return true
+}
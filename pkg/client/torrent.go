@@ -0,0 +1,503 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Jamescog/bttclient/internal/data"
+	"github.com/Jamescog/bttclient/internal/peerman"
+	"github.com/Jamescog/bttclient/internal/ratelimit"
+	"github.com/Jamescog/bttclient/pkg/bencode"
+	"github.com/Jamescog/bttclient/pkg/protocol"
+	"github.com/Jamescog/bttclient/pkg/storage"
+)
+
+type State int
+
+const (
+	StatePaused State = iota
+	StateDownloading
+	StateSeeding
+	StateCompleted
+	StateStopped
+)
+
+func (s State) String() string {
+	switch s {
+	case StatePaused:
+		return "paused"
+	case StateDownloading:
+		return "downloading"
+	case StateSeeding:
+		return "seeding"
+	case StateCompleted:
+		return "completed"
+	case StateStopped:
+		return "stopped"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// Stats is a snapshot of a torrent's progress.
+type Stats struct {
+	State            State
+	Peers            int
+	ActivePeers      int
+	SnubbedPeers     int
+	BannedPeers      int
+	TotalPieces      int
+	CompletedPieces  int
+	WantedPieces     int
+	InProgressPieces int
+	DownloadedBytes  int64
+	UploadedBytes    int64
+	TotalBytes       int64
+	PiecesVerified   int64
+	PiecesFailed     int64
+	TimedOutRequests int64
+}
+
+// Torrent is a handle to one torrent added to a Client.
+type Torrent struct {
+	client     *Client
+	meta       *bencode.Torrent
+	infoHash   [20]byte
+	layout     *storage.Info
+	store      storage.TorrentStorage
+	disk       storage.TorrentStorage // store, timed for metrics
+	swarm      *data.Swarm
+	downloader *peerman.Downloader
+
+	mu        sync.Mutex
+	state     State
+	runCtx    context.Context
+	cancelRun context.CancelFunc
+	runDone   chan struct{}
+	peerWG    sync.WaitGroup
+	connected map[string]bool
+	peerSlots chan struct{}
+	resumed   []net.TCPAddr // peers from resume data, tried before the tracker answers
+
+	priorities []Priority    // per file
+	reopened   chan struct{} // signals run that more files were selected
+
+	downloadLimit *ratelimit.Limiter
+	uploadLimit   *ratelimit.Limiter
+
+	recentPeers map[string]bool
+
+	stopped chan struct{} // closed by Stop
+	done    chan struct{}
+	err     error
+}
+
+func newTorrent(c *Client, meta *bencode.Torrent, infoHash [20]byte) (*Torrent, error) {
+	var files []storage.File
+	for _, f := range meta.Files() {
+		files = append(files, storage.File{Path: f.Path, Length: f.Length})
+	}
+	layout, err := storage.NewInfo(infoHash, meta.Name(), int64(meta.PieceLength()), files)
+	if err != nil {
+		return nil, err
+	}
+
+	if layout.NumPieces() != meta.NumPieces() {
+		return nil, fmt.Errorf("torrent has %d piece hashes but its %d bytes make %d pieces",
+			meta.NumPieces(), layout.Length, layout.NumPieces())
+	}
+
+	store, err := c.config.Storage.OpenTorrent(layout)
+	if err != nil {
+		return nil, fmt.Errorf("open storage: %w", err)
+	}
+	log.Printf("Initialized download: %s (%.2f MB)", meta.Name(), float64(layout.Length)/(1024*1024))
+
+	swarm := data.NewSwarm(layout.Geometry)
+	disk := c.metrics.timeStorage(store)
+	downloader := peerman.NewDownloader(swarm, disk, meta.Pieces())
+
+	t := &Torrent{
+		client:      c,
+		meta:        meta,
+		infoHash:    infoHash,
+		layout:      layout,
+		store:       store,
+		disk:        disk,
+		swarm:       swarm,
+		downloader:  downloader,
+		state:       StatePaused,
+		connected:   make(map[string]bool),
+		recentPeers: make(map[string]bool),
+		peerSlots:   make(chan struct{}, max(1, c.config.MaxPeersPerTorrent)),
+		reopened:    make(chan struct{}, 1),
+		stopped:     make(chan struct{}),
+		done:        make(chan struct{}),
+
+		downloadLimit: ratelimit.NewLimiter(0),
+		uploadLimit:   ratelimit.NewLimiter(0),
+	}
+	downloader.SetHolepunchHandler(t.holepunch)
+	t.priorities = make([]Priority, len(layout.Files))
+	for i := range t.priorities {
+		t.priorities[i] = PriorityNormal
+	}
+
+	if err := t.restore(); err != nil {
+		downloader.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *Torrent) Name() string       { return t.meta.Name() }
+func (t *Torrent) InfoHash() [20]byte { return t.infoHash }
+
+// Metainfo returns the decoded .torrent file.
+func (t *Torrent) Metainfo() *bencode.Torrent { return t.meta }
+
+// OutputPath returns the absolute path of the downloaded data, or "" when
+// the storage does not keep it in local files.
+func (t *Torrent) OutputPath() string {
+	local, ok := t.store.(storage.Local)
+	if !ok {
+		return ""
+	}
+	path, _ := filepath.Abs(local.Path())
+	return path
+}
+
+func (t *Torrent) State() State {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state
+}
+
+func (t *Torrent) Stats() Stats {
+	st := t.swarm.Stats()
+	return Stats{
+		State:            t.State(),
+		Peers:            st.Peers,
+		ActivePeers:      st.ActivePeers,
+		SnubbedPeers:     st.SnubbedPeers,
+		BannedPeers:      st.BannedPeers,
+		TotalPieces:      st.TotalPieces,
+		CompletedPieces:  st.CompletedPieces,
+		WantedPieces:     st.WantedPieces,
+		InProgressPieces: st.InProgressPieces,
+		DownloadedBytes:  st.DownloadedBytes,
+		UploadedBytes:    st.UploadedBytes,
+		TotalBytes:       st.TotalBytes,
+		PiecesVerified:   st.PiecesVerified,
+		PiecesFailed:     st.PiecesFailed,
+		TimedOutRequests: st.TimedOutRequests,
+	}
+}
+
+// BannedPeers returns the addresses banned for sending data that failed its
+// hash check. Web seeds appear as "webseed:" or "httpseed:" and their URL.
+func (t *Torrent) BannedPeers() []string {
+	return t.swarm.BannedPeers()
+}
+
+// Complete reports whether every wanted piece has been verified.
+func (t *Torrent) Complete() bool {
+	return t.swarm.IsComplete()
+}
+
+// Start begins or resumes downloading. A complete torrent is started as a
+// seed when the client is configured to seed, and is otherwise left alone.
+func (t *Torrent) Start() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch t.state {
+	case StateStopped:
+		return ErrTorrentStopped
+	case StateDownloading, StateSeeding:
+		return nil
+	}
+
+	if t.Complete() {
+		if !t.client.config.Seed {
+			t.state = StateCompleted
+			t.finishLocked(nil)
+			return nil
+		}
+		t.state = StateSeeding
+	} else {
+		t.state = StateDownloading
+	}
+
+	t.runCtx, t.cancelRun = context.WithCancel(context.Background())
+	t.runDone = make(chan struct{})
+	go t.run(t.runCtx, t.runDone)
+	return nil
+}
+
+// Pause disconnects all peers but keeps the download state so Start can
+// continue where it left off.
+func (t *Torrent) Pause() {
+	t.mu.Lock()
+	if t.state != StateDownloading && t.state != StateSeeding {
+		t.mu.Unlock()
+		return
+	}
+	t.state = StatePaused
+	runDone := t.halt()
+	t.mu.Unlock()
+
+	<-runDone
+}
+
+// Stop ends the torrent for good and closes its files. Wait returns
+// ErrTorrentStopped unless the download had already completed.
+func (t *Torrent) Stop() error {
+	t.mu.Lock()
+	if t.state == StateStopped {
+		t.mu.Unlock()
+		return nil
+	}
+	completed := t.Complete()
+	t.state = StateStopped
+	close(t.stopped)
+	runDone := t.halt()
+	t.mu.Unlock()
+
+	<-runDone
+
+	err := t.downloader.Close()
+	if !completed {
+		t.finish(ErrTorrentStopped)
+	}
+	return err
+}
+
+// Wait blocks until the download completes or the torrent is stopped.
+func (t *Torrent) Wait() error {
+	<-t.done
+	return t.err
+}
+
+// halt cancels the current run and returns a channel closed once it has
+// exited. t.mu must be held.
+func (t *Torrent) halt() <-chan struct{} {
+	if t.cancelRun == nil {
+		closed := make(chan struct{})
+		close(closed)
+		return closed
+	}
+	t.cancelRun()
+	t.cancelRun = nil
+	t.runCtx = nil
+	return t.runDone
+}
+
+func (t *Torrent) finish(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.finishLocked(err)
+}
+
+// finishLocked releases Wait with err. t.mu must be held.
+func (t *Torrent) finishLocked(err error) {
+	select {
+	case <-t.done:
+	default:
+		t.err = err
+		close(t.done)
+	}
+}
+
+// run announces, connects to the returned peers and re-announces
+// periodically until ctx is cancelled, downloading from web seeds and
+// checkpointing resume data along the way. When the download completes the
+// torrent either keeps running as a seed or halts; a seed goes back to
+// downloading when more files are selected.
+func (t *Torrent) run(ctx context.Context, runDone chan struct{}) {
+	defer close(runDone)
+	defer t.checkpoint()
+	defer t.peerWG.Wait()
+
+	for _, addr := range t.client.filterPeers(t.savedPeers(), &t.client.filterCounts.resume) {
+		t.connectPeer(ctx, addr)
+	}
+	if !t.Complete() {
+		t.startWebSeeds(ctx)
+	}
+
+	checkpoint := time.NewTicker(t.client.config.CheckpointInterval)
+	defer checkpoint.Stop()
+
+	completed := t.downloader.Done()
+	for {
+		peers, err := t.announce(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("[%s] announce failed: %v", t.Name(), err)
+		}
+		for _, addr := range t.client.filterPeers(peers, &t.client.filterCounts.tracker) {
+			t.connectPeer(ctx, addr)
+		}
+
+		reannounce := time.NewTimer(t.client.config.ReannounceInterval)
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				reannounce.Stop()
+				return
+			case <-checkpoint.C:
+				t.checkpoint()
+			case <-t.reopened:
+				completed = t.downloader.Done()
+				t.startWebSeeds(ctx)
+				log.Printf("[%s] more files selected, downloading", t.Name())
+				// Announce again so trackers see we are leeching.
+				reannounce.Stop()
+				break wait
+			case <-completed:
+				if next := t.downloader.Done(); next != completed {
+					// Reopened before we got here.
+					completed = next
+					continue
+				}
+				completed = nil
+				t.checkpoint()
+				t.finish(nil)
+
+				t.mu.Lock()
+				seed := t.client.config.Seed
+				if t.state == StateDownloading {
+					if seed {
+						t.state = StateSeeding
+					} else {
+						t.state = StateCompleted
+						t.halt()
+					}
+				}
+				t.mu.Unlock()
+				if !seed {
+					reannounce.Stop()
+					return
+				}
+				log.Printf("[%s] download complete, seeding", t.Name())
+			case <-reannounce.C:
+				break wait
+			}
+		}
+	}
+}
+
+// connectPeer dials addr unless we already talk to it.
+func (t *Torrent) connectPeer(ctx context.Context, addr net.TCPAddr) {
+	key := addr.String()
+
+	if t.swarm.IsBanned(addr.IP.String()) {
+		return
+	}
+
+	t.mu.Lock()
+	if t.connected[key] || ctx.Err() != nil {
+		t.mu.Unlock()
+		return
+	}
+	t.connected[key] = true
+	t.peerWG.Add(1)
+	t.mu.Unlock()
+
+	go func() {
+		var unreachable bool
+		defer func() {
+			// After forgetPeer, so the relayed connection is not taken
+			// for this one.
+			if unreachable {
+				if n := t.Holepunch(addr.AddrPort()); n > 0 {
+					log.Printf("[%s] asked %d peers to relay a connection to %s", t.Name(), n, key)
+				}
+			}
+		}()
+		defer t.peerWG.Done()
+		defer t.forgetPeer(key)
+
+		select {
+		case t.peerSlots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		defer func() { <-t.peerSlots }()
+
+		if !t.client.acquireConn(ctx) {
+			return
+		}
+		defer t.client.releaseConn()
+
+		p := peerman.Peer{IP: addr.IP.String(), Port: addr.Port}
+		dialCtx, cancel := context.WithTimeout(ctx, 12*time.Second)
+		conn, err := t.client.dialPeer(dialCtx, p, t.infoHash)
+		cancel()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Failed to handshake with %s:%d: %v", p.IP, p.Port, err)
+				unreachable = true
+			}
+			return
+		}
+		t.rememberPeer(key)
+		t.downloader.HandlePeer(ctx, p, t.limitConn(conn))
+	}()
+}
+
+// peerFromAddr returns the peer behind a TCP or uTP connection.
+func peerFromAddr(addr net.Addr) (peerman.Peer, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return peerman.Peer{IP: a.IP.String(), Port: a.Port}, true
+	case *net.UDPAddr:
+		return peerman.Peer{IP: a.IP.String(), Port: a.Port}, true
+	}
+	return peerman.Peer{}, false
+}
+
+// addInboundPeer completes the handshake of an incoming connection and runs
+// it alongside the outgoing peers.
+func (t *Torrent) addInboundPeer(conn net.Conn, hs protocol.Handshake) {
+	peer, ok := peerFromAddr(conn.RemoteAddr())
+	if !ok || t.swarm.IsBanned(peer.IP) {
+		conn.Close()
+		return
+	}
+	key := conn.RemoteAddr().String()
+
+	t.mu.Lock()
+	ctx := t.runCtx
+	if ctx == nil || ctx.Err() != nil || t.connected[key] || !t.client.tryAcquireConn() {
+		t.mu.Unlock()
+		conn.Close()
+		return
+	}
+	t.connected[key] = true
+	t.peerWG.Add(1)
+	t.mu.Unlock()
+
+	go func() {
+		defer t.peerWG.Done()
+		defer t.forgetPeer(key)
+		defer t.client.releaseConn()
+
+		if err := peerman.AcceptHandshake(conn, hs, t.client.peerID, t.client.listenPort()); err != nil {
+			conn.Close()
+			return
+		}
+		t.downloader.HandlePeer(ctx, peer, t.limitConn(conn))
+	}()
+}
+
+func (t *Torrent) forgetPeer(key string) {
+	t.mu.Lock()
+	delete(t.connected, key)
+	t.mu.Unlock()
+}
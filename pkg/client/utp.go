@@ -0,0 +1,79 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Jamescog/bttclient/internal/peerman"
+	"github.com/Jamescog/bttclient/internal/proxy"
+	"github.com/Jamescog/bttclient/internal/utp"
+)
+
+// utpDialTimeout bounds a uTP connection attempt before falling back to TCP.
+const utpDialTimeout = 3 * time.Second
+
+// startUTP opens the UDP socket shared by uTP peers and UDP trackers, on the
+// same port as the TCP listener. Incoming uTP connections are accepted only
+// when incoming TCP is.
+func (c *Client) startUTP() error {
+	port := 0
+	if c.listener != nil {
+		port = int(c.listenPort())
+	}
+	pc, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return fmt.Errorf("listen udp: %w", err)
+	}
+	c.utp = utp.NewSocket(pc, c.listener != nil)
+	if c.listener != nil {
+		go c.acceptLoop(c.utp)
+	}
+	return nil
+}
+
+// dialTransport connects to a peer over uTP when enabled, falling back to
+// TCP for peers that do not answer. With a proxy only TCP through the proxy
+// is used.
+func (c *Client) dialTransport(ctx context.Context, addr string) (net.Conn, error) {
+	if c.utp != nil && c.proxy == nil {
+		utpCtx, cancel := context.WithTimeout(ctx, utpDialTimeout)
+		conn, err := c.utp.DialContext(utpCtx, addr)
+		cancel()
+		if err == nil || ctx.Err() != nil {
+			return conn, err
+		}
+	}
+	return c.dialTCP(ctx, addr)
+}
+
+// dialTCP connects to a peer over TCP, through the proxy if there is one.
+// Every peer dial ends up here or on uTP, so none bypasses the proxy.
+func (c *Client) dialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	if c.proxy != nil {
+		return c.proxy.DialContext(ctx, "tcp", addr)
+	}
+	return peerman.DialTCP(ctx, addr)
+}
+
+// dialTracker returns a datagram conn to a UDP tracker: relayed by a SOCKS5
+// proxy, or on the shared uTP socket when there is one.
+func (c *Client) dialTracker(ctx context.Context, addr string) (net.Conn, error) {
+	if c.proxy != nil {
+		conn, err := c.proxy.DialUDP(ctx, addr)
+		if !errors.Is(err, proxy.ErrNoUDP) || c.config.ProxyOnly {
+			return conn, err
+		}
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("resolve: %w", err)
+	}
+	if c.utp != nil {
+		return c.utp.DialPacket(udpAddr), nil
+	}
+	return net.DialUDP("udp", nil, udpAddr)
+}
@@ -0,0 +1,136 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"github.com/Jamescog/bttclient/internal/peerman"
+	"github.com/Jamescog/bttclient/pkg/protocol"
+)
+
+// ErrTorrentRunning is returned by Verify while the torrent is active.
+var ErrTorrentRunning = errors.New("torrent is running")
+
+// VerifyReport lists the result of hashing a torrent's data on disk.
+type VerifyReport struct {
+	Valid   []uint32
+	Missing []uint32
+	Corrupt []uint32
+	Files   []FileReport
+}
+
+// FileReport counts the pieces overlapping one file of the torrent by
+// status. Path is relative to the download directory.
+type FileReport struct {
+	Path    string
+	Pieces  int
+	Valid   int
+	Missing int
+	Corrupt int
+}
+
+// Complete reports whether every piece was valid.
+func (r *VerifyReport) Complete() bool {
+	return len(r.Missing) == 0 && len(r.Corrupt) == 0
+}
+
+// Verify hashes every piece on disk using up to workers goroutines (0 means
+// one per CPU) and brings the download state in line with the result, so a
+// later Start only fetches the missing and corrupt pieces. The torrent must
+// not be running.
+func (t *Torrent) Verify(ctx context.Context, workers int) (*VerifyReport, error) {
+	switch t.State() {
+	case StateDownloading, StateSeeding:
+		return nil, ErrTorrentRunning
+	case StateStopped:
+		return nil, ErrTorrentStopped
+	}
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	numPieces := t.swarm.NumPieces
+	statuses := make([]peerman.PieceStatus, numPieces)
+	pieces := make(chan uint32)
+
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	for range min(workers, numPieces) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for piece := range pieces {
+				status, err := t.downloader.CheckPiece(piece)
+				if err != nil {
+					errOnce.Do(func() { firstErr = err })
+				}
+				statuses[piece] = status
+			}
+		}()
+	}
+
+feed:
+	for piece := range uint32(numPieces) {
+		select {
+		case pieces <- piece:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(pieces)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if firstErr != nil {
+		return nil, fmt.Errorf("verify: %w", firstErr)
+	}
+
+	report := &VerifyReport{}
+	valid := protocol.NewBitfield(numPieces)
+	for piece, status := range statuses {
+		switch status {
+		case peerman.PieceValid:
+			report.Valid = append(report.Valid, uint32(piece))
+			valid.Set(uint32(piece))
+		case peerman.PieceMissing:
+			report.Missing = append(report.Missing, uint32(piece))
+		case peerman.PieceCorrupt:
+			report.Corrupt = append(report.Corrupt, uint32(piece))
+		}
+	}
+
+	for _, f := range t.layout.Files {
+		file := FileReport{Path: filepath.Join(f.Path...)}
+		first, end := t.layout.PieceRange(f.Offset, f.Length)
+		for piece := first; piece < end; piece++ {
+			file.Pieces++
+			switch statuses[piece] {
+			case peerman.PieceValid:
+				file.Valid++
+			case peerman.PieceMissing:
+				file.Missing++
+			case peerman.PieceCorrupt:
+				file.Corrupt++
+			}
+		}
+		report.Files = append(report.Files, file)
+	}
+
+	completed := t.swarm.CompletedPieces()
+	for piece := range valid.AndNot(completed).All() {
+		t.downloader.MarkPieceComplete(piece)
+	}
+	for piece := range completed.AndNot(valid).All() {
+		t.downloader.MarkPieceUnverified(piece)
+	}
+	t.checkpoint()
+
+	return report, nil
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Jamescog/bttclient/internal/peerman"
+	"github.com/Jamescog/bttclient/internal/proxy"
+)
+
+// webSeedClient returns the HTTP client used for web seeds. Its connections
+// share the client's bandwidth budget with peer connections and go through
+// the configured proxy.
+func (c *Client) webSeedClient() *http.Client {
+	c.httpOnce.Do(func() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		dialer := &net.Dialer{Timeout: 30 * time.Second}
+		dial := dialer.DialContext
+		switch {
+		case c.proxy != nil && c.proxy.Type == proxy.HTTP:
+			transport.Proxy = http.ProxyURL(c.proxy.URL())
+		case c.proxy != nil:
+			transport.Proxy = nil
+			dial = c.proxy.DialContext
+		}
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return c.limitConn(conn), nil
+		}
+		transport.ResponseHeaderTimeout = 30 * time.Second
+		c.httpClient = &http.Client{Transport: transport}
+	})
+	return c.httpClient
+}
+
+// startWebSeeds downloads from the torrent's url-list web seeds and
+// httpseeds alongside its peers until ctx is done.
+func (t *Torrent) startWebSeeds(ctx context.Context) {
+	for _, url := range t.meta.URLList() {
+		ws := &peerman.WebSeed{
+			URL:    url,
+			Files:  t.layout.Files,
+			Client: t.client.webSeedClient(),
+		}
+		t.peerWG.Add(1)
+		go func() {
+			defer t.peerWG.Done()
+			t.downloader.RunWebSeed(ctx, ws)
+		}()
+	}
+
+	for _, url := range t.meta.HTTPSeeds() {
+		hs := &peerman.HTTPSeed{
+			URL:      url,
+			InfoHash: t.infoHash,
+			Client:   t.client.webSeedClient(),
+		}
+		t.peerWG.Add(1)
+		go func() {
+			defer t.peerWG.Done()
+			t.downloader.RunHTTPSeed(ctx, hs)
+		}()
+	}
+}
@@ -0,0 +1,253 @@
+// Package ipfilter matches addresses against blocklists in the eMule DAT,
+// PeerGuardian P2P and CIDR formats.
+package ipfilter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// datAllowLevel is the eMule access level from which a range is allowed
+// rather than blocked.
+const datAllowLevel = 128
+
+// Range is an inclusive span of addresses of one family.
+type Range struct {
+	First, Last netip.Addr
+}
+
+// Filter is a set of blocked ranges, merged and sorted for binary search.
+// It is immutable and safe for concurrent use.
+type Filter struct {
+	ranges []Range
+}
+
+// New builds a filter from ranges, which may overlap.
+func New(ranges []Range) *Filter {
+	sorted := slices.Clone(ranges)
+	slices.SortFunc(sorted, func(a, b Range) int { return a.First.Compare(b.First) })
+
+	var merged []Range
+	for _, r := range sorted {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			next := last.Last.Next()
+			if last.Last.Is4() == r.First.Is4() && (!next.IsValid() || r.First.Compare(next) <= 0) {
+				if r.Last.Compare(last.Last) > 0 {
+					last.Last = r.Last
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return &Filter{ranges: merged}
+}
+
+// Load reads and combines blocklist files.
+func Load(paths ...string) (*Filter, error) {
+	var ranges []Range
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		rs, err := parse(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		ranges = append(ranges, rs...)
+	}
+	return New(ranges), nil
+}
+
+// Parse reads a blocklist. Each line may use any of the supported formats:
+//
+//	001.002.003.000 - 001.002.003.255 , 000 , eMule DAT
+//	Some description:1.2.3.0-1.2.3.255
+//	1.2.3.0/24
+//	1.2.3.4
+//
+// Lines that cannot be parsed are skipped; an error is returned only if
+// nothing in r could be parsed.
+func Parse(r io.Reader) (*Filter, error) {
+	ranges, err := parse(r)
+	if err != nil {
+		return nil, err
+	}
+	return New(ranges), nil
+}
+
+func parse(r io.Reader) ([]Range, error) {
+	var ranges []Range
+	var firstErr error
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		rng, blocked, err := parseLine(line)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			continue
+		}
+		if blocked {
+			ranges = append(ranges, rng)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ranges) == 0 && firstErr != nil {
+		return nil, firstErr
+	}
+	return ranges, nil
+}
+
+// parseLine detects the format of one line. blocked is false for eMule
+// ranges whose access level allows them.
+func parseLine(line string) (rng Range, blocked bool, err error) {
+	// PeerGuardian descriptions may contain commas, slashes and dashes, so
+	// the format is recognised by its range before anything else.
+	if r, ok := p2pRange(line); ok {
+		rng, err := parseRange(r)
+		return rng, true, err
+	}
+
+	if fields := strings.Split(line, ","); len(fields) > 1 {
+		level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return Range{}, false, fmt.Errorf("bad access level %q", fields[1])
+		}
+		rng, err := parseRange(fields[0])
+		return rng, level < datAllowLevel, err
+	}
+
+	if strings.Contains(line, "/") {
+		prefix, err := netip.ParsePrefix(strings.Fields(line)[0])
+		if err != nil {
+			return Range{}, false, err
+		}
+		return prefixRange(prefix), true, nil
+	}
+
+	if strings.Contains(line, "-") {
+		rng, err := parseRange(line)
+		return rng, true, err
+	}
+
+	addr, err := parseAddr(line)
+	return Range{addr, addr}, true, err
+}
+
+// p2pRange returns the range of a PeerGuardian line,
+// "description:first-last", which follows the last colon of the line.
+func p2pRange(line string) (string, bool) {
+	i := strings.LastIndex(line, ":")
+	if i < 0 {
+		return "", false
+	}
+	from, to, ok := strings.Cut(line[i+1:], "-")
+	if !ok {
+		return "", false
+	}
+	if _, err := parseAddr(from); err != nil {
+		return "", false
+	}
+	if _, err := parseAddr(to); err != nil {
+		return "", false
+	}
+	return line[i+1:], true
+}
+
+// parseRange parses "first - last".
+func parseRange(s string) (Range, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return Range{}, fmt.Errorf("bad range %q", s)
+	}
+
+	first, err := parseAddr(from)
+	if err != nil {
+		return Range{}, err
+	}
+	last, err := parseAddr(to)
+	if err != nil {
+		return Range{}, err
+	}
+	if first.Is4() != last.Is4() || last.Less(first) {
+		return Range{}, fmt.Errorf("bad range %q", s)
+	}
+	return Range{first, last}, nil
+}
+
+// parseAddr accepts IPv4 octets with leading zeros, as eMule lists use.
+func parseAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, ":") {
+		addr, err := netip.ParseAddr(s)
+		return addr.Unmap(), err
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) != 4 {
+		return netip.Addr{}, fmt.Errorf("bad address %q", s)
+	}
+	var ip [4]byte
+	for i, p := range parts {
+		n, err := strconv.ParseUint(p, 10, 8)
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("bad address %q", s)
+		}
+		ip[i] = byte(n)
+	}
+	return netip.AddrFrom4(ip), nil
+}
+
+func prefixRange(p netip.Prefix) Range {
+	p = p.Masked()
+	first := p.Addr()
+	last := first.AsSlice()
+	for bit := p.Bits(); bit < len(last)*8; bit++ {
+		last[bit/8] |= 0x80 >> (bit % 8)
+	}
+	lastAddr, _ := netip.AddrFromSlice(last)
+	return Range{first.Unmap(), lastAddr.Unmap()}
+}
+
+// Blocked reports whether addr falls in a blocked range. A nil filter
+// blocks nothing.
+func (f *Filter) Blocked(addr netip.Addr) bool {
+	if f == nil || !addr.IsValid() {
+		return false
+	}
+	addr = addr.Unmap()
+	// Ranges are disjoint and sorted, so only the last one starting at or
+	// before addr can contain it. Addresses of different families never
+	// compare as within a range.
+	i, found := slices.BinarySearchFunc(f.ranges, addr, func(r Range, a netip.Addr) int {
+		return r.First.Compare(a)
+	})
+	if found {
+		return true
+	}
+	return i > 0 && f.ranges[i-1].Last.Compare(addr) >= 0
+}
+
+// Len returns the number of ranges after merging.
+func (f *Filter) Len() int {
+	if f == nil {
+		return 0
+	}
+	return len(f.ranges)
+}
@@ -0,0 +1,180 @@
+package ipfilter
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line        string
+		first, last string
+		blocked     bool
+	}{
+		// eMule DAT.
+		{"001.002.003.000 - 001.002.003.255 , 000 , Some ISP", "1.2.3.0", "1.2.3.255", true},
+		{"001.002.003.000 - 001.002.003.255 , 200 , Allowed, with commas", "1.2.3.0", "1.2.3.255", false},
+		{"2001:db8:: - 2001:db8::ffff , 100 , v6", "2001:db8::", "2001:db8::ffff", true},
+
+		// PeerGuardian P2P.
+		{"Some description:1.2.3.0-1.2.3.255", "1.2.3.0", "1.2.3.255", true},
+		{"Foo, Inc. / Bar - Baz:1.2.3.0-1.2.3.255", "1.2.3.0", "1.2.3.255", true},
+		{"Proxy 10:30, port 8080/tcp - Bad:001.002.003.004 - 001.002.003.005", "1.2.3.4", "1.2.3.5", true},
+		{"http://example.com/list:5.6.7.8-5.6.7.8", "5.6.7.8", "5.6.7.8", true},
+
+		// CIDR and single addresses.
+		{"1.2.3.0/24", "1.2.3.0", "1.2.3.255", true},
+		{"1.2.3.77/30", "1.2.3.76", "1.2.3.79", true},
+		{"2001:db8::/32", "2001:db8::", "2001:db8:ffff:ffff:ffff:ffff:ffff:ffff", true},
+		{"1.2.3.4", "1.2.3.4", "1.2.3.4", true},
+		{"::ffff:1.2.3.4", "1.2.3.4", "1.2.3.4", true},
+	}
+	for _, tt := range tests {
+		rng, blocked, err := parseLine(tt.line)
+		if err != nil {
+			t.Errorf("parseLine(%q): %v", tt.line, err)
+			continue
+		}
+		want := Range{netip.MustParseAddr(tt.first), netip.MustParseAddr(tt.last)}
+		if rng != want || blocked != tt.blocked {
+			t.Errorf("parseLine(%q) = %v, %v, want %v, %v", tt.line, rng, blocked, want, tt.blocked)
+		}
+	}
+}
+
+func TestParseLineErrors(t *testing.T) {
+	for _, line := range []string{
+		"garbage",
+		"1.2.3",
+		"1.2.3.256",
+		"1.2.3.255 - 1.2.3.0",
+		"1.2.3.0 - 2001:db8::1",
+		"001.002.003.000 - 001.002.003.255 , high , bad level",
+		"Description:1.2.3.255-1.2.3.0",
+	} {
+		if rng, _, err := parseLine(line); err == nil {
+			t.Errorf("parseLine(%q) = %v, want an error", line, rng)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	list := `# comment
+// another comment
+
+Bad people, Inc.:10.0.0.0-10.0.0.255
+010.000.001.000 - 010.000.001.255 , 000 , DAT
+010.000.002.000 - 010.000.002.255 , 255 , allowed
+192.168.0.0/16
+not an address
+2001:db8::1
+`
+	f, err := Parse(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for addr, want := range map[string]bool{
+		"10.0.0.7":    true,
+		"10.0.1.255":  true,
+		"10.0.2.1":    false,
+		"192.168.3.4": true,
+		"2001:db8::1": true,
+		"2001:db8::2": false,
+		"8.8.8.8":     false,
+	} {
+		if got := f.Blocked(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("Blocked(%s) = %v, want %v", addr, got, want)
+		}
+	}
+	if f.Len() != 3 {
+		t.Errorf("Len() = %d, want 3 after merging the adjacent 10.0.0.0/24 and 10.0.1.0/24", f.Len())
+	}
+
+	if _, err := Parse(strings.NewReader("nothing here\n")); err == nil {
+		t.Error("Parse of a list without a single range succeeded")
+	}
+}
+
+func TestNewMergesRanges(t *testing.T) {
+	r := func(first, last string) Range {
+		return Range{netip.MustParseAddr(first), netip.MustParseAddr(last)}
+	}
+
+	tests := []struct {
+		name string
+		in   []Range
+		want []Range
+	}{
+		{
+			"overlapping",
+			[]Range{r("1.0.0.50", "1.0.0.200"), r("1.0.0.0", "1.0.0.100")},
+			[]Range{r("1.0.0.0", "1.0.0.200")},
+		},
+		{
+			"adjacent",
+			[]Range{r("1.0.1.0", "1.0.1.255"), r("1.0.0.0", "1.0.0.255")},
+			[]Range{r("1.0.0.0", "1.0.1.255")},
+		},
+		{
+			"nested",
+			[]Range{r("1.0.0.0", "1.0.255.255"), r("1.0.3.0", "1.0.3.255")},
+			[]Range{r("1.0.0.0", "1.0.255.255")},
+		},
+		{
+			"gap of one address",
+			[]Range{r("1.0.0.0", "1.0.0.9"), r("1.0.0.11", "1.0.0.20")},
+			[]Range{r("1.0.0.0", "1.0.0.9"), r("1.0.0.11", "1.0.0.20")},
+		},
+		{
+			"families kept apart",
+			[]Range{r("::", "::ffff"), r("255.255.255.0", "255.255.255.255"), r("0.0.0.0", "0.0.0.255")},
+			[]Range{r("0.0.0.0", "0.0.0.255"), r("255.255.255.0", "255.255.255.255"), r("::", "::ffff")},
+		},
+		{
+			"end of the address space",
+			[]Range{r("255.255.255.0", "255.255.255.255"), r("255.255.255.128", "255.255.255.255")},
+			[]Range{r("255.255.255.0", "255.255.255.255")},
+		},
+	}
+	for _, tt := range tests {
+		f := New(tt.in)
+		if len(f.ranges) != len(tt.want) {
+			t.Errorf("%s: merged into %v, want %v", tt.name, f.ranges, tt.want)
+			continue
+		}
+		for i := range tt.want {
+			if f.ranges[i] != tt.want[i] {
+				t.Errorf("%s: merged into %v, want %v", tt.name, f.ranges, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestBlockedRangeEdges(t *testing.T) {
+	f := New([]Range{
+		{netip.MustParseAddr("1.2.3.10"), netip.MustParseAddr("1.2.3.20")},
+		{netip.MustParseAddr("1.2.3.30"), netip.MustParseAddr("1.2.3.30")},
+	})
+	for addr, want := range map[string]bool{
+		"1.2.3.9":         false,
+		"1.2.3.10":        true,
+		"1.2.3.20":        true,
+		"1.2.3.21":        false,
+		"1.2.3.30":        true,
+		"1.2.3.31":        false,
+		"::ffff:1.2.3.15": true,
+		"::1":             false,
+	} {
+		if got := f.Blocked(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("Blocked(%s) = %v, want %v", addr, got, want)
+		}
+	}
+
+	var none *Filter
+	if none.Blocked(netip.MustParseAddr("1.2.3.15")) || none.Len() != 0 {
+		t.Error("nil filter blocks addresses")
+	}
+}
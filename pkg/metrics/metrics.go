@@ -0,0 +1,307 @@
+// Package metrics keeps counters, gauges and histograms, optionally split
+// by labels, and serves them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are histogram bounds in seconds suited to network and disk
+// latencies.
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds metric families in the order they were created.
+type Registry struct {
+	scrapeMu sync.Mutex // held across the OnScrape funcs and the write
+
+	mu       sync.Mutex
+	families []*family
+	names    map[string]bool
+	onScrape []func()
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+// Counter adds a family of values that only go up.
+func (r *Registry) Counter(name, help string, labels ...string) *Vec {
+	return &Vec{r.add(name, help, "counter", nil, labels)}
+}
+
+// Gauge adds a family of values that go up and down.
+func (r *Registry) Gauge(name, help string, labels ...string) *Vec {
+	return &Vec{r.add(name, help, "gauge", nil, labels)}
+}
+
+// Histogram adds a family of observation counts in buckets with the given
+// upper bounds, in increasing order. Nil means DefaultBuckets.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	if !slices.IsSorted(buckets) {
+		panic("metrics: histogram buckets of " + name + " are not sorted")
+	}
+	return &HistogramVec{r.add(name, help, "histogram", buckets, labels)}
+}
+
+// OnScrape registers f to run before every scrape, to update values that
+// are read from elsewhere rather than counted as they happen. Scrapes run
+// one at a time, so f may reset a family and refill it without another
+// scrape writing it half done.
+func (r *Registry) OnScrape(f func()) {
+	r.mu.Lock()
+	r.onScrape = append(r.onScrape, f)
+	r.mu.Unlock()
+}
+
+func (r *Registry) add(name, help, kind string, buckets []float64, labels []string) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[name] {
+		panic("metrics: duplicate metric " + name)
+	}
+	r.names[name] = true
+	f := &family{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	r.families = append(r.families, f)
+	return f
+}
+
+// WriteTo writes every metric in the text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.scrapeMu.Lock()
+	defer r.scrapeMu.Unlock()
+
+	r.mu.Lock()
+	onScrape := slices.Clone(r.onScrape)
+	families := slices.Clone(r.families)
+	r.mu.Unlock()
+
+	for _, f := range onScrape {
+		f()
+	}
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, f := range families {
+		f.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP serves a scrape.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+type family struct {
+	name, help, kind string
+	labels           []string
+	buckets          []float64
+
+	mu     sync.Mutex
+	series map[string]*series // by joined label values
+}
+
+type series struct {
+	labelValues []string
+	value       float64  // counters and gauges
+	counts      []uint64 // histograms, per bucket and not cumulative
+	count       uint64
+	sum         float64
+}
+
+func (f *family) with(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: slices.Clone(values)}
+		if f.buckets != nil {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (f *family) write(w *bufio.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		s := f.series[k]
+		if f.kind != "histogram" {
+			writeSample(w, f.name, f.labels, s.labelValues, "", s.value)
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range f.buckets {
+			cumulative += s.counts[i]
+			writeSample(w, f.name+"_bucket", f.labels, s.labelValues, formatFloat(bound), float64(cumulative))
+		}
+		writeSample(w, f.name+"_bucket", f.labels, s.labelValues, "+Inf", float64(s.count))
+		writeSample(w, f.name+"_sum", f.labels, s.labelValues, "", s.sum)
+		writeSample(w, f.name+"_count", f.labels, s.labelValues, "", float64(s.count))
+	}
+}
+
+// writeSample writes one line; le is added as the last label when set.
+func writeSample(w *bufio.Writer, name string, labels, values []string, le string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || le != "" {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", l, escapeLabel(values[i]))
+		}
+		if le != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "le=\"%s\"", le)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Vec is a counter or gauge family.
+type Vec struct{ f *family }
+
+// With returns the value for the given label values, in the order the
+// labels were declared.
+func (v *Vec) With(labelValues ...string) Value {
+	return Value{v.f, v.f.with(labelValues)}
+}
+
+// Reset drops every value, so labels that are no longer set disappear
+// from the next scrape.
+func (v *Vec) Reset() {
+	v.f.mu.Lock()
+	clear(v.f.series)
+	v.f.mu.Unlock()
+}
+
+// Value is one labelled counter or gauge.
+type Value struct {
+	f *family
+	s *series
+}
+
+func (v Value) Inc() { v.Add(1) }
+
+// Add increases the value; counters must not be given negative deltas.
+func (v Value) Add(delta float64) {
+	v.f.mu.Lock()
+	v.s.value += delta
+	v.f.mu.Unlock()
+}
+
+// Set replaces the value. For counters it should only be used to mirror a
+// total kept elsewhere.
+func (v Value) Set(x float64) {
+	v.f.mu.Lock()
+	v.s.value = x
+	v.f.mu.Unlock()
+}
+
+// HistogramVec is a histogram family.
+type HistogramVec struct{ f *family }
+
+// With returns the histogram for the given label values.
+func (v *HistogramVec) With(labelValues ...string) Histogram {
+	return Histogram{v.f, v.f.with(labelValues)}
+}
+
+// Histogram is one labelled histogram.
+type Histogram struct {
+	f *family
+	s *series
+}
+
+func (h Histogram) Observe(x float64) {
+	i, _ := slices.BinarySearch(h.f.buckets, x)
+	h.f.mu.Lock()
+	if i < len(h.s.counts) {
+		h.s.counts[i]++
+	}
+	h.s.count++
+	h.s.sum += x
+	h.f.mu.Unlock()
+}
+
+// ObserveSince records the seconds elapsed since start.
+func (h Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,131 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := NewRegistry()
+	up := r.Gauge("test_up", "Whether the test is up.")
+	bytes := r.Counter("test_bytes_total", "Bytes moved,\nby direction and path\\name.", "direction", "path")
+	latency := r.Histogram("test_latency_seconds", "Latency.", []float64{.1, .5, 1}, "op")
+	r.Histogram("test_empty_seconds", "No observations.", nil)
+
+	up.With().Set(1)
+	bytes.With("up", `C:\data`).Add(1.5)
+	bytes.With("down", "say \"hi\"\nbye").Inc()
+	bytes.With("down", "say \"hi\"\nbye").Add(2)
+	latency.With("read").Observe(.05)
+	latency.With("read").Observe(.5) // bounds are inclusive
+	latency.With("read").Observe(.75)
+	latency.With("read").Observe(3)
+	latency.With("write").Observe(.2)
+
+	want := `# HELP test_up Whether the test is up.
+# TYPE test_up gauge
+test_up 1
+# HELP test_bytes_total Bytes moved,\nby direction and path\\name.
+# TYPE test_bytes_total counter
+test_bytes_total{direction="down",path="say \"hi\"\nbye"} 3
+test_bytes_total{direction="up",path="C:\\data"} 1.5
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{op="read",le="0.1"} 1
+test_latency_seconds_bucket{op="read",le="0.5"} 2
+test_latency_seconds_bucket{op="read",le="1"} 3
+test_latency_seconds_bucket{op="read",le="+Inf"} 4
+test_latency_seconds_sum{op="read"} 4.3
+test_latency_seconds_count{op="read"} 4
+test_latency_seconds_bucket{op="write",le="0.1"} 0
+test_latency_seconds_bucket{op="write",le="0.5"} 1
+test_latency_seconds_bucket{op="write",le="1"} 1
+test_latency_seconds_bucket{op="write",le="+Inf"} 1
+test_latency_seconds_sum{op="write"} 0.2
+test_latency_seconds_count{op="write"} 1
+# HELP test_empty_seconds No observations.
+# TYPE test_empty_seconds histogram
+`
+	var b strings.Builder
+	n, err := r.WriteTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := b.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	if n != int64(b.Len()) {
+		t.Errorf("WriteTo returned %d, wrote %d bytes", n, b.Len())
+	}
+
+	// Reset drops the series but keeps the family.
+	bytes.Reset()
+	b.Reset()
+	r.WriteTo(&b)
+	if !strings.Contains(b.String(), "# TYPE test_bytes_total counter\n# HELP test_latency_seconds") {
+		t.Errorf("reset family still has series:\n%s", b.String())
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("test_total", "Test.").With().Inc()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if !strings.HasSuffix(w.Body.String(), "test_total 1\n") {
+		t.Errorf("body = %q", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST answered %d", w.Code)
+	}
+}
+
+// TestOnScrapeSerialized scrapes concurrently while an OnScrape func resets
+// a family and refills it one series at a time. No scrape may see it half
+// filled.
+func TestOnScrapeSerialized(t *testing.T) {
+	const series = 50
+	r := NewRegistry()
+	peers := r.Gauge("test_peers", "Peers.", "torrent")
+	scrapes := 0
+	r.OnScrape(func() {
+		scrapes++
+		peers.Reset()
+		for i := range series {
+			peers.With(strconv.Itoa(i)).Set(float64(scrapes))
+			runtime.Gosched()
+		}
+	})
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				var b strings.Builder
+				r.WriteTo(&b)
+				if got := strings.Count(b.String(), "test_peers{"); got != series {
+					t.Errorf("scrape wrote %d series, want %d", got, series)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if scrapes != 8*20 {
+		t.Errorf("OnScrape ran %d times, want %d", scrapes, 8*20)
+	}
+}
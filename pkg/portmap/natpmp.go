@@ -0,0 +1,168 @@
+package portmap
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+)
+
+// NAT-PMP (RFC 6886) and its successor PCP share a UDP port on the gateway.
+const (
+	pmpVersion = 0
+
+	pmpOpExternalAddr = 0
+	pmpOpMapUDP       = 1
+	pmpOpMapTCP       = 2
+	pmpReply          = 0x80
+
+	// Requests are sent up to pmpRetries times, waiting twice as long for a
+	// reply each time, starting at pmpInitialTimeout.
+	pmpInitialTimeout = 250 * time.Millisecond
+	pmpRetries        = 4
+)
+
+var pmpResults = map[uint16]string{
+	1: "unsupported version",
+	2: "not authorized",
+	3: "network failure",
+	4: "out of resources",
+	5: "unsupported opcode",
+}
+
+func pmpError(code uint16) error {
+	reason, ok := pmpResults[code]
+	if !ok {
+		reason = fmt.Sprintf("error %d", code)
+	}
+	return fmt.Errorf("natpmp: %s", reason)
+}
+
+// pmpRoundTrip sends req to addr until a reply accepted by match arrives.
+func pmpRoundTrip(ctx context.Context, addr string, req []byte, match func([]byte) bool) ([]byte, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	buf := make([]byte, 1100)
+	timeout := pmpInitialTimeout
+	for range pmpRetries {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		for {
+			n, err := conn.Read(buf)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if match(buf[:n]) {
+				return buf[:n], nil
+			}
+		}
+		timeout *= 2
+	}
+	return nil, fmt.Errorf("no reply from %s", addr)
+}
+
+// probePMP asks addr which of PCP and NAT-PMP it speaks.
+func probePMP(ctx context.Context, addr string) (gateway, error) {
+	pcp, err := newPCPGateway(addr)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := pmpRoundTrip(ctx, addr, pcp.request(pcpOpAnnounce, 0, nil), func(b []byte) bool {
+		return len(b) >= 4 && b[1] == pmpReply|pcpOpAnnounce
+	})
+	if err != nil {
+		return nil, fmt.Errorf("pcp: %w", err)
+	}
+
+	switch {
+	case resp[0] == pcpVersion && resp[3] == 0:
+		return pcp, nil
+	case resp[0] == pmpVersion:
+		pmp := &pmpGateway{addr: addr}
+		if _, err := pmp.externalAddr(ctx); err != nil {
+			return nil, err
+		}
+		return pmp, nil
+	case resp[0] == pcpVersion:
+		return nil, pcpError(resp[3])
+	}
+	return nil, fmt.Errorf("pcp: unknown version %d", resp[0])
+}
+
+// pmpGateway speaks NAT-PMP.
+type pmpGateway struct {
+	addr string
+}
+
+func (g *pmpGateway) method() string { return "natpmp" }
+
+func (g *pmpGateway) externalAddr(ctx context.Context) (netip.Addr, error) {
+	resp, err := pmpRoundTrip(ctx, g.addr, []byte{pmpVersion, pmpOpExternalAddr}, func(b []byte) bool {
+		return len(b) >= 12 && b[0] == pmpVersion && b[1] == pmpReply|pmpOpExternalAddr
+	})
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("natpmp: %w", err)
+	}
+	if code := binary.BigEndian.Uint16(resp[2:]); code != 0 {
+		return netip.Addr{}, pmpError(code)
+	}
+	return netip.AddrFrom4([4]byte(resp[8:12])), nil
+}
+
+func (g *pmpGateway) addMapping(ctx context.Context, p Port, external int, lifetime time.Duration) (Mapping, error) {
+	return g.mapPort(ctx, p, external, lifetime)
+}
+
+// deleteMapping asks for a zero lifetime, which removes the mapping.
+func (g *pmpGateway) deleteMapping(ctx context.Context, m Mapping) error {
+	_, err := g.mapPort(ctx, Port{m.Protocol, m.InternalPort}, 0, 0)
+	return err
+}
+
+func (g *pmpGateway) mapPort(ctx context.Context, p Port, external int, lifetime time.Duration) (Mapping, error) {
+	op := byte(pmpOpMapTCP)
+	if p.Protocol == "udp" {
+		op = pmpOpMapUDP
+	}
+	req := make([]byte, 12)
+	req[0], req[1] = pmpVersion, op
+	binary.BigEndian.PutUint16(req[4:], uint16(p.Port))
+	binary.BigEndian.PutUint16(req[6:], uint16(external))
+	binary.BigEndian.PutUint32(req[8:], uint32(lifetime/time.Second))
+
+	resp, err := pmpRoundTrip(ctx, g.addr, req, func(b []byte) bool {
+		return len(b) >= 16 && b[0] == pmpVersion && b[1] == pmpReply|op &&
+			binary.BigEndian.Uint16(b[8:]) == uint16(p.Port)
+	})
+	if err != nil {
+		return Mapping{}, fmt.Errorf("natpmp: %w", err)
+	}
+	if code := binary.BigEndian.Uint16(resp[2:]); code != 0 {
+		return Mapping{}, pmpError(code)
+	}
+	return Mapping{
+		Protocol:     p.Protocol,
+		InternalPort: p.Port,
+		ExternalPort: int(binary.BigEndian.Uint16(resp[10:])),
+		Method:       g.method(),
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(resp[12:])) * time.Second,
+	}, nil
+}
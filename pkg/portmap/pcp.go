@@ -0,0 +1,138 @@
+package portmap
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// PCP (RFC 6887) messages: a 24-byte header followed by an opcode payload.
+const (
+	pcpVersion = 2
+
+	pcpOpAnnounce = 0
+	pcpOpMap      = 1
+
+	pcpHeaderSize = 24
+	pcpMapSize    = 36
+
+	protoTCP = 6
+	protoUDP = 17
+)
+
+var pcpResults = map[byte]string{
+	1:  "unsupported version",
+	2:  "not authorized",
+	3:  "malformed request",
+	4:  "unsupported opcode",
+	5:  "unsupported option",
+	6:  "malformed option",
+	7:  "network failure",
+	8:  "no resources",
+	9:  "unsupported protocol",
+	10: "user exceeded quota",
+	11: "cannot provide external address",
+	12: "address mismatch",
+	13: "excessive remote peers",
+}
+
+func pcpError(code byte) error {
+	reason, ok := pcpResults[code]
+	if !ok {
+		reason = fmt.Sprintf("error %d", code)
+	}
+	return fmt.Errorf("pcp: %s", reason)
+}
+
+// pcpGateway speaks PCP. It is used by one goroutine at a time.
+type pcpGateway struct {
+	addr     string
+	client   netip.Addr // our address as the gateway sees it
+	nonce    [12]byte   // identifies our mappings across renewals
+	external netip.Addr // from the last MAP response
+}
+
+func newPCPGateway(addr string) (*pcpGateway, error) {
+	client, err := localAddrFor(addr)
+	if err != nil {
+		return nil, err
+	}
+	g := &pcpGateway{addr: addr, client: client}
+	rand.Read(g.nonce[:])
+	return g, nil
+}
+
+func (g *pcpGateway) method() string { return "pcp" }
+
+func (g *pcpGateway) request(op byte, lifetime uint32, payload []byte) []byte {
+	b := make([]byte, pcpHeaderSize, pcpHeaderSize+len(payload))
+	b[0], b[1] = pcpVersion, op
+	binary.BigEndian.PutUint32(b[4:], lifetime)
+	client := g.client.As16()
+	copy(b[8:], client[:])
+	return append(b, payload...)
+}
+
+// externalAddr returns the address from the last mapping; PCP has no
+// separate request for it.
+func (g *pcpGateway) externalAddr(context.Context) (netip.Addr, error) {
+	if !g.external.IsValid() {
+		return netip.Addr{}, fmt.Errorf("pcp: no external address yet")
+	}
+	return g.external, nil
+}
+
+func (g *pcpGateway) addMapping(ctx context.Context, p Port, external int, lifetime time.Duration) (Mapping, error) {
+	return g.mapPort(ctx, p, external, lifetime)
+}
+
+func (g *pcpGateway) deleteMapping(ctx context.Context, m Mapping) error {
+	_, err := g.mapPort(ctx, Port{m.Protocol, m.InternalPort}, m.ExternalPort, 0)
+	return err
+}
+
+func (g *pcpGateway) mapPort(ctx context.Context, p Port, external int, lifetime time.Duration) (Mapping, error) {
+	proto := byte(protoTCP)
+	if p.Protocol == "udp" {
+		proto = protoUDP
+	}
+	payload := make([]byte, pcpMapSize)
+	copy(payload, g.nonce[:])
+	payload[12] = proto
+	binary.BigEndian.PutUint16(payload[16:], uint16(p.Port))
+	binary.BigEndian.PutUint16(payload[18:], uint16(external))
+	// Any external IPv4 address.
+	suggested := netip.IPv4Unspecified().As16()
+	copy(payload[20:], suggested[:])
+
+	req := g.request(pcpOpMap, uint32(lifetime/time.Second), payload)
+	resp, err := pmpRoundTrip(ctx, g.addr, req, func(b []byte) bool {
+		if len(b) < pcpHeaderSize || b[1] != pmpReply|pcpOpMap {
+			return false
+		}
+		// Errors may come without the payload; successes must be ours.
+		return b[3] != 0 || len(b) >= pcpHeaderSize+pcpMapSize &&
+			bytes.Equal(b[24:36], g.nonce[:]) && binary.BigEndian.Uint16(b[40:]) == uint16(p.Port)
+	})
+	if err != nil {
+		return Mapping{}, fmt.Errorf("pcp: %w", err)
+	}
+	if resp[3] != 0 {
+		return Mapping{}, pcpError(resp[3])
+	}
+
+	if lifetime > 0 {
+		g.external = netip.AddrFrom16([16]byte(resp[44:60])).Unmap()
+	}
+	return Mapping{
+		Protocol:     p.Protocol,
+		InternalPort: p.Port,
+		ExternalPort: int(binary.BigEndian.Uint16(resp[42:])),
+		Method:       g.method(),
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(resp[4:])) * time.Second,
+	}, nil
+}
@@ -0,0 +1,336 @@
+// Package portmap asks a home router to forward ports to us, using PCP,
+// NAT-PMP or UPnP IGD, and keeps the mappings alive until closed.
+package portmap
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// pmpLifetime is the lease requested from PCP and NAT-PMP gateways, as
+	// RFC 6886 recommends.
+	pmpLifetime = 2 * time.Hour
+	// upnpLifetime is the lease requested from UPnP gateways.
+	upnpLifetime = time.Hour
+	// maxRenewInterval bounds the time between refreshes, also for
+	// permanent mappings that a rebooted router may have forgotten.
+	maxRenewInterval = 20 * time.Minute
+	// retryInterval is how long to wait before looking for a gateway again
+	// after discovery or mapping failed.
+	retryInterval = 5 * time.Minute
+	// cleanupTimeout bounds removing mappings in Close.
+	cleanupTimeout = 3 * time.Second
+
+	pmpPort  = 5351
+	ssdpAddr = "239.255.255.250:1900"
+)
+
+var ErrNoGateway = errors.New("portmap: no gateway found")
+
+// Port is a local port to forward.
+type Port struct {
+	Protocol string // "tcp" or "udp"
+	Port     int
+}
+
+// Mapping is a port forwarded by the gateway.
+type Mapping struct {
+	Protocol     string
+	InternalPort int
+	ExternalPort int
+	// Method is "pcp", "natpmp" or "upnp".
+	Method string
+	// Lifetime is the lease granted; 0 means the mapping is permanent.
+	Lifetime time.Duration
+}
+
+// Options overrides gateway discovery. The zero value finds gateways the
+// usual way; tests point it at a fake gateway.
+type Options struct {
+	// Gateway is the PCP and NAT-PMP server as host:port. Empty means port
+	// 5351 of the default gateway.
+	Gateway string
+	// SSDPAddr is where UPnP discovery requests are sent. Empty means the
+	// SSDP multicast group.
+	SSDPAddr string
+	// Description labels UPnP mappings in the router's interface.
+	Description string
+}
+
+// gateway is one port mapping protocol spoken with a discovered router.
+type gateway interface {
+	method() string
+	// addMapping creates or renews a mapping, preferring external when it
+	// is non-zero.
+	addMapping(ctx context.Context, p Port, external int, lifetime time.Duration) (Mapping, error)
+	deleteMapping(ctx context.Context, m Mapping) error
+	externalAddr(ctx context.Context) (netip.Addr, error)
+}
+
+// Mapper maintains mappings for a set of ports in the background.
+type Mapper struct {
+	opts   Options
+	ports  []Port
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu       sync.Mutex
+	gw       gateway
+	mappings []Mapping
+	external netip.Addr
+}
+
+// Start looks for a gateway and maps ports, renewing the leases until
+// Close. Failures are logged and retried; they never stop the caller.
+func Start(opts Options, ports []Port) *Mapper {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Mapper{
+		opts:   opts,
+		ports:  ports,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go m.run(ctx)
+	return m
+}
+
+// Mappings returns the mappings currently in place.
+func (m *Mapper) Mappings() []Mapping {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Mapping(nil), m.mappings...)
+}
+
+// ExternalAddr returns our address as the gateway reports it, if known.
+func (m *Mapper) ExternalAddr() (netip.Addr, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.external, m.external.IsValid()
+}
+
+// ExternalPort returns the external port forwarded to a local port.
+func (m *Mapper) ExternalPort(p Port) (int, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, mapping := range m.mappings {
+		if mapping.Protocol == p.Protocol && mapping.InternalPort == p.Port {
+			return mapping.ExternalPort, true
+		}
+	}
+	return 0, false
+}
+
+// Close stops renewing and removes the mappings from the gateway.
+func (m *Mapper) Close() error {
+	m.cancel()
+	<-m.done
+
+	m.mu.Lock()
+	gw, mappings := m.gw, m.mappings
+	m.gw, m.mappings = nil, nil
+	m.mu.Unlock()
+	if gw == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+	var errs []error
+	for _, mapping := range mappings {
+		errs = append(errs, gw.deleteMapping(ctx, mapping))
+	}
+	return errors.Join(errs...)
+}
+
+func (m *Mapper) run(ctx context.Context) {
+	defer close(m.done)
+	for {
+		gw, err := m.discover(ctx)
+		if err == nil {
+			err = m.maintain(ctx, gw)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("port mapping: %v", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// maintain maps every port and renews the mappings at half their lifetime
+// until ctx is done or the gateway stops cooperating.
+func (m *Mapper) maintain(ctx context.Context, gw gateway) error {
+	lifetime := pmpLifetime
+	if gw.method() == "upnp" {
+		lifetime = upnpLifetime
+	}
+
+	for {
+		renew := maxRenewInterval
+		var mappings []Mapping
+		for _, p := range m.ports {
+			external, _ := m.ExternalPort(p)
+			mapping, err := gw.addMapping(ctx, p, external, lifetime)
+			if err != nil {
+				m.abandon(ctx, gw, mappings)
+				return fmt.Errorf("%s: map %s port %d: %w", gw.method(), p.Protocol, p.Port, err)
+			}
+			if mapping.Lifetime > 0 {
+				renew = min(renew, mapping.Lifetime/2)
+			}
+			mappings = append(mappings, mapping)
+		}
+
+		external, err := gw.externalAddr(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("port mapping: %s: external address: %v", gw.method(), err)
+		}
+
+		m.mu.Lock()
+		first := m.gw == nil
+		m.gw, m.mappings = gw, mappings
+		if external.IsValid() {
+			m.external = external
+		}
+		m.mu.Unlock()
+		if first {
+			for _, mapping := range mappings {
+				log.Printf("port mapping: %s forwards %s port %d to local port %d (external address %v)",
+					mapping.Method, mapping.Protocol, mapping.ExternalPort, mapping.InternalPort, external)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(renew):
+		}
+	}
+}
+
+// abandon handles a failed round of mapping. When closing, the mappings
+// made so far are kept for Close to remove; otherwise they are removed now
+// so the next attempt starts clean.
+func (m *Mapper) abandon(ctx context.Context, gw gateway, fresh []Mapping) {
+	m.mu.Lock()
+	all := fresh
+	for _, old := range m.mappings {
+		renewed := slices.ContainsFunc(fresh, func(f Mapping) bool {
+			return f.Protocol == old.Protocol && f.InternalPort == old.InternalPort
+		})
+		if !renewed {
+			all = append(all, old)
+		}
+	}
+	if ctx.Err() != nil {
+		m.gw, m.mappings = gw, all
+		m.mu.Unlock()
+		return
+	}
+	m.gw, m.mappings, m.external = nil, nil, netip.Addr{}
+	m.mu.Unlock()
+
+	for _, mapping := range all {
+		gw.deleteMapping(ctx, mapping)
+	}
+}
+
+// discover finds a gateway, trying PCP, then NAT-PMP, then UPnP. A NAT-PMP
+// gateway answers a PCP request with an unsupported version error, so one
+// probe tells them apart.
+func (m *Mapper) discover(ctx context.Context) (gateway, error) {
+	addr := m.opts.Gateway
+	if addr == "" {
+		if ip, err := defaultGateway(); err == nil {
+			addr = net.JoinHostPort(ip.String(), strconv.Itoa(pmpPort))
+		}
+	}
+	var reasons []string
+	if addr != "" {
+		gw, err := probePMP(ctx, addr)
+		if err == nil {
+			return gw, nil
+		}
+		reasons = append(reasons, err.Error())
+	}
+
+	ssdp := m.opts.SSDPAddr
+	if ssdp == "" {
+		ssdp = ssdpAddr
+	}
+	gw, err := discoverUPnP(ctx, ssdp, m.opts.Description)
+	if err == nil {
+		return gw, nil
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	reasons = append(reasons, err.Error())
+	return nil, fmt.Errorf("%w: %s", ErrNoGateway, strings.Join(reasons, "; "))
+}
+
+// defaultGateway reads the IPv4 default route from the kernel routing
+// table. It is only implemented on Linux.
+func defaultGateway() (netip.Addr, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer f.Close()
+	return parseRoutes(f)
+}
+
+// parseRoutes finds the default gateway in a table in the format of
+// /proc/net/route.
+func parseRoutes(r io.Reader) (netip.Addr, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[1] != "00000000" {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[3], 16, 16)
+		if err != nil || flags&0x2 == 0 { // RTF_GATEWAY
+			continue
+		}
+		gw, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil {
+			continue
+		}
+		// The table holds addresses in host byte order, little-endian on
+		// the platforms we support.
+		var ip [4]byte
+		binary.LittleEndian.PutUint32(ip[:], uint32(gw))
+		return netip.AddrFrom4(ip), nil
+	}
+	return netip.Addr{}, errors.New("no default route")
+}
+
+// localAddrFor returns the local address used to reach addr.
+func localAddrFor(addr string) (netip.Addr, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap(), nil
+}
@@ -0,0 +1,431 @@
+package portmap
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testPorts = []Port{{"tcp", 6881}, {"udp", 6881}}
+
+// pmpRequest is a mapping request received by a fake PCP or NAT-PMP
+// gateway.
+type pmpRequest struct {
+	protocol string
+	internal int
+	external int // suggested by the client
+	lifetime uint32
+}
+
+// fakePMP is a gateway speaking PCP, or only NAT-PMP when pcp is false. It
+// grants leases of at most lease seconds on external port internal+offset.
+type fakePMP struct {
+	pcp    bool
+	lease  uint32
+	offset int
+	pc     net.PacketConn
+
+	mu   sync.Mutex
+	maps []pmpRequest
+}
+
+func newFakePMP(t *testing.T, pcp bool, lease uint32) *fakePMP {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	g := &fakePMP{pcp: pcp, lease: lease, offset: 1000, pc: pc}
+	go g.serve()
+	return g
+}
+
+func (g *fakePMP) addr() string { return g.pc.LocalAddr().String() }
+
+func (g *fakePMP) requests() []pmpRequest {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]pmpRequest(nil), g.maps...)
+}
+
+func (g *fakePMP) record(r pmpRequest) {
+	g.mu.Lock()
+	g.maps = append(g.maps, r)
+	g.mu.Unlock()
+}
+
+func (g *fakePMP) serve() {
+	buf := make([]byte, 1100)
+	for {
+		n, addr, err := g.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		b := buf[:n]
+		switch {
+		case b[0] == pcpVersion && !g.pcp:
+			g.pc.WriteTo([]byte{pmpVersion, pmpReply | b[1], 0, 1, 0, 0, 0, 0}, addr)
+		case b[0] == pcpVersion && b[1] == pcpOpAnnounce:
+			resp := make([]byte, pcpHeaderSize)
+			resp[0], resp[1] = pcpVersion, pmpReply|pcpOpAnnounce
+			g.pc.WriteTo(resp, addr)
+		case b[0] == pcpVersion && b[1] == pcpOpMap:
+			protocol := "tcp"
+			if b[36] == protoUDP {
+				protocol = "udp"
+			}
+			r := pmpRequest{
+				protocol: protocol,
+				internal: int(binary.BigEndian.Uint16(b[40:])),
+				external: int(binary.BigEndian.Uint16(b[42:])),
+				lifetime: binary.BigEndian.Uint32(b[4:]),
+			}
+			g.record(r)
+			resp := make([]byte, pcpHeaderSize+pcpMapSize)
+			resp[0], resp[1] = pcpVersion, pmpReply|pcpOpMap
+			binary.BigEndian.PutUint32(resp[4:], min(r.lifetime, g.lease))
+			copy(resp[24:], b[24:60])
+			binary.BigEndian.PutUint16(resp[42:], uint16(r.internal+g.offset))
+			external := netip.MustParseAddr("203.0.113.7").As16()
+			copy(resp[44:], external[:])
+			g.pc.WriteTo(resp, addr)
+		case b[0] == pmpVersion && b[1] == pmpOpExternalAddr:
+			g.pc.WriteTo([]byte{pmpVersion, pmpReply, 0, 0, 0, 0, 0, 1, 198, 51, 100, 9}, addr)
+		case b[0] == pmpVersion && (b[1] == pmpOpMapUDP || b[1] == pmpOpMapTCP):
+			protocol := "tcp"
+			if b[1] == pmpOpMapUDP {
+				protocol = "udp"
+			}
+			r := pmpRequest{
+				protocol: protocol,
+				internal: int(binary.BigEndian.Uint16(b[4:])),
+				external: int(binary.BigEndian.Uint16(b[6:])),
+				lifetime: binary.BigEndian.Uint32(b[8:]),
+			}
+			g.record(r)
+			resp := make([]byte, 16)
+			resp[0], resp[1] = pmpVersion, pmpReply|b[1]
+			binary.BigEndian.PutUint16(resp[8:], uint16(r.internal))
+			binary.BigEndian.PutUint16(resp[10:], uint16(r.internal+g.offset))
+			binary.BigEndian.PutUint32(resp[12:], min(r.lifetime, g.lease))
+			g.pc.WriteTo(resp, addr)
+		}
+	}
+}
+
+// closedAddr returns a UDP address nothing listens on, so requests to it
+// fail straight away.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+	return addr
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPMPGateways(t *testing.T) {
+	tests := []struct {
+		method   string
+		pcp      bool
+		external string
+	}{
+		{"pcp", true, "203.0.113.7"},
+		{"natpmp", false, "198.51.100.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			gw := newFakePMP(t, tt.pcp, 2)
+			m := Start(Options{Gateway: gw.addr(), SSDPAddr: closedAddr(t)}, testPorts)
+			closed := false
+			defer func() {
+				if !closed {
+					m.Close()
+				}
+			}()
+
+			waitFor(t, "mappings", func() bool { return len(m.Mappings()) == len(testPorts) })
+			for _, p := range testPorts {
+				if port, ok := m.ExternalPort(p); !ok || port != p.Port+gw.offset {
+					t.Errorf("ExternalPort(%v) = %d, %v, want %d", p, port, ok, p.Port+gw.offset)
+				}
+			}
+			for _, mapping := range m.Mappings() {
+				if mapping.Method != tt.method || mapping.Lifetime != 2*time.Second {
+					t.Errorf("mapping %+v, want method %s and a 2s lease", mapping, tt.method)
+				}
+			}
+			waitFor(t, "external address", func() bool { _, ok := m.ExternalAddr(); return ok })
+			if addr, _ := m.ExternalAddr(); addr.String() != tt.external {
+				t.Errorf("ExternalAddr() = %v, want %s", addr, tt.external)
+			}
+
+			first := gw.requests()
+			for _, r := range first {
+				if r.lifetime != uint32(pmpLifetime/time.Second) || r.external != 0 {
+					t.Errorf("first request %+v, want a %v lease on any port", r, pmpLifetime)
+				}
+			}
+
+			// A 2s lease is renewed after a second, asking to keep the
+			// external port.
+			waitFor(t, "renewal", func() bool { return len(gw.requests()) >= 2*len(testPorts) })
+			for _, r := range gw.requests()[len(testPorts) : 2*len(testPorts)] {
+				if r.lifetime == 0 || r.external != r.internal+gw.offset {
+					t.Errorf("renewal %+v, want the lease on port %d", r, r.internal+gw.offset)
+				}
+			}
+
+			closed = true
+			if err := m.Close(); err != nil {
+				t.Fatal(err)
+			}
+			var deleted []string
+			for _, r := range gw.requests() {
+				if r.lifetime == 0 {
+					deleted = append(deleted, r.protocol)
+				}
+			}
+			if len(deleted) != len(testPorts) {
+				t.Errorf("Close deleted %v, want both mappings", deleted)
+			}
+			if len(m.Mappings()) != 0 {
+				t.Errorf("mappings left after Close: %v", m.Mappings())
+			}
+		})
+	}
+}
+
+const testDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+ <device>
+  <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+  <deviceList><device>
+   <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+   <deviceList><device>
+    <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+    <serviceList><service>
+     <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+     <controlURL>/ctl/IPConn</controlURL>
+    </service></serviceList>
+   </device></deviceList>
+  </device></deviceList>
+ </device>
+</root>`
+
+// soapCall is an action received by a fake UPnP gateway, with its
+// arguments.
+type soapCall struct {
+	action string
+	args   map[string]string
+}
+
+// fakeUPnP is an Internet Gateway Device answering SSDP searches and SOAP
+// actions. With permanentOnly it refuses leases with error 725.
+type fakeUPnP struct {
+	permanentOnly bool
+	ssdp          net.PacketConn
+
+	mu    sync.Mutex
+	calls []soapCall
+}
+
+var soapArg = regexp.MustCompile(`<(New\w+)>([^<]*)</New\w+>`)
+
+func newFakeUPnP(t *testing.T, permanentOnly bool) *fakeUPnP {
+	t.Helper()
+	g := &fakeUPnP{permanentOnly: permanentOnly}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/desc.xml", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testDescription)
+	})
+	mux.HandleFunc("/ctl/IPConn", g.control)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	g.ssdp = pc
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if !strings.HasPrefix(string(buf[:n]), "M-SEARCH") {
+				continue
+			}
+			pc.WriteTo([]byte("HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=120\r\n"+
+				"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n"+
+				"LOCATION: "+srv.URL+"/desc.xml\r\n\r\n"), addr)
+		}
+	}()
+	return g
+}
+
+func (g *fakeUPnP) control(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	action := r.Header.Get("SOAPAction")
+	action = strings.Trim(action[strings.Index(action, "#")+1:], `"`)
+	call := soapCall{action: action, args: make(map[string]string)}
+	for _, m := range soapArg.FindAllStringSubmatch(string(body), -1) {
+		call.args[m[1]] = m[2]
+	}
+	g.mu.Lock()
+	g.calls = append(g.calls, call)
+	g.mu.Unlock()
+
+	switch {
+	case action == "AddPortMapping" && g.permanentOnly && call.args["NewLeaseDuration"] != "0":
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, `<s:Envelope><s:Body><s:Fault><detail><UPnPError>`+
+			`<errorCode>725</errorCode><errorDescription>OnlyPermanentLeasesSupported</errorDescription>`+
+			`</UPnPError></detail></s:Fault></s:Body></s:Envelope>`)
+	case action == "GetExternalIPAddress":
+		io.WriteString(w, `<s:Envelope><s:Body><u:GetExternalIPAddressResponse>`+
+			`<NewExternalIPAddress>192.0.2.44</NewExternalIPAddress>`+
+			`</u:GetExternalIPAddressResponse></s:Body></s:Envelope>`)
+	default:
+		io.WriteString(w, `<s:Envelope><s:Body/></s:Envelope>`)
+	}
+}
+
+func (g *fakeUPnP) actions(action string) []soapCall {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var out []soapCall
+	for _, c := range g.calls {
+		if c.action == action {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func TestUPnPGateway(t *testing.T) {
+	tests := []struct {
+		name          string
+		permanentOnly bool
+		lifetime      time.Duration
+	}{
+		{"lease", false, upnpLifetime},
+		{"permanent only", true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gw := newFakeUPnP(t, tt.permanentOnly)
+			m := Start(Options{
+				Gateway:     closedAddr(t),
+				SSDPAddr:    gw.ssdp.LocalAddr().String(),
+				Description: "test client",
+			}, testPorts)
+			closed := false
+			defer func() {
+				if !closed {
+					m.Close()
+				}
+			}()
+
+			waitFor(t, "mappings", func() bool { return len(m.Mappings()) == len(testPorts) })
+			for _, mapping := range m.Mappings() {
+				if mapping.Method != "upnp" || mapping.ExternalPort != mapping.InternalPort || mapping.Lifetime != tt.lifetime {
+					t.Errorf("mapping %+v, want the same port by upnp for %v", mapping, tt.lifetime)
+				}
+			}
+			waitFor(t, "external address", func() bool { _, ok := m.ExternalAddr(); return ok })
+			if addr, _ := m.ExternalAddr(); addr.String() != "192.0.2.44" {
+				t.Errorf("ExternalAddr() = %v, want 192.0.2.44", addr)
+			}
+
+			adds := gw.actions("AddPortMapping")
+			wantAdds := len(testPorts)
+			if tt.permanentOnly {
+				// Each port is asked for with a lease first, then for good.
+				wantAdds *= 2
+			}
+			if len(adds) != wantAdds {
+				t.Fatalf("%d AddPortMapping calls, want %d", len(adds), wantAdds)
+			}
+			last := adds[len(adds)-1].args
+			if last["NewProtocol"] != "UDP" || last["NewInternalPort"] != "6881" ||
+				last["NewInternalClient"] != "127.0.0.1" || last["NewPortMappingDescription"] != "test client" {
+				t.Errorf("AddPortMapping arguments %v", last)
+			}
+			if tt.permanentOnly && (adds[0].args["NewLeaseDuration"] != "3600" || last["NewLeaseDuration"] != "0") {
+				t.Errorf("leases asked for %s then %s, want 3600 then 0",
+					adds[0].args["NewLeaseDuration"], last["NewLeaseDuration"])
+			}
+
+			closed = true
+			if err := m.Close(); err != nil {
+				t.Fatal(err)
+			}
+			deletes := gw.actions("DeletePortMapping")
+			if len(deletes) != len(testPorts) {
+				t.Fatalf("Close made %d DeletePortMapping calls, want %d", len(deletes), len(testPorts))
+			}
+			for i, d := range deletes {
+				if d.args["NewExternalPort"] != "6881" || d.args["NewProtocol"] != strings.ToUpper(testPorts[i].Protocol) {
+					t.Errorf("DeletePortMapping arguments %v", d.args)
+				}
+			}
+		})
+	}
+}
+
+func TestNoGateway(t *testing.T) {
+	m := Start(Options{Gateway: closedAddr(t), SSDPAddr: closedAddr(t)}, testPorts)
+	time.Sleep(100 * time.Millisecond)
+	if len(m.Mappings()) != 0 {
+		t.Errorf("mappings without a gateway: %v", m.Mappings())
+	}
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close without a gateway: %v", err)
+	}
+}
+
+func TestParseRoutes(t *testing.T) {
+	table := "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n" +
+		"eth0\t0001A8C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n" +
+		"eth0\t00000000\t0101A8C0\t0003\t0\t0\t100\t00000000\t0\t0\t0\n"
+	addr, err := parseRoutes(strings.NewReader(table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != netip.MustParseAddr("192.168.1.1") {
+		t.Errorf("gateway %v, want 192.168.1.1", addr)
+	}
+
+	noDefault := "Iface\tDestination\tGateway \tFlags\n" +
+		"eth0\t0001A8C0\t00000000\t0001\n"
+	if addr, err := parseRoutes(strings.NewReader(noDefault)); err == nil {
+		t.Errorf("found gateway %v in a table without a default route", addr)
+	}
+}
@@ -0,0 +1,341 @@
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ssdpTimeout = 2 * time.Second
+	soapTimeout = 5 * time.Second
+
+	// upnpErrPermanentOnly is returned by gateways that refuse leases.
+	upnpErrPermanentOnly = 725
+)
+
+var igdDevices = []string{
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:2",
+}
+
+var wanServices = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// upnpGateway is the WAN connection service of an Internet Gateway Device.
+type upnpGateway struct {
+	controlURL  string
+	serviceType string
+	client      netip.Addr // our address on the gateway's network
+	description string
+	http        *http.Client
+}
+
+// discoverUPnP searches for an Internet Gateway Device with SSDP and picks
+// the first one offering a WAN connection service.
+func discoverUPnP(ctx context.Context, ssdp, description string) (*upnpGateway, error) {
+	pc, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+	stop := context.AfterFunc(ctx, func() { pc.Close() })
+	defer stop()
+
+	dst, err := net.ResolveUDPAddr("udp4", ssdp)
+	if err != nil {
+		return nil, fmt.Errorf("upnp: %w", err)
+	}
+	for _, st := range igdDevices {
+		search := "M-SEARCH * HTTP/1.1\r\n" +
+			"HOST: " + ssdpAddr + "\r\n" +
+			"MAN: \"ssdp:discover\"\r\n" +
+			"MX: 2\r\n" +
+			"ST: " + st + "\r\n\r\n"
+		if _, err := pc.WriteTo([]byte(search), dst); err != nil {
+			return nil, fmt.Errorf("upnp: search: %w", err)
+		}
+	}
+
+	httpClient := &http.Client{Timeout: soapTimeout}
+	seen := make(map[string]bool)
+	var errs []error
+	pc.SetReadDeadline(time.Now().Add(ssdpTimeout))
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("upnp: %w", err)
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			continue
+		}
+		location := resp.Header.Get("Location")
+		if location == "" || seen[location] {
+			continue
+		}
+		seen[location] = true
+
+		gw, err := fetchDescription(ctx, httpClient, location)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		gw.description = description
+		return gw, nil
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return nil, errors.New("upnp: no devices answered")
+}
+
+type upnpRoot struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices  []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// findService returns the first WAN connection service in the device tree.
+func (d *upnpDevice) findService() (upnpService, bool) {
+	for _, s := range d.Services {
+		for _, want := range wanServices {
+			if s.ServiceType == want {
+				return s, true
+			}
+		}
+	}
+	for i := range d.Devices {
+		if s, ok := d.Devices[i].findService(); ok {
+			return s, true
+		}
+	}
+	return upnpService{}, false
+}
+
+// fetchDescription reads a device description and resolves its WAN
+// connection service.
+func fetchDescription(ctx context.Context, httpClient *http.Client, location string) (*upnpGateway, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, fmt.Errorf("upnp: %w", err)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("upnp: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upnp: %s: %s", location, resp.Status)
+	}
+
+	var root upnpRoot
+	if err := xml.NewDecoder(resp.Body).Decode(&root); err != nil {
+		return nil, fmt.Errorf("upnp: %s: %w", location, err)
+	}
+	service, ok := root.Device.findService()
+	if !ok {
+		return nil, fmt.Errorf("upnp: %s has no WAN connection service", location)
+	}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("upnp: %w", err)
+	}
+	if root.URLBase != "" {
+		if b, err := url.Parse(root.URLBase); err == nil {
+			base = b
+		}
+	}
+	control, err := base.Parse(service.ControlURL)
+	if err != nil {
+		return nil, fmt.Errorf("upnp: control URL: %w", err)
+	}
+
+	host := control.Host
+	if control.Port() == "" {
+		host = net.JoinHostPort(control.Hostname(), "80")
+	}
+	client, err := localAddrFor(host)
+	if err != nil {
+		return nil, fmt.Errorf("upnp: %w", err)
+	}
+	return &upnpGateway{
+		controlURL:  control.String(),
+		serviceType: service.ServiceType,
+		client:      client,
+		http:        httpClient,
+	}, nil
+}
+
+func (g *upnpGateway) method() string { return "upnp" }
+
+func (g *upnpGateway) externalAddr(ctx context.Context) (netip.Addr, error) {
+	values, err := g.soap(ctx, "GetExternalIPAddress", nil)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	addr, err := netip.ParseAddr(values["NewExternalIPAddress"])
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("upnp: external address: %w", err)
+	}
+	return addr, nil
+}
+
+// addMapping forwards the same port number externally, as UPnP leaves port
+// choice to us.
+func (g *upnpGateway) addMapping(ctx context.Context, p Port, external int, lifetime time.Duration) (Mapping, error) {
+	if external == 0 {
+		external = p.Port
+	}
+	args := func(lifetime time.Duration) [][2]string {
+		return [][2]string{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", strconv.Itoa(external)},
+			{"NewProtocol", strings.ToUpper(p.Protocol)},
+			{"NewInternalPort", strconv.Itoa(p.Port)},
+			{"NewInternalClient", g.client.String()},
+			{"NewEnabled", "1"},
+			{"NewPortMappingDescription", g.description},
+			{"NewLeaseDuration", strconv.Itoa(int(lifetime / time.Second))},
+		}
+	}
+
+	_, err := g.soap(ctx, "AddPortMapping", args(lifetime))
+	var upnpErr *upnpError
+	if errors.As(err, &upnpErr) && upnpErr.code == upnpErrPermanentOnly {
+		lifetime = 0
+		_, err = g.soap(ctx, "AddPortMapping", args(lifetime))
+	}
+	if err != nil {
+		return Mapping{}, err
+	}
+	return Mapping{
+		Protocol:     p.Protocol,
+		InternalPort: p.Port,
+		ExternalPort: external,
+		Method:       g.method(),
+		Lifetime:     lifetime,
+	}, nil
+}
+
+func (g *upnpGateway) deleteMapping(ctx context.Context, m Mapping) error {
+	_, err := g.soap(ctx, "DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(m.ExternalPort)},
+		{"NewProtocol", strings.ToUpper(m.Protocol)},
+	})
+	return err
+}
+
+// upnpError is a fault returned by the gateway for a SOAP action.
+type upnpError struct {
+	code        int
+	description string
+}
+
+func (e *upnpError) Error() string {
+	return fmt.Sprintf("upnp: error %d: %s", e.code, e.description)
+}
+
+// soap invokes action on the WAN connection service and returns the
+// elements of the response.
+func (g *upnpGateway) soap(ctx context.Context, action string, args [][2]string) (map[string]string, error) {
+	var body strings.Builder
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + action + ` xmlns:u="` + g.serviceType + `">`)
+	for _, arg := range args {
+		fmt.Fprintf(&body, "<%s>%s</%s>", arg[0], html.EscapeString(arg[1]), arg[0])
+	}
+	body.WriteString(`</u:` + action + `></s:Body></s:Envelope>`)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.controlURL, strings.NewReader(body.String()))
+	if err != nil {
+		return nil, fmt.Errorf("upnp: %w", err)
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+g.serviceType+"#"+action+`"`)
+
+	resp, err := g.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("upnp: %s: %w", action, err)
+	}
+	defer resp.Body.Close()
+	values, err := xmlValues(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, fmt.Errorf("upnp: %s: %w", action, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		code, err := strconv.Atoi(values["errorCode"])
+		if err != nil {
+			return nil, fmt.Errorf("upnp: %s: %s", action, resp.Status)
+		}
+		return nil, &upnpError{code: code, description: values["errorDescription"]}
+	}
+	return values, nil
+}
+
+// xmlValues collects the text of every leaf element by local name, which
+// is all SOAP responses and faults need.
+func xmlValues(r io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	dec := xml.NewDecoder(r)
+	var name string
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			for k, v := range values {
+				values[k] = strings.TrimSpace(v)
+			}
+			return values, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name = t.Name.Local
+		case xml.CharData:
+			if name != "" {
+				values[name] += string(t)
+			}
+		case xml.EndElement:
+			name = ""
+		}
+	}
+}
@@ -1,25 +1,166 @@
 package protocol
 
+import (
+	"errors"
+	"fmt"
+	"iter"
+	"math/bits"
+)
+
+var ErrInvalidBitfield = errors.New("invalid bitfield")
+
+// Bitfield is a compact set of piece indices in wire order: the high bit of
+// the first byte is piece 0. It also serves as the bitfield message. The
+// zero value is an empty set of length 0. Copies share storage; use Clone
+// for an independent copy.
+type Bitfield struct {
+	bits []byte
+	n    int
+}
+
+// NewBitfield returns an empty bitfield for n pieces.
+func NewBitfield(n int) Bitfield {
+	return Bitfield{bits: make([]byte, (n+7)/8), n: n}
+}
+
+// BitfieldFromBytes copies a wire bitfield for n pieces. It fails if the
+// length does not match n or any spare trailing bit is set.
+func BitfieldFromBytes(data []byte, n int) (Bitfield, error) {
+	if len(data) != (n+7)/8 {
+		return Bitfield{}, fmt.Errorf("%w: %d bytes for %d pieces", ErrInvalidBitfield, len(data), n)
+	}
+	if n%8 != 0 && data[len(data)-1]&(0xFF>>(n%8)) != 0 {
+		return Bitfield{}, fmt.Errorf("%w: spare bits set", ErrInvalidBitfield)
+	}
+	b := NewBitfield(n)
+	copy(b.bits, data)
+	return b, nil
+}
+
+// Len returns the number of pieces the bitfield covers.
+func (b Bitfield) Len() int { return b.n }
+
+func (b Bitfield) Has(i uint32) bool {
+	if int(i) >= b.n {
+		return false
+	}
+	return b.bits[i/8]&(0x80>>(i%8)) != 0
+}
+
+// Set marks piece i. Indices outside the bitfield are ignored.
+func (b Bitfield) Set(i uint32) {
+	if int(i) < b.n {
+		b.bits[i/8] |= 0x80 >> (i % 8)
+	}
+}
+
+func (b Bitfield) Clear(i uint32) {
+	if int(i) < b.n {
+		b.bits[i/8] &^= 0x80 >> (i % 8)
+	}
+}
+
+// SetAll marks every piece, as for a have-all message.
+func (b Bitfield) SetAll() {
+	for i := range b.bits {
+		b.bits[i] = 0xFF
+	}
+	if b.n%8 != 0 {
+		b.bits[len(b.bits)-1] = 0xFF << (8 - b.n%8)
+	}
+}
+
+// Count returns the number of pieces set.
+func (b Bitfield) Count() int {
+	count := 0
+	for _, v := range b.bits {
+		count += bits.OnesCount8(v)
+	}
+	return count
+}
+
+func (b Bitfield) IsFull() bool { return b.Count() == b.n }
+
+func (b Bitfield) Clone() Bitfield {
+	c := NewBitfield(b.n)
+	copy(c.bits, b.bits)
+	return c
+}
+
+// And returns the pieces set in both b and o.
+func (b Bitfield) And(o Bitfield) Bitfield {
+	return b.combine(o, func(x, y byte) byte { return x & y })
+}
+
+// Or returns the pieces set in either b or o.
+func (b Bitfield) Or(o Bitfield) Bitfield {
+	return b.combine(o, func(x, y byte) byte { return x | y })
+}
+
+// AndNot returns the pieces set in b but not in o.
+func (b Bitfield) AndNot(o Bitfield) Bitfield {
+	return b.combine(o, func(x, y byte) byte { return x &^ y })
+}
+
+// combine applies op bytewise. The result has b's length; missing bytes of o
+// are treated as zero.
+func (b Bitfield) combine(o Bitfield, op func(x, y byte) byte) Bitfield {
+	r := NewBitfield(b.n)
+	for i := range r.bits {
+		var y byte
+		if i < len(o.bits) {
+			y = o.bits[i]
+		}
+		r.bits[i] = op(b.bits[i], y)
+	}
+	if b.n%8 != 0 {
+		r.bits[len(r.bits)-1] &= 0xFF << (8 - b.n%8)
+	}
+	return r
+}
+
+// All iterates over the set piece indices in ascending order.
+func (b Bitfield) All() iter.Seq[uint32] {
+	return func(yield func(uint32) bool) {
+		for i, v := range b.bits {
+			for v != 0 {
+				bit := bits.LeadingZeros8(v)
+				if !yield(uint32(i*8 + bit)) {
+					return
+				}
+				v &^= 0x80 >> bit
+			}
+		}
+	}
+}
+
+// Bytes returns the wire encoding. The slice aliases the bitfield.
+func (b Bitfield) Bytes() []byte { return b.bits }
+
+func (Bitfield) ID() MessageID { return MsgBitfield }
+
+func (b Bitfield) AppendPayload(buf []byte) []byte { return append(buf, b.bits...) }
+
 // ParseBitfield converts a byte slice into a slice of booleans
 // where each element indicates whether the peer has the corresponding piece.
+//
+// Deprecated: Use BitfieldFromBytes and Bitfield.Has.
 func ParseBitfield(data []byte) []bool {
-	bitfield := make([]bool, len(data)*8)
-	for i := 0; i < len(data); i++ {
-		for j := 0; j < 8; j++ {
-			bitfield[i*8+j] = (data[i]&(1<<(7-j)) != 0)
-		}
+	b := Bitfield{bits: data, n: len(data) * 8}
+	bitfield := make([]bool, b.n)
+	for i := range b.All() {
+		bitfield[i] = true
 	}
 	return bitfield
 }
 
-// piecesPeerHas returns a slice of piece indices that the peer has
+// PiecesPeerHas returns a slice of piece indices that the peer has.
+//
+// Deprecated: Use BitfieldFromBytes and Bitfield.All.
 func PiecesPeerHas(data []byte) []uint32 {
-	bitfield := ParseBitfield(data)
 	pieces := []uint32{}
-	for i, hasPiece := range bitfield {
-		if hasPiece {
-			pieces = append(pieces, uint32(i))
-		}
+	for i := range (Bitfield{bits: data, n: len(data) * 8}).All() {
+		pieces = append(pieces, i)
 	}
 	return pieces
 }
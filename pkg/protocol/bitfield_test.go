@@ -0,0 +1,148 @@
+package protocol
+
+import (
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func bitfieldWith(n int, pieces ...uint32) Bitfield {
+	b := NewBitfield(n)
+	for _, i := range pieces {
+		b.Set(i)
+	}
+	return b
+}
+
+func TestBitfieldFromBytes(t *testing.T) {
+	for _, tc := range []struct {
+		data []byte
+		n    int
+		ok   bool
+	}{
+		{[]byte{0xff, 0xe0}, 11, true},
+		{[]byte{0xff, 0xf0}, 11, false}, // spare bit 11 set
+		{[]byte{0xff, 0x01}, 11, false}, // last spare bit set
+		{[]byte{0xff, 0xff}, 16, true},
+		{[]byte{0xff}, 11, false}, // too short
+		{[]byte{0xff, 0, 0}, 11, false},
+	} {
+		b, err := BitfieldFromBytes(tc.data, tc.n)
+		if tc.ok != (err == nil) {
+			t.Errorf("BitfieldFromBytes(%x, %d) error = %v, want ok %v", tc.data, tc.n, err, tc.ok)
+			continue
+		}
+		if err != nil && !errors.Is(err, ErrInvalidBitfield) {
+			t.Errorf("BitfieldFromBytes(%x, %d) = %v, want ErrInvalidBitfield", tc.data, tc.n, err)
+		}
+		if err == nil && b.Len() != tc.n {
+			t.Errorf("BitfieldFromBytes(%x, %d).Len() = %d", tc.data, tc.n, b.Len())
+		}
+	}
+
+	// The result does not alias the input.
+	data := []byte{0x80}
+	b, _ := BitfieldFromBytes(data, 8)
+	data[0] = 0
+	if !b.Has(0) {
+		t.Error("BitfieldFromBytes aliases its input")
+	}
+}
+
+func TestBitfieldSetClear(t *testing.T) {
+	b := NewBitfield(10)
+	b.Set(0)
+	b.Set(9)
+	b.Set(10) // out of range, ignored
+	if got := b.Bytes(); !slices.Equal(got, []byte{0x80, 0x40}) {
+		t.Fatalf("Bytes = %x, want 8040", got)
+	}
+	if !b.Has(9) || b.Has(10) || b.Count() != 2 {
+		t.Fatalf("Has(9) = %v, Has(10) = %v, Count = %d", b.Has(9), b.Has(10), b.Count())
+	}
+	b.Clear(0)
+	if b.Has(0) || b.Count() != 1 {
+		t.Fatalf("Clear(0) left %x", b.Bytes())
+	}
+
+	b.SetAll()
+	if got := b.Bytes(); !slices.Equal(got, []byte{0xff, 0xc0}) || !b.IsFull() {
+		t.Fatalf("SetAll = %x, want ffc0 with no spare bits", got)
+	}
+}
+
+func TestBitfieldSetOperations(t *testing.T) {
+	a := bitfieldWith(11, 0, 1, 5, 10)
+	b := bitfieldWith(11, 1, 2, 10)
+
+	for _, tc := range []struct {
+		name string
+		got  Bitfield
+		want []uint32
+	}{
+		{"And", a.And(b), []uint32{1, 10}},
+		{"Or", a.Or(b), []uint32{0, 1, 2, 5, 10}},
+		{"AndNot", a.AndNot(b), []uint32{0, 5}},
+	} {
+		if got := slices.Collect(tc.got.All()); !slices.Equal(got, tc.want) {
+			t.Errorf("%s = %v, want %v", tc.name, got, tc.want)
+		}
+		if tc.got.Len() != 11 {
+			t.Errorf("%s has length %d, want 11", tc.name, tc.got.Len())
+		}
+	}
+
+	// Operands are left unchanged.
+	if got := slices.Collect(a.All()); !slices.Equal(got, []uint32{0, 1, 5, 10}) {
+		t.Errorf("a changed to %v", got)
+	}
+
+	// A shorter operand counts as unset, and spare bits never leak into the
+	// result.
+	short := bitfieldWith(3, 0)
+	short.bits[0] |= 0x01
+	if got := slices.Collect(a.AndNot(short).All()); !slices.Equal(got, []uint32{1, 5, 10}) {
+		t.Errorf("AndNot shorter = %v, want [1 5 10]", got)
+	}
+	if got := short.Or(a).Bytes(); !slices.Equal(got, []byte{0xc0}) {
+		t.Errorf("Or of 3 piece bitfield = %x, want c0", got)
+	}
+}
+
+func TestBitfieldAll(t *testing.T) {
+	b := bitfieldWith(20, 3, 7, 8, 19)
+	if got := slices.Collect(b.All()); !slices.Equal(got, []uint32{3, 7, 8, 19}) {
+		t.Fatalf("All = %v", got)
+	}
+
+	var first []uint32
+	for i := range b.All() {
+		first = append(first, i)
+		if len(first) == 2 {
+			break
+		}
+	}
+	if !slices.Equal(first, []uint32{3, 7}) {
+		t.Fatalf("All stopped early = %v", first)
+	}
+
+	if got := slices.Collect(NewBitfield(0).All()); len(got) != 0 {
+		t.Fatalf("All of empty bitfield = %v", got)
+	}
+}
+
+func TestDeprecatedBitfieldHelpers(t *testing.T) {
+	data := []byte{0xa0, 0x01}
+	want := make([]bool, 16)
+	want[0], want[2], want[15] = true, true, true
+	if got := ParseBitfield(data); !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseBitfield = %v", got)
+	}
+	if got := PiecesPeerHas(data); !slices.Equal(got, []uint32{0, 2, 15}) {
+		t.Errorf("PiecesPeerHas = %v", got)
+	}
+	if got := PiecesPeerHas(nil); got == nil || len(got) != 0 {
+		t.Errorf("PiecesPeerHas(nil) = %#v, want empty slice", got)
+	}
+}
@@ -0,0 +1,103 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DefaultMaxMessageSize bounds incoming messages. It fits a bitfield for
+// 16 million pieces and any sane block or extension message.
+const DefaultMaxMessageSize = 2 << 20
+
+var ErrMessageTooLarge = errors.New("message exceeds maximum size")
+
+// Reader decodes length-prefixed messages from a stream. The payload buffer
+// is reused between calls, so byte slices in a returned message (Piece.Block,
+// Bitfield, Extended.Payload) are only valid until the next ReadMessage.
+type Reader struct {
+	MaxMessageSize uint32
+
+	r      io.Reader
+	header [4]byte
+	buf    []byte
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r, MaxMessageSize: DefaultMaxMessageSize}
+}
+
+// ReadMessage reads the next message. Unknown message ids are reported as
+// ErrUnknownMessage after their payload has been consumed, so the stream stays
+// in sync and the caller may keep reading.
+func (r *Reader) ReadMessage() (Message, error) {
+	if _, err := io.ReadFull(r.r, r.header[:]); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(r.header[:])
+	if length == 0 {
+		return KeepAlive{}, nil
+	}
+	if length > r.MaxMessageSize {
+		return nil, fmt.Errorf("%w: %d > %d", ErrMessageTooLarge, length, r.MaxMessageSize)
+	}
+
+	if uint32(cap(r.buf)) < length {
+		r.buf = make([]byte, length)
+	}
+	buf := r.buf[:length]
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return nil, err
+	}
+
+	return ParseMessage(MessageID(buf[0]), buf[1:])
+}
+
+// Writer encodes messages into an internal buffer that is sent on Flush, so
+// several small messages (e.g. a batch of requests) go out in one write. It
+// is safe for concurrent use.
+type Writer struct {
+	mu  sync.Mutex
+	w   io.Writer
+	buf []byte
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// WriteMessage queues m without sending it.
+func (w *Writer) WriteMessage(m Message) {
+	w.mu.Lock()
+	w.buf = AppendMessage(w.buf, m)
+	w.mu.Unlock()
+}
+
+// Flush sends all queued messages.
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flushLocked()
+}
+
+// Send queues msgs and flushes them together with anything already queued.
+func (w *Writer) Send(msgs ...Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, m := range msgs {
+		w.buf = AppendMessage(w.buf, m)
+	}
+	return w.flushLocked()
+}
+
+func (w *Writer) flushLocked() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := w.w.Write(w.buf)
+	w.buf = w.buf[:0]
+	return err
+}
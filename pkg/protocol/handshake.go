@@ -0,0 +1,69 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	ProtocolString = "BitTorrent protocol"
+	HandshakeLen   = 1 + len(ProtocolString) + 8 + 20 + 20
+)
+
+// Reserved bits, as byte index and mask into Handshake.Reserved.
+const (
+	reservedExtensionByte = 5
+	reservedExtensionBit  = 0x10 // BEP 10
+	reservedFastByte      = 7
+	reservedFastBit       = 0x04 // BEP 6
+	reservedDHTByte       = 7
+	reservedDHTBit        = 0x01 // BEP 5
+)
+
+var ErrBadHandshake = errors.New("invalid handshake")
+
+// Handshake is the fixed-size message that opens every peer connection.
+type Handshake struct {
+	Reserved [8]byte
+	InfoHash [20]byte
+	PeerID   [20]byte
+}
+
+// Marshal encodes <pstrlen><pstr><reserved><info_hash><peer_id>.
+func (h Handshake) Marshal() []byte {
+	buf := make([]byte, 0, HandshakeLen)
+	buf = append(buf, byte(len(ProtocolString)))
+	buf = append(buf, ProtocolString...)
+	buf = append(buf, h.Reserved[:]...)
+	buf = append(buf, h.InfoHash[:]...)
+	return append(buf, h.PeerID[:]...)
+}
+
+func (h *Handshake) SetExtensions() { h.Reserved[reservedExtensionByte] |= reservedExtensionBit }
+func (h *Handshake) SetFast()       { h.Reserved[reservedFastByte] |= reservedFastBit }
+func (h *Handshake) SetDHT()        { h.Reserved[reservedDHTByte] |= reservedDHTBit }
+func (h Handshake) SupportsExtensions() bool {
+	return h.Reserved[reservedExtensionByte]&reservedExtensionBit != 0
+}
+func (h Handshake) SupportsFast() bool { return h.Reserved[reservedFastByte]&reservedFastBit != 0 }
+func (h Handshake) SupportsDHT() bool  { return h.Reserved[reservedDHTByte]&reservedDHTBit != 0 }
+
+// ReadHandshake reads a complete handshake from r. Unlike a single Read it
+// never returns a short handshake.
+func ReadHandshake(r io.Reader) (Handshake, error) {
+	var h Handshake
+	buf := make([]byte, HandshakeLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return h, err
+	}
+	if int(buf[0]) != len(ProtocolString) || string(buf[1:1+len(ProtocolString)]) != ProtocolString {
+		return h, fmt.Errorf("%w: unexpected protocol string %q", ErrBadHandshake, buf[1:1+len(ProtocolString)])
+	}
+
+	rest := buf[1+len(ProtocolString):]
+	copy(h.Reserved[:], rest[0:8])
+	copy(h.InfoHash[:], rest[8:28])
+	copy(h.PeerID[:], rest[28:48])
+	return h, nil
+}
@@ -0,0 +1,65 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func handshakeFixture() ([]byte, Handshake) {
+	var h Handshake
+	h.SetExtensions()
+	h.SetFast()
+	copy(h.InfoHash[:], "aaaaaaaaaaaaaaaaaaaa")
+	copy(h.PeerID[:], "-BT0001-bbbbbbbbbbbb")
+
+	wire := []byte{19}
+	wire = append(wire, "BitTorrent protocol"...)
+	wire = append(wire, 0, 0, 0, 0, 0, 0x10, 0, 0x04)
+	wire = append(wire, "aaaaaaaaaaaaaaaaaaaa"...)
+	wire = append(wire, "-BT0001-bbbbbbbbbbbb"...)
+	return wire, h
+}
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	wire, h := handshakeFixture()
+	if got := h.Marshal(); !bytes.Equal(got, wire) {
+		t.Fatalf("Marshal = %x, want %x", got, wire)
+	}
+
+	got, err := ReadHandshake(bytes.NewReader(wire))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != h {
+		t.Fatalf("ReadHandshake = %+v, want %+v", got, h)
+	}
+	if !got.SupportsExtensions() || !got.SupportsFast() || got.SupportsDHT() {
+		t.Fatalf("reserved bits %x decoded wrongly", got.Reserved)
+	}
+}
+
+func TestReadHandshakeTruncated(t *testing.T) {
+	wire, _ := handshakeFixture()
+	for _, n := range []int{0, 1, 20, HandshakeLen - 1} {
+		_, err := ReadHandshake(bytes.NewReader(wire[:n]))
+		if n == 0 && err != io.EOF || n > 0 && !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("ReadHandshake of %d bytes = %v", n, err)
+		}
+	}
+}
+
+func TestReadHandshakeWrongProtocol(t *testing.T) {
+	wire, _ := handshakeFixture()
+	for _, corrupt := range []func([]byte){
+		func(b []byte) { b[0] = 18 },
+		func(b []byte) { copy(b[1:], "BitTorrent Protocol") },
+	} {
+		b := bytes.Clone(wire)
+		corrupt(b)
+		if _, err := ReadHandshake(bytes.NewReader(b)); !errors.Is(err, ErrBadHandshake) {
+			t.Errorf("ReadHandshake(%q) = %v, want ErrBadHandshake", b[:20], err)
+		}
+	}
+}
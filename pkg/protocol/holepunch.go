@@ -0,0 +1,89 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+// HolepunchType is the kind of a ut_holepunch (BEP 55) message.
+type HolepunchType uint8
+
+const (
+	// HolepunchRendezvous asks a relay to connect us to the peer at Addr.
+	HolepunchRendezvous HolepunchType = 0
+	// HolepunchConnect tells both ends of a rendezvous to connect to Addr.
+	HolepunchConnect HolepunchType = 1
+	// HolepunchError reports why a rendezvous for Addr failed.
+	HolepunchError HolepunchType = 2
+)
+
+// HolepunchErrCode explains a HolepunchError message.
+type HolepunchErrCode uint32
+
+const (
+	HolepunchNoSuchPeer   HolepunchErrCode = 1
+	HolepunchNotConnected HolepunchErrCode = 2
+	HolepunchNoSupport    HolepunchErrCode = 3
+	HolepunchNoSelf       HolepunchErrCode = 4
+)
+
+func (c HolepunchErrCode) String() string {
+	switch c {
+	case HolepunchNoSuchPeer:
+		return "no such peer"
+	case HolepunchNotConnected:
+		return "not connected"
+	case HolepunchNoSupport:
+		return "no support"
+	case HolepunchNoSelf:
+		return "no self"
+	}
+	return fmt.Sprintf("error %d", uint32(c))
+}
+
+// Holepunch is the payload of a ut_holepunch extended message.
+type Holepunch struct {
+	Type    HolepunchType
+	Addr    netip.AddrPort
+	ErrCode HolepunchErrCode
+}
+
+// Marshal encodes m as an extended message payload.
+func (m Holepunch) Marshal() []byte {
+	addr := m.Addr.Addr().Unmap()
+	b := []byte{byte(m.Type), 0}
+	if addr.Is6() {
+		b[1] = 1
+	}
+	b = append(b, addr.AsSlice()...)
+	b = binary.BigEndian.AppendUint16(b, m.Addr.Port())
+	return binary.BigEndian.AppendUint32(b, uint32(m.ErrCode))
+}
+
+// ParseHolepunch decodes an extended message payload.
+func ParseHolepunch(b []byte) (Holepunch, error) {
+	if len(b) < 2 {
+		return Holepunch{}, fmt.Errorf("holepunch message too short")
+	}
+	var size int
+	switch b[1] {
+	case 0:
+		size = 4
+	case 1:
+		size = 16
+	default:
+		return Holepunch{}, fmt.Errorf("holepunch message has unknown address type %d", b[1])
+	}
+	if len(b) != 2+size+2+4 {
+		return Holepunch{}, fmt.Errorf("holepunch message has %d bytes, want %d", len(b), 2+size+2+4)
+	}
+
+	addr, _ := netip.AddrFromSlice(b[2 : 2+size])
+	port := binary.BigEndian.Uint16(b[2+size:])
+	return Holepunch{
+		Type:    HolepunchType(b[0]),
+		Addr:    netip.AddrPortFrom(addr, port),
+		ErrCode: HolepunchErrCode(binary.BigEndian.Uint32(b[4+size:])),
+	}, nil
+}
@@ -0,0 +1,262 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// MessageID identifies a peer wire message.
+type MessageID uint8
+
+// Message ids from BEP 3 (core), BEP 5 (port), BEP 6 (fast extension) and
+// BEP 10 (extension protocol).
+const (
+	MsgChoke         MessageID = 0
+	MsgUnchoke       MessageID = 1
+	MsgInterested    MessageID = 2
+	MsgNotInterested MessageID = 3
+	MsgHave          MessageID = 4
+	MsgBitfield      MessageID = 5
+	MsgRequest       MessageID = 6
+	MsgPiece         MessageID = 7
+	MsgCancel        MessageID = 8
+	MsgPort          MessageID = 9
+	MsgSuggestPiece  MessageID = 0x0D
+	MsgHaveAll       MessageID = 0x0E
+	MsgHaveNone      MessageID = 0x0F
+	MsgRejectRequest MessageID = 0x10
+	MsgAllowedFast   MessageID = 0x11
+	MsgExtended      MessageID = 20
+)
+
+func (id MessageID) String() string {
+	switch id {
+	case MsgChoke:
+		return "choke"
+	case MsgUnchoke:
+		return "unchoke"
+	case MsgInterested:
+		return "interested"
+	case MsgNotInterested:
+		return "not interested"
+	case MsgHave:
+		return "have"
+	case MsgBitfield:
+		return "bitfield"
+	case MsgRequest:
+		return "request"
+	case MsgPiece:
+		return "piece"
+	case MsgCancel:
+		return "cancel"
+	case MsgPort:
+		return "port"
+	case MsgSuggestPiece:
+		return "suggest piece"
+	case MsgHaveAll:
+		return "have all"
+	case MsgHaveNone:
+		return "have none"
+	case MsgRejectRequest:
+		return "reject request"
+	case MsgAllowedFast:
+		return "allowed fast"
+	case MsgExtended:
+		return "extended"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(id))
+}
+
+var ErrUnknownMessage = errors.New("unknown message id")
+
+// Message is a single peer wire message. AppendPayload appends the bytes that
+// follow the message id on the wire.
+type Message interface {
+	ID() MessageID
+	AppendPayload(b []byte) []byte
+}
+
+// KeepAlive is the zero-length message. It has no id on the wire; ID returns
+// 0 but Writer special-cases it.
+type KeepAlive struct{}
+
+type Choke struct{}
+type Unchoke struct{}
+type Interested struct{}
+type NotInterested struct{}
+type HaveAll struct{}
+type HaveNone struct{}
+
+type Have struct{ Index uint32 }
+type SuggestPiece struct{ Index uint32 }
+type AllowedFast struct{ Index uint32 }
+
+type Request struct{ Index, Begin, Length uint32 }
+type Cancel struct{ Index, Begin, Length uint32 }
+type RejectRequest struct{ Index, Begin, Length uint32 }
+
+type Piece struct {
+	Index uint32
+	Begin uint32
+	Block []byte
+}
+
+type Port struct{ Port uint16 }
+
+// Extended is a BEP 10 message. ExtendedID 0 is the extension handshake.
+type Extended struct {
+	ExtendedID uint8
+	Payload    []byte
+}
+
+func (KeepAlive) ID() MessageID     { return 0 }
+func (Choke) ID() MessageID         { return MsgChoke }
+func (Unchoke) ID() MessageID       { return MsgUnchoke }
+func (Interested) ID() MessageID    { return MsgInterested }
+func (NotInterested) ID() MessageID { return MsgNotInterested }
+func (HaveAll) ID() MessageID       { return MsgHaveAll }
+func (HaveNone) ID() MessageID      { return MsgHaveNone }
+func (Have) ID() MessageID          { return MsgHave }
+func (SuggestPiece) ID() MessageID  { return MsgSuggestPiece }
+func (AllowedFast) ID() MessageID   { return MsgAllowedFast }
+func (Request) ID() MessageID       { return MsgRequest }
+func (Cancel) ID() MessageID        { return MsgCancel }
+func (RejectRequest) ID() MessageID { return MsgRejectRequest }
+func (Piece) ID() MessageID         { return MsgPiece }
+func (Port) ID() MessageID          { return MsgPort }
+func (Extended) ID() MessageID      { return MsgExtended }
+
+func (KeepAlive) AppendPayload(b []byte) []byte     { return b }
+func (Choke) AppendPayload(b []byte) []byte         { return b }
+func (Unchoke) AppendPayload(b []byte) []byte       { return b }
+func (Interested) AppendPayload(b []byte) []byte    { return b }
+func (NotInterested) AppendPayload(b []byte) []byte { return b }
+func (HaveAll) AppendPayload(b []byte) []byte       { return b }
+func (HaveNone) AppendPayload(b []byte) []byte      { return b }
+
+func (m Have) AppendPayload(b []byte) []byte { return binary.BigEndian.AppendUint32(b, m.Index) }
+func (m SuggestPiece) AppendPayload(b []byte) []byte {
+	return binary.BigEndian.AppendUint32(b, m.Index)
+}
+func (m AllowedFast) AppendPayload(b []byte) []byte { return binary.BigEndian.AppendUint32(b, m.Index) }
+func (m Port) AppendPayload(b []byte) []byte        { return binary.BigEndian.AppendUint16(b, m.Port) }
+
+func (m Request) AppendPayload(b []byte) []byte {
+	return appendBlockRef(b, m.Index, m.Begin, m.Length)
+}
+
+func (m Cancel) AppendPayload(b []byte) []byte {
+	return appendBlockRef(b, m.Index, m.Begin, m.Length)
+}
+
+func (m RejectRequest) AppendPayload(b []byte) []byte {
+	return appendBlockRef(b, m.Index, m.Begin, m.Length)
+}
+
+func (m Piece) AppendPayload(b []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, m.Index)
+	b = binary.BigEndian.AppendUint32(b, m.Begin)
+	return append(b, m.Block...)
+}
+
+func (m Extended) AppendPayload(b []byte) []byte {
+	b = append(b, m.ExtendedID)
+	return append(b, m.Payload...)
+}
+
+func appendBlockRef(b []byte, index, begin, length uint32) []byte {
+	b = binary.BigEndian.AppendUint32(b, index)
+	b = binary.BigEndian.AppendUint32(b, begin)
+	return binary.BigEndian.AppendUint32(b, length)
+}
+
+// AppendMessage appends the length-prefixed wire encoding of m to b.
+func AppendMessage(b []byte, m Message) []byte {
+	if _, ok := m.(KeepAlive); ok {
+		return append(b, 0, 0, 0, 0)
+	}
+
+	start := len(b)
+	b = append(b, 0, 0, 0, 0, byte(m.ID()))
+	b = m.AppendPayload(b)
+	binary.BigEndian.PutUint32(b[start:], uint32(len(b)-start-4))
+	return b
+}
+
+// ParseMessage decodes a message from its id and payload. Byte slices in the
+// result alias payload.
+func ParseMessage(id MessageID, payload []byte) (Message, error) {
+	switch id {
+	case MsgChoke, MsgUnchoke, MsgInterested, MsgNotInterested, MsgHaveAll, MsgHaveNone:
+		if len(payload) != 0 {
+			return nil, fmt.Errorf("%s message has %d byte payload", id, len(payload))
+		}
+		switch id {
+		case MsgChoke:
+			return Choke{}, nil
+		case MsgUnchoke:
+			return Unchoke{}, nil
+		case MsgInterested:
+			return Interested{}, nil
+		case MsgNotInterested:
+			return NotInterested{}, nil
+		case MsgHaveAll:
+			return HaveAll{}, nil
+		default:
+			return HaveNone{}, nil
+		}
+	case MsgHave, MsgSuggestPiece, MsgAllowedFast:
+		if len(payload) != 4 {
+			return nil, fmt.Errorf("%s message has %d byte payload, want 4", id, len(payload))
+		}
+		index := binary.BigEndian.Uint32(payload)
+		switch id {
+		case MsgHave:
+			return Have{Index: index}, nil
+		case MsgSuggestPiece:
+			return SuggestPiece{Index: index}, nil
+		default:
+			return AllowedFast{Index: index}, nil
+		}
+	case MsgBitfield:
+		// The piece count is not known here; callers validate with
+		// BitfieldFromBytes.
+		return Bitfield{bits: payload, n: len(payload) * 8}, nil
+	case MsgRequest, MsgCancel, MsgRejectRequest:
+		if len(payload) != 12 {
+			return nil, fmt.Errorf("%s message has %d byte payload, want 12", id, len(payload))
+		}
+		index := binary.BigEndian.Uint32(payload[0:4])
+		begin := binary.BigEndian.Uint32(payload[4:8])
+		length := binary.BigEndian.Uint32(payload[8:12])
+		switch id {
+		case MsgRequest:
+			return Request{Index: index, Begin: begin, Length: length}, nil
+		case MsgCancel:
+			return Cancel{Index: index, Begin: begin, Length: length}, nil
+		default:
+			return RejectRequest{Index: index, Begin: begin, Length: length}, nil
+		}
+	case MsgPiece:
+		if len(payload) < 8 {
+			return nil, fmt.Errorf("piece message has %d byte payload, want at least 8", len(payload))
+		}
+		return Piece{
+			Index: binary.BigEndian.Uint32(payload[0:4]),
+			Begin: binary.BigEndian.Uint32(payload[4:8]),
+			Block: payload[8:],
+		}, nil
+	case MsgPort:
+		if len(payload) != 2 {
+			return nil, fmt.Errorf("port message has %d byte payload, want 2", len(payload))
+		}
+		return Port{Port: binary.BigEndian.Uint16(payload)}, nil
+	case MsgExtended:
+		if len(payload) < 1 {
+			return nil, fmt.Errorf("extended message has empty payload")
+		}
+		return Extended{ExtendedID: payload[0], Payload: payload[1:]}, nil
+	}
+	return nil, fmt.Errorf("%w %d", ErrUnknownMessage, uint8(id))
+}
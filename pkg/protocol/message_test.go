@@ -0,0 +1,147 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func bitfieldOf(bits ...byte) Bitfield {
+	return Bitfield{bits: bits, n: len(bits) * 8}
+}
+
+var messageFixtures = []struct {
+	msg  Message
+	wire []byte
+}{
+	{KeepAlive{}, []byte{0, 0, 0, 0}},
+	{Choke{}, []byte{0, 0, 0, 1, 0}},
+	{Unchoke{}, []byte{0, 0, 0, 1, 1}},
+	{Interested{}, []byte{0, 0, 0, 1, 2}},
+	{NotInterested{}, []byte{0, 0, 0, 1, 3}},
+	{Have{Index: 0x01020304}, []byte{0, 0, 0, 5, 4, 1, 2, 3, 4}},
+	{bitfieldOf(0xa0, 0x01), []byte{0, 0, 0, 3, 5, 0xa0, 0x01}},
+	{Request{Index: 1, Begin: 0x4000, Length: 0x4000}, []byte{0, 0, 0, 13, 6, 0, 0, 0, 1, 0, 0, 0x40, 0, 0, 0, 0x40, 0}},
+	{Piece{Index: 2, Begin: 16, Block: []byte("data")}, []byte{0, 0, 0, 13, 7, 0, 0, 0, 2, 0, 0, 0, 16, 'd', 'a', 't', 'a'}},
+	{Cancel{Index: 1, Begin: 2, Length: 3}, []byte{0, 0, 0, 13, 8, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3}},
+	{Port{Port: 6881}, []byte{0, 0, 0, 3, 9, 0x1a, 0xe1}},
+	{SuggestPiece{Index: 7}, []byte{0, 0, 0, 5, 0x0d, 0, 0, 0, 7}},
+	{HaveAll{}, []byte{0, 0, 0, 1, 0x0e}},
+	{HaveNone{}, []byte{0, 0, 0, 1, 0x0f}},
+	{RejectRequest{Index: 1, Begin: 2, Length: 3}, []byte{0, 0, 0, 13, 0x10, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3}},
+	{AllowedFast{Index: 9}, []byte{0, 0, 0, 5, 0x11, 0, 0, 0, 9}},
+	{Extended{ExtendedID: 0, Payload: []byte("de")}, []byte{0, 0, 0, 4, 20, 0, 'd', 'e'}},
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	for _, f := range messageFixtures {
+		if got := AppendMessage(nil, f.msg); !bytes.Equal(got, f.wire) {
+			t.Errorf("AppendMessage(%T) = %x, want %x", f.msg, got, f.wire)
+		}
+
+		m, err := NewReader(bytes.NewReader(f.wire)).ReadMessage()
+		if err != nil {
+			t.Errorf("ReadMessage(%x): %v", f.wire, err)
+			continue
+		}
+		if !reflect.DeepEqual(m, f.msg) {
+			t.Errorf("ReadMessage(%x) = %#v, want %#v", f.wire, m, f.msg)
+		}
+	}
+}
+
+func TestWriterBatchesMessages(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	var want []byte
+	for _, f := range messageFixtures {
+		w.WriteMessage(f.msg)
+		want = append(want, f.wire...)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("WriteMessage sent %d bytes before Flush", buf.Len())
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("Flush wrote %x, want %x", buf.Bytes(), want)
+	}
+
+	r := NewReader(&buf)
+	for _, f := range messageFixtures {
+		m, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("reading %T: %v", f.msg, err)
+		}
+		if !reflect.DeepEqual(m, f.msg) {
+			t.Fatalf("got %#v, want %#v", m, f.msg)
+		}
+	}
+	if _, err := r.ReadMessage(); err != io.EOF {
+		t.Fatalf("ReadMessage at end = %v, want io.EOF", err)
+	}
+}
+
+func TestReadMessageKeepAlive(t *testing.T) {
+	r := NewReader(bytes.NewReader([]byte{0, 0, 0, 0, 0, 0, 0, 1, 1}))
+	if m, err := r.ReadMessage(); err != nil || m != (KeepAlive{}) {
+		t.Fatalf("ReadMessage = %#v, %v, want keep-alive", m, err)
+	}
+	if m, err := r.ReadMessage(); err != nil || m != (Unchoke{}) {
+		t.Fatalf("ReadMessage after keep-alive = %#v, %v, want unchoke", m, err)
+	}
+}
+
+func TestReadMessageTooLarge(t *testing.T) {
+	r := NewReader(bytes.NewReader([]byte{0, 0, 0x40, 1, 7}))
+	r.MaxMessageSize = 0x4000
+	if _, err := r.ReadMessage(); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("ReadMessage = %v, want ErrMessageTooLarge", err)
+	}
+}
+
+func TestReadMessageShortRead(t *testing.T) {
+	for _, wire := range [][]byte{
+		{0, 0},                    // truncated length
+		{0, 0, 0, 5, 4, 0, 0},     // truncated payload
+		{0, 0, 0, 13, 7, 0, 0, 0}, // truncated piece header
+	} {
+		_, err := NewReader(bytes.NewReader(wire)).ReadMessage()
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("ReadMessage(%x) = %v, want io.ErrUnexpectedEOF", wire, err)
+		}
+	}
+}
+
+func TestReadMessageUnknownID(t *testing.T) {
+	wire := []byte{0, 0, 0, 3, 0x63, 0xaa, 0xbb, 0, 0, 0, 1, 2}
+	r := NewReader(bytes.NewReader(wire))
+	if _, err := r.ReadMessage(); !errors.Is(err, ErrUnknownMessage) {
+		t.Fatalf("ReadMessage = %v, want ErrUnknownMessage", err)
+	}
+	// The payload was consumed, so the next message is intact.
+	if m, err := r.ReadMessage(); err != nil || m != (Interested{}) {
+		t.Fatalf("ReadMessage after unknown id = %#v, %v, want interested", m, err)
+	}
+}
+
+func TestParseMessageBadLength(t *testing.T) {
+	for _, tc := range []struct {
+		id      MessageID
+		payload []byte
+	}{
+		{MsgChoke, []byte{0}},
+		{MsgHave, []byte{0, 0, 1}},
+		{MsgRequest, make([]byte, 11)},
+		{MsgPiece, make([]byte, 7)},
+		{MsgPort, []byte{1}},
+		{MsgExtended, nil},
+	} {
+		if m, err := ParseMessage(tc.id, tc.payload); err == nil {
+			t.Errorf("ParseMessage(%s, %x) = %#v, want error", tc.id, tc.payload, m)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// BlobStorage keeps each torrent's data contiguously in a single file below
+// Dir, named after the info hash, whatever files the torrent describes.
+type BlobStorage struct {
+	Dir string
+}
+
+func NewBlobStorage(dir string) *BlobStorage {
+	return &BlobStorage{Dir: dir}
+}
+
+func (s *BlobStorage) OpenTorrent(info *Info) (TorrentStorage, error) {
+	path := filepath.Join(s.Dir, hex.EncodeToString(info.InfoHash[:])+".blob")
+	f, err := openFile(path, info.Length)
+	if err != nil {
+		return nil, err
+	}
+	return &blobTorrent{info: info, path: path, file: f}, nil
+}
+
+type blobTorrent struct {
+	info *Info
+	path string
+	file *os.File
+}
+
+func (t *blobTorrent) ReadAt(p []byte, piece uint32, off int64) (int, error) {
+	off = t.info.Offset(piece, off)
+	n, short := clip(len(p), off, t.info.Length)
+	read, err := t.file.ReadAt(p[:n], off)
+	if err == nil && short {
+		err = io.EOF
+	}
+	return read, err
+}
+
+func (t *blobTorrent) WriteAt(p []byte, piece uint32, off int64) (int, error) {
+	off = t.info.Offset(piece, off)
+	n, short := clip(len(p), off, t.info.Length)
+	written, err := t.file.WriteAt(p[:n], off)
+	if err == nil && short {
+		err = errShortWrite
+	}
+	return written, err
+}
+
+func (t *blobTorrent) MarkComplete(piece uint32) error { return nil }
+func (t *blobTorrent) Sync() error                     { return t.file.Sync() }
+
+func (t *blobTorrent) Close() error {
+	if err := t.file.Sync(); err != nil {
+		t.file.Close()
+		return err
+	}
+	return t.file.Close()
+}
+
+func (t *blobTorrent) Path() string { return t.path }
+
+func (t *blobTorrent) Files() []LocalFile {
+	return []LocalFile{{Path: t.path, Offset: 0, Length: t.info.Length}}
+}
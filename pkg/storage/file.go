@@ -0,0 +1,307 @@
+package storage
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStorage writes each file of a torrent to its own path below Dir,
+// laid out as the torrent describes. This is the default backend. Files are
+// created on their first write, so skipped files are never allocated; their
+// share of pieces that also hold wanted data goes to a part file in Dir.
+type FileStorage struct {
+	Dir string
+}
+
+func NewFileStorage(dir string) *FileStorage {
+	return &FileStorage{Dir: dir}
+}
+
+func (s *FileStorage) OpenTorrent(info *Info) (TorrentStorage, error) {
+	t := &fileTorrent{
+		info:   info,
+		root:   filepath.Join(s.Dir, info.Name),
+		files:  make([]*os.File, len(info.Files)),
+		wanted: make([]bool, len(info.Files)),
+	}
+	for i, f := range info.Files {
+		if err := checkPath(f.Path); err != nil {
+			return nil, err
+		}
+		t.paths = append(t.paths, filepath.Join(append([]string{s.Dir}, f.Path...)...))
+		t.wanted[i] = true
+	}
+
+	parts, err := openPartFile(filepath.Join(s.Dir, "."+hex.EncodeToString(info.InfoHash[:])+".parts"), info.Geometry)
+	if err != nil {
+		return nil, err
+	}
+	t.parts = parts
+
+	// Files already on disk are used as they are, wanted or not.
+	for i, path := range t.paths {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		file, err := openFile(path, info.Files[i].Length)
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+		t.files[i] = file
+	}
+	return t, nil
+}
+
+// openFile opens a data file, creating it and its directory if needed.
+// Existing data is kept so an interrupted download can resume.
+func openFile(path string, size int64) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open output file: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to stat output file: %w", err)
+	}
+	if info.Size() != size {
+		if err := f.Truncate(size); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to allocate file space: %w", err)
+		}
+	}
+	return f, nil
+}
+
+type fileTorrent struct {
+	info  *Info
+	root  string
+	paths []string
+	parts *partFile
+
+	mu     sync.RWMutex
+	files  []*os.File // nil until the file exists
+	wanted []bool
+}
+
+// span calls fn for each file overlapping len(p) bytes of torrent data at
+// off, with the part of p and the offset of that part in the torrent.
+func (t *fileTorrent) span(p []byte, off int64, fn func(i int, p []byte, off int64) (int, error)) (int, error) {
+	total := 0
+	for i, f := range t.info.Files {
+		if len(p) == 0 {
+			break
+		}
+		if f.Length == 0 || off >= f.Offset+f.Length {
+			continue
+		}
+		chunk := p[:min(int64(len(p)), f.Offset+f.Length-off)]
+		n, err := fn(i, chunk, off)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+		off += int64(n)
+	}
+	return total, nil
+}
+
+func (t *fileTorrent) ReadAt(p []byte, piece uint32, off int64) (int, error) {
+	off = t.info.Offset(piece, off)
+	n, short := clip(len(p), off, t.info.Length)
+	read, err := t.span(p[:n], off, func(i int, p []byte, off int64) (int, error) {
+		t.mu.RLock()
+		file := t.files[i]
+		t.mu.RUnlock()
+
+		if file == nil {
+			return t.parts.ReadAt(p, off)
+		}
+		return file.ReadAt(p, off-t.info.Files[i].Offset)
+	})
+	if err != nil {
+		return read, err
+	}
+	if short {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+func (t *fileTorrent) WriteAt(p []byte, piece uint32, off int64) (int, error) {
+	off = t.info.Offset(piece, off)
+	n, short := clip(len(p), off, t.info.Length)
+	written, err := t.span(p[:n], off, func(i int, p []byte, off int64) (int, error) {
+		file, err := t.fileForWrite(i)
+		if err != nil {
+			return 0, err
+		}
+		if file == nil {
+			return t.parts.WriteAt(p, off)
+		}
+		return file.WriteAt(p, off-t.info.Files[i].Offset)
+	})
+	if err != nil {
+		return written, err
+	}
+	if short {
+		return written, errShortWrite
+	}
+	return written, nil
+}
+
+// fileForWrite returns the open file at index i, creating it if it is
+// wanted, or nil if its data belongs in the part file.
+func (t *fileTorrent) fileForWrite(i int) (*os.File, error) {
+	t.mu.RLock()
+	file, wanted := t.files[i], t.wanted[i]
+	t.mu.RUnlock()
+	if file != nil || !wanted {
+		return file, nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.createLocked(i)
+}
+
+// createLocked creates file i and moves any of its data out of the part
+// file. t.mu must be held.
+func (t *fileTorrent) createLocked(i int) (*os.File, error) {
+	if t.files[i] != nil {
+		return t.files[i], nil
+	}
+
+	f := t.info.Files[i]
+	file, err := openFile(t.paths[i], f.Length)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.parts.Has(f.Offset, f.Length) {
+		first, end := t.info.PieceRange(f.Offset, f.Length)
+		for piece := first; piece < end; piece++ {
+			start := max(f.Offset, t.info.PieceOffset(piece))
+			stop := min(f.Offset+f.Length, t.info.PieceOffset(piece)+t.info.PieceSize(piece))
+			buf := make([]byte, stop-start)
+			if _, err := t.parts.ReadAt(buf, start); err != nil {
+				file.Close()
+				return nil, err
+			}
+			if _, err := file.WriteAt(buf, start-f.Offset); err != nil {
+				file.Close()
+				return nil, err
+			}
+		}
+	}
+
+	t.files[i] = file
+	return file, nil
+}
+
+// SetFileWanted creates a newly wanted file right away, so data kept in the
+// part file moves into place. Unwanted files that already exist are kept.
+func (t *fileTorrent) SetFileWanted(i int, wanted bool) error {
+	if i < 0 || i >= len(t.files) {
+		return fmt.Errorf("file %d out of range", i)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.wanted[i] = wanted
+	if !wanted || !t.parts.Has(t.info.Files[i].Offset, t.info.Files[i].Length) {
+		return nil
+	}
+	_, err := t.createLocked(i)
+	return err
+}
+
+// MarkComplete creates wanted empty files, which no write would create.
+func (t *fileTorrent) MarkComplete(piece uint32) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, f := range t.info.Files {
+		if f.Length == 0 && t.wanted[i] && t.files[i] == nil {
+			if _, err := t.createLocked(i); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t *fileTorrent) Sync() error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for _, f := range t.files {
+		if f == nil {
+			continue
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	return t.parts.Sync()
+}
+
+func (t *fileTorrent) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var firstErr error
+	for i, f := range t.files {
+		if f == nil {
+			continue
+		}
+		if err := f.Sync(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		t.files[i] = nil
+	}
+	if err := t.parts.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+func (t *fileTorrent) Path() string {
+	if len(t.paths) == 1 && len(t.info.Files[0].Path) == 1 {
+		return t.paths[0]
+	}
+	return t.root
+}
+
+// Files returns the data files that exist, followed by the part file if
+// there is one. The part file may hold data from anywhere in the torrent.
+func (t *fileTorrent) Files() []LocalFile {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var local []LocalFile
+	for i, f := range t.files {
+		if f != nil {
+			local = append(local, LocalFile{Path: t.paths[i], Offset: t.info.Files[i].Offset, Length: t.info.Files[i].Length})
+		}
+	}
+	if t.parts.Exists() {
+		local = append(local, LocalFile{Path: t.parts.path, Offset: 0, Length: t.info.Length})
+	}
+	return local
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrBadGeometry = errors.New("invalid torrent geometry")
+
+// Geometry maps pieces to byte ranges of a torrent's data. Every piece is
+// PieceLength bytes except the last, which holds whatever remains.
+type Geometry struct {
+	PieceLength int64
+	Length      int64
+}
+
+// NewGeometry checks that the piece length is positive and the data length
+// is not negative.
+func NewGeometry(pieceLength, length int64) (Geometry, error) {
+	if pieceLength <= 0 {
+		return Geometry{}, fmt.Errorf("%w: piece length %d", ErrBadGeometry, pieceLength)
+	}
+	if length < 0 {
+		return Geometry{}, fmt.Errorf("%w: length %d", ErrBadGeometry, length)
+	}
+	return Geometry{PieceLength: pieceLength, Length: length}, nil
+}
+
+// NumPieces returns how many pieces cover the data.
+func (g Geometry) NumPieces() int {
+	if g.PieceLength <= 0 {
+		return 0
+	}
+	return int((g.Length + g.PieceLength - 1) / g.PieceLength)
+}
+
+// PieceOffset returns where a piece starts in the torrent data.
+func (g Geometry) PieceOffset(piece uint32) int64 {
+	return int64(piece) * g.PieceLength
+}
+
+// PieceSize returns the true length of a piece, or 0 for an index past the
+// end of the data.
+func (g Geometry) PieceSize(piece uint32) int64 {
+	start := g.PieceOffset(piece)
+	if start >= g.Length {
+		return 0
+	}
+	return min(g.PieceLength, g.Length-start)
+}
+
+// Contains reports whether n bytes at off lie within the piece.
+func (g Geometry) Contains(piece uint32, off, n int64) bool {
+	return off >= 0 && n >= 0 && off+n <= g.PieceSize(piece)
+}
+
+// Offset converts a piece-relative offset to an offset in the torrent data.
+func (g Geometry) Offset(piece uint32, off int64) int64 {
+	return g.PieceOffset(piece) + off
+}
+
+// PieceRange returns the pieces [first, end) overlapping length bytes of
+// torrent data starting at offset.
+func (g Geometry) PieceRange(offset, length int64) (first, end uint32) {
+	if length <= 0 || g.PieceLength <= 0 {
+		return 0, 0
+	}
+	first = uint32(offset / g.PieceLength)
+	end = uint32((offset+length-1)/g.PieceLength) + 1
+	return first, end
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+)
+
+// 2.5 pieces: the last piece is half length.
+var shortLast = Geometry{PieceLength: 16, Length: 40}
+
+func TestGeometryShortLastPiece(t *testing.T) {
+	if n := shortLast.NumPieces(); n != 3 {
+		t.Fatalf("NumPieces = %d, want 3", n)
+	}
+	for _, tc := range []struct {
+		piece        uint32
+		offset, size int64
+	}{
+		{0, 0, 16},
+		{1, 16, 16},
+		{2, 32, 8},
+		{3, 48, 0}, // past the end
+	} {
+		if got := shortLast.PieceOffset(tc.piece); got != tc.offset {
+			t.Errorf("PieceOffset(%d) = %d, want %d", tc.piece, got, tc.offset)
+		}
+		if got := shortLast.PieceSize(tc.piece); got != tc.size {
+			t.Errorf("PieceSize(%d) = %d, want %d", tc.piece, got, tc.size)
+		}
+	}
+
+	if !shortLast.Contains(2, 0, 8) || shortLast.Contains(2, 0, 9) || shortLast.Contains(2, 4, 5) {
+		t.Error("Contains does not stop at the end of the short last piece")
+	}
+	if got := shortLast.Offset(2, 5); got != 37 {
+		t.Errorf("Offset(2, 5) = %d, want 37", got)
+	}
+}
+
+func TestGeometryPieceRange(t *testing.T) {
+	for _, tc := range []struct {
+		offset, length int64
+		first, end     uint32
+	}{
+		{0, 40, 0, 3},  // everything
+		{32, 8, 2, 3},  // exactly the short piece
+		{39, 1, 2, 3},  // last byte
+		{15, 2, 0, 2},  // across a boundary
+		{16, 16, 1, 2}, // exactly one full piece
+		{20, 0, 0, 0},  // empty
+	} {
+		first, end := shortLast.PieceRange(tc.offset, tc.length)
+		if first != tc.first || end != tc.end {
+			t.Errorf("PieceRange(%d, %d) = [%d, %d), want [%d, %d)",
+				tc.offset, tc.length, first, end, tc.first, tc.end)
+		}
+	}
+}
+
+func TestNewGeometryRejectsBadLengths(t *testing.T) {
+	for _, tc := range []struct{ pieceLength, length int64 }{
+		{0, 40},
+		{-16, 40},
+		{16, -1},
+	} {
+		if _, err := NewGeometry(tc.pieceLength, tc.length); !errors.Is(err, ErrBadGeometry) {
+			t.Errorf("NewGeometry(%d, %d) = %v, want ErrBadGeometry", tc.pieceLength, tc.length, err)
+		}
+	}
+	if _, err := NewInfo([20]byte{}, "x", 0, []File{{Path: []string{"x"}, Length: 1}}); !errors.Is(err, ErrBadGeometry) {
+		t.Errorf("NewInfo with zero piece length = %v, want ErrBadGeometry", err)
+	}
+
+	// A Geometry built by hand with no piece length covers nothing rather
+	// than dividing by zero.
+	if first, end := (Geometry{Length: 40}).PieceRange(0, 40); first != 0 || end != 0 {
+		t.Errorf("PieceRange without piece length = [%d, %d)", first, end)
+	}
+
+	g, err := NewGeometry(16, 40)
+	if err != nil || g != shortLast {
+		t.Errorf("NewGeometry(16, 40) = %+v, %v", g, err)
+	}
+}
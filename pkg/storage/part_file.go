@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// partFile keeps the data of skipped files that falls in pieces shared with
+// wanted files, so the shared pieces can still be verified and uploaded
+// without allocating the skipped files. The file is a sequence of slots,
+// each a 4-byte piece index followed by a whole piece's worth of space.
+type partFile struct {
+	path     string
+	geometry Geometry
+
+	mu    sync.Mutex
+	file  *os.File
+	slots map[uint32]int64 // piece -> slot number
+}
+
+// openPartFile loads the slot table of an existing part file. The file
+// itself is only created on the first write.
+func openPartFile(path string, geometry Geometry) (*partFile, error) {
+	p := &partFile{path: path, geometry: geometry, slots: make(map[uint32]int64)}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open part file: %w", err)
+	}
+	p.file = f
+
+	var header [4]byte
+	for slot := int64(0); ; slot++ {
+		_, err := f.ReadAt(header[:], slot*p.slotSize())
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to read part file: %w", err)
+		}
+		p.slots[binary.BigEndian.Uint32(header[:])] = slot
+	}
+	return p, nil
+}
+
+func (p *partFile) slotSize() int64 {
+	return 4 + p.geometry.PieceLength
+}
+
+// each calls fn for every piece overlapped by len(b) bytes of torrent data
+// at off, with the matching part of b and the offset within the piece.
+func (p *partFile) each(b []byte, off int64, fn func(b []byte, piece uint32, pieceOff int64) error) error {
+	for len(b) > 0 {
+		piece := uint32(off / p.geometry.PieceLength)
+		pieceOff := off - p.geometry.PieceOffset(piece)
+		n := min(int64(len(b)), p.geometry.PieceLength-pieceOff)
+		if err := fn(b[:n], piece, pieceOff); err != nil {
+			return err
+		}
+		b = b[n:]
+		off += n
+	}
+	return nil
+}
+
+// ReadAt reads torrent data at off. Data never written reads as zeros.
+func (p *partFile) ReadAt(b []byte, off int64) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	err := p.each(b, off, func(b []byte, piece uint32, pieceOff int64) error {
+		slot, ok := p.slots[piece]
+		if !ok || p.file == nil {
+			clear(b)
+			return nil
+		}
+		_, err := p.file.ReadAt(b, slot*p.slotSize()+4+pieceOff)
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// WriteAt writes torrent data at off, adding slots as needed.
+func (p *partFile) WriteAt(b []byte, off int64) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	err := p.each(b, off, func(b []byte, piece uint32, pieceOff int64) error {
+		slot, ok := p.slots[piece]
+		if !ok {
+			if p.file == nil {
+				f, err := os.OpenFile(p.path, os.O_RDWR|os.O_CREATE, 0o644)
+				if err != nil {
+					return fmt.Errorf("failed to create part file: %w", err)
+				}
+				p.file = f
+			}
+			slot = int64(len(p.slots))
+			var header [4]byte
+			binary.BigEndian.PutUint32(header[:], piece)
+			if _, err := p.file.WriteAt(header[:], slot*p.slotSize()); err != nil {
+				return err
+			}
+			p.slots[piece] = slot
+		}
+		_, err := p.file.WriteAt(b, slot*p.slotSize()+4+pieceOff)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Has reports whether any data overlapping the range was written.
+func (p *partFile) Has(off, length int64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	first, end := p.geometry.PieceRange(off, length)
+	for piece := first; piece < end; piece++ {
+		if _, ok := p.slots[piece]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Exists reports whether the part file has been created.
+func (p *partFile) Exists() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.file != nil
+}
+
+func (p *partFile) Sync() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.file == nil {
+		return nil
+	}
+	return p.file.Sync()
+}
+
+func (p *partFile) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.file == nil {
+		return nil
+	}
+	err := p.file.Sync()
+	if closeErr := p.file.Close(); err == nil {
+		err = closeErr
+	}
+	p.file = nil
+	return err
+}
@@ -0,0 +1,130 @@
+// Package storage decides where a torrent's data lives. The client reads and
+// writes pieces through a TorrentStorage, so data can be kept in local files,
+// in memory or in a user supplied backend such as an object store.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrBadPath = errors.New("unsafe file path in torrent")
+
+// Storage opens the data of torrents.
+type Storage interface {
+	OpenTorrent(info *Info) (TorrentStorage, error)
+}
+
+// TorrentStorage holds the data of one torrent. Offsets are relative to the
+// start of a piece; ReadAt and WriteAt may be called concurrently and follow
+// the io.ReaderAt and io.WriterAt contracts, so reading past the end of the
+// torrent returns io.EOF.
+type TorrentStorage interface {
+	ReadAt(p []byte, piece uint32, off int64) (int, error)
+	WriteAt(p []byte, piece uint32, off int64) (int, error)
+	// MarkComplete is called once a piece has been written and verified, and
+	// again for pieces restored from resume data.
+	MarkComplete(piece uint32) error
+	Close() error
+}
+
+// Syncer is implemented by storage that buffers writes. Sync is called
+// before resume data is saved.
+type Syncer interface {
+	Sync() error
+}
+
+// Selective is implemented by storage that can avoid allocating files the
+// user skipped. Data of a skipped file that shares a piece with a wanted
+// file is still written, but may be kept aside until the file is wanted.
+type Selective interface {
+	SetFileWanted(file int, wanted bool) error
+}
+
+// Local is implemented by storage that keeps data in local files, so resume
+// data can detect files changed behind the client's back.
+type Local interface {
+	// Path returns the file or directory holding the torrent's data.
+	Path() string
+	// Files returns the local files and the range of torrent data each holds.
+	Files() []LocalFile
+}
+
+// LocalFile is a local file holding Length bytes of torrent data starting at
+// Offset.
+type LocalFile struct {
+	Path   string
+	Offset int64
+	Length int64
+}
+
+// Info describes the layout of a torrent's data.
+type Info struct {
+	Geometry
+	InfoHash [20]byte
+	Name     string
+	Files    []File
+}
+
+// File is one file of the torrent. Path is relative to the download
+// directory; paths of a multi-file torrent start with the torrent name.
+type File struct {
+	Path   []string
+	Offset int64
+	Length int64
+}
+
+// NewInfo builds an Info, computing the offset of each file from the order
+// and lengths given. It fails for a piece length that is not positive.
+func NewInfo(infoHash [20]byte, name string, pieceLength int64, files []File) (*Info, error) {
+	info := &Info{InfoHash: infoHash, Name: name}
+	var length int64
+	for _, f := range files {
+		f.Offset = length
+		info.Files = append(info.Files, f)
+		length += f.Length
+	}
+	geometry, err := NewGeometry(pieceLength, length)
+	if err != nil {
+		return nil, err
+	}
+	info.Geometry = geometry
+	return info, nil
+}
+
+// checkPath rejects path elements that would escape the download directory.
+func checkPath(path []string) error {
+	if len(path) == 0 {
+		return fmt.Errorf("%w: empty path", ErrBadPath)
+	}
+	for _, part := range path {
+		if part == "" || part == "." || part == ".." || containsSeparator(part) {
+			return fmt.Errorf("%w: %q", ErrBadPath, path)
+		}
+	}
+	return nil
+}
+
+func containsSeparator(s string) bool {
+	for _, r := range s {
+		if r == '/' || r == '\\' {
+			return true
+		}
+	}
+	return false
+}
+
+// clip limits a transfer of n bytes at off to the torrent's length and
+// reports whether it was cut short.
+func clip(n int, off, length int64) (int, bool) {
+	if off >= length {
+		return 0, n > 0
+	}
+	if off+int64(n) > length {
+		return int(length - off), true
+	}
+	return n, false
+}
+
+var errShortWrite = fmt.Errorf("write past end of torrent: %w", io.ErrShortWrite)
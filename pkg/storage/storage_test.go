@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestInfo describes 40 bytes in 16-byte pieces spread over four files,
+// so pieces straddle file boundaries and one file is empty:
+//
+//	piece 0 [0,16)  a [0,10) b [10,16)
+//	piece 1 [16,32) b [16,30) c [30,32)
+//	piece 2 [32,40) c [32,40)
+func newTestInfo(t *testing.T) *Info {
+	t.Helper()
+	info, err := NewInfo([20]byte{1, 2, 3}, "name", 16, []File{
+		{Path: []string{"name", "a"}, Length: 10},
+		{Path: []string{"name", "empty"}, Length: 0},
+		{Path: []string{"name", "sub", "b"}, Length: 20},
+		{Path: []string{"name", "c"}, Length: 10},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func testContent() []byte {
+	content := make([]byte, 40)
+	for i := range content {
+		content[i] = byte(i + 1)
+	}
+	return content
+}
+
+// writeAll writes content in 7-byte chunks addressed from piece 0, so
+// writes cross both piece and file boundaries.
+func writeAll(t *testing.T, ts TorrentStorage, content []byte) {
+	t.Helper()
+	for off := 0; off < len(content); off += 7 {
+		chunk := content[off:min(off+7, len(content))]
+		if n, err := ts.WriteAt(chunk, 0, int64(off)); n != len(chunk) || err != nil {
+			t.Fatalf("WriteAt(%d bytes at %d) = %d, %v", len(chunk), off, n, err)
+		}
+	}
+}
+
+// checkContent reads the torrent back piece by piece and across boundaries.
+func checkContent(t *testing.T, ts TorrentStorage, content []byte) {
+	t.Helper()
+	for _, tc := range []struct {
+		piece    uint32
+		off, len int64
+	}{
+		{0, 0, 16},
+		{1, 0, 16},
+		{2, 0, 8},
+		{0, 8, 16}, // piece 0 into 1, a into b
+		{1, 12, 6}, // b into c, piece 1 into 2
+		{0, 0, 40}, // everything
+	} {
+		got := make([]byte, tc.len)
+		n, err := ts.ReadAt(got, tc.piece, tc.off)
+		if n != len(got) || err != nil {
+			t.Fatalf("ReadAt(%d bytes, piece %d, %d) = %d, %v", tc.len, tc.piece, tc.off, n, err)
+		}
+		start := 16*int64(tc.piece) + tc.off
+		if want := content[start : start+tc.len]; !bytes.Equal(got, want) {
+			t.Fatalf("ReadAt(%d bytes, piece %d, %d) = %v, want %v", tc.len, tc.piece, tc.off, got, want)
+		}
+	}
+}
+
+// checkEnd checks that transfers past the end of the torrent are cut short.
+func checkEnd(t *testing.T, ts TorrentStorage, content []byte) {
+	t.Helper()
+	buf := make([]byte, 16)
+	if n, err := ts.ReadAt(buf, 2, 0); n != 8 || err != io.EOF || !bytes.Equal(buf[:n], content[32:]) {
+		t.Errorf("ReadAt across the end = %d, %v, want 8, EOF", n, err)
+	}
+	if n, err := ts.ReadAt(buf, 3, 0); n != 0 || err != io.EOF {
+		t.Errorf("ReadAt past the end = %d, %v, want 0, EOF", n, err)
+	}
+	if n, err := ts.WriteAt(content[32:], 2, 0); n != 8 || err != nil {
+		t.Errorf("WriteAt of the last piece = %d, %v", n, err)
+	}
+	if n, err := ts.WriteAt(buf, 2, 0); n != 8 || !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("WriteAt across the end = %d, %v, want 8, ErrShortWrite", n, err)
+	}
+}
+
+func TestBackends(t *testing.T) {
+	backends := []struct {
+		name string
+		open func(dir string) Storage
+	}{
+		{"file", func(dir string) Storage { return NewFileStorage(dir) }},
+		{"blob", func(dir string) Storage { return NewBlobStorage(dir) }},
+		{"memory", func(string) Storage { return NewMemoryStorage() }},
+	}
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			info, content := newTestInfo(t), testContent()
+			s := b.open(t.TempDir())
+
+			ts, err := s.OpenTorrent(info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeAll(t, ts, content)
+			checkContent(t, ts, content)
+			for piece := range uint32(info.NumPieces()) {
+				if err := ts.MarkComplete(piece); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := ts.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The data is still there when the torrent is opened again.
+			ts, err = s.OpenTorrent(info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ts.Close()
+			checkContent(t, ts, content)
+			checkEnd(t, ts, content)
+		})
+	}
+}
+
+func TestFileStorageLayout(t *testing.T) {
+	info, content := newTestInfo(t), testContent()
+	dir := t.TempDir()
+	ts, err := NewFileStorage(dir).OpenTorrent(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	writeAll(t, ts, content)
+	if err := ts.MarkComplete(0); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, f := range info.Files {
+		got, err := os.ReadFile(filepath.Join(append([]string{dir}, f.Path...)...))
+		if err != nil {
+			t.Fatalf("file %d: %v", i, err)
+		}
+		if want := content[f.Offset : f.Offset+f.Length]; !bytes.Equal(got, want) {
+			t.Errorf("%v holds %v, want %v", f.Path, got, want)
+		}
+	}
+
+	local := ts.(Local)
+	if path := local.Path(); path != filepath.Join(dir, "name") {
+		t.Errorf("Path() = %q", path)
+	}
+	if files := local.Files(); len(files) != len(info.Files) {
+		t.Errorf("Files() = %v, want the %d data files and no part file", files, len(info.Files))
+	}
+}
+
+func TestFileStorageRejectsUnsafePaths(t *testing.T) {
+	for _, path := range [][]string{
+		{},
+		{"name", ".."},
+		{"name", ""},
+		{"name", "a/b"},
+		{"name", `a\b`},
+	} {
+		info, err := NewInfo([20]byte{}, "name", 16, []File{{Path: path, Length: 1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewFileStorage(t.TempDir()).OpenTorrent(info); !errors.Is(err, ErrBadPath) {
+			t.Errorf("OpenTorrent with path %q = %v, want ErrBadPath", path, err)
+		}
+	}
+}
+
+func TestPartFile(t *testing.T) {
+	info, content := newTestInfo(t), testContent()
+	dir := t.TempDir()
+	pathB := filepath.Join(dir, "name", "sub", "b")
+
+	ts, err := NewFileStorage(dir).OpenTorrent(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.(Selective).SetFileWanted(2, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// b's share of pieces 0 and 1 goes to the part file instead of b.
+	writeAll(t, ts, content)
+	checkContent(t, ts, content)
+	if _, err := os.Stat(pathB); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("skipped file was created: %v", err)
+	}
+	files := ts.(Local).Files()
+	if len(files) != 3 || files[2].Path != filepath.Join(dir, "."+hex.EncodeToString(info.InfoHash[:])+".parts") {
+		t.Fatalf("Files() = %v, want a, c and the part file", files)
+	}
+	if err := ts.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening loads the part file's slots, so b's data is still found.
+	ts, err = NewFileStorage(dir).OpenTorrent(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+	checkContent(t, ts, content)
+
+	// Wanting b again moves its data out of the part file.
+	if err := ts.(Selective).SetFileWanted(2, true); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(pathB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content[10:30]) {
+		t.Fatalf("b holds %v after SetFileWanted, want %v", got, content[10:30])
+	}
+	checkContent(t, ts, content)
+
+	if err := ts.(Selective).SetFileWanted(4, true); err == nil {
+		t.Error("SetFileWanted accepted a file index out of range")
+	}
+}